@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -10,10 +12,14 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Melsoft-Games/ant-watcher/internal/api"
 	"github.com/Melsoft-Games/ant-watcher/internal/config"
 	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/pusher"
 	"github.com/Melsoft-Games/ant-watcher/internal/server"
 	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/Melsoft-Games/ant-watcher/internal/wal"
+	"github.com/google/go-github/v66/github"
 )
 
 func main() {
@@ -30,10 +36,82 @@ func main() {
 	logger.ChangeLogLevel(cfg.LogLevel)
 
 	// Initialize the data store
-	dataStore := store.NewStore()
+	var backend store.Backend
+	var memStore *store.Store // Snapshots and the write-ahead log are only used by the memory backend
+	switch cfg.StorageBackend {
+	case config.StorageBackendDisk:
+		if backend, err = store.OpenDiskStore(cfg.StoragePath); err != nil {
+			log.Fatalf("Failed to open disk store: %v", err)
+		}
+		logger.Infof("Using disk store at %s", cfg.StoragePath)
+	default:
+		memStore = store.NewStore()
+		backend = memStore
+	}
+	store.ConfigureHistograms(cfg)
+
+	// Журнал принятых вебхуков, без него теряется всё, что пришло после последнего снапшота
+	var walLog *wal.Log
+	if cfg.WALDir != "" {
+		if walLog, err = wal.Open(cfg.WALDir, int64(cfg.WALSegmentSizeBytes)); err != nil {
+			log.Fatalf("Failed to open write-ahead log: %v", err)
+		}
+	}
+
+	// Восстановление состояния из снапшота до того, как начнут приходить вебхуки
+	var walSeq uint64
+	if cfg.SnapshotPath != "" {
+		if walSeq, err = memStore.RestoreSnapshot(cfg.SnapshotPath); errors.Is(err, fs.ErrNotExist) {
+			logger.Infof("Snapshot %s not found, starting with an empty store", cfg.SnapshotPath)
+		} else if err != nil {
+			logger.Errorf("Failed to restore snapshot, starting with an empty store: %v", err)
+			// Записи журнала до снапшота уже удалены, применяем всё, что осталось
+			walSeq = 0
+		}
+	}
 
 	// Create a new server
-	srv := server.NewServer(cfg, dataStore)
+	srv := server.NewServer(cfg, backend)
+
+	// Доставки, принятые после снапшота, применяются поверх него
+	if walLog != nil {
+		srv.WebhookHandler.WAL = walLog
+		replayed, err := srv.WebhookHandler.Replay(walSeq)
+		if err != nil {
+			log.Fatalf("Failed to replay write-ahead log: %v", err)
+		}
+		logger.Infof("Replayed %d webhook deliveries from the write-ahead log", replayed)
+	}
+
+	// Background workers are stopped by cancelling this context on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Запуск пушера метрик, он ничего не делает, пока не задан PushMetricsUrl
+	go pusher.NewPusher(cfg, backend).Run(ctx)
+
+	// Запуск очистки хранилища от устаревших запусков по MemoryTTL и MaxRunAge
+	go store.RunJanitor(ctx, backend, cfg)
+
+	// Запуск периодического сохранения снапшотов
+	if cfg.SnapshotPath != "" {
+		go memStore.RunSnapshots(ctx, cfg, walLog)
+	}
+
+	// Добор пропущенных за время простоя запусков из GitHub API и исправление зависших,
+	// вебхуки тем временем принимаются
+	if cfg.UsesGitHubApp() || cfg.GitHubToken != "" {
+		client, err := api.NewClientFromConfig(cfg)
+		if err != nil {
+			log.Fatalf("Failed to create GitHub API client: %v", err)
+		}
+		if cfg.FetchHistoryTime > 0 {
+			go backfill(ctx, cfg, client, backend)
+		}
+		reconciler := api.NewReconciler(cfg, backend, client)
+		srv.AdminHandler.Reconciler = reconciler
+		go reconciler.Run(ctx)
+	}
 
 	// Запуск админ-сервера
 	go func() {
@@ -63,23 +141,62 @@ func main() {
 	}()
 
 	// Wait for the shutdown signal, to gracefully shutdown the servers
-	waitForShutdown(srv)
+	waitForShutdown(srv, cancel, func() {
+		if cfg.SnapshotPath != "" {
+			if err := memStore.Checkpoint(cfg.SnapshotPath, walLog); err != nil {
+				log.Printf("Failed to save snapshot: %v", err)
+			} else {
+				log.Printf("Snapshot saved to %s", cfg.SnapshotPath)
+			}
+		}
+		if walLog != nil {
+			walLog.Close()
+		}
+		if err := backend.Close(); err != nil {
+			log.Printf("Failed to close the store: %v", err)
+		}
+	})
+}
+
+// backfill fetches the runs of the last FetchHistory from the GitHub API into the store
+func backfill(ctx context.Context, cfg *config.Config, client *github.Client, backend store.Backend) {
+	scheduler, err := api.NewScheduler(cfg, backend, client)
+	if err != nil {
+		logger.Errorf("Backfill failed: %v", err)
+		return
+	}
+	logger.Infof("Backfilling workflow runs of the last %s from %s with %d workers", cfg.FetchHistoryTime, client.BaseURL, scheduler.Concurrency)
+	if len(cfg.GitHubOrgList) == 0 && cfg.UsesGitHubApp() {
+		// An installation token can't list organizations, the App backfills the repositories it is installed on
+		err = scheduler.BackfillInstallation(ctx, cfg.FetchHistoryTime)
+	} else {
+		err = scheduler.Backfill(ctx, cfg.GitHubOrgList, cfg.FetchHistoryTime)
+	}
+	if err != nil {
+		logger.Errorf("Backfill failed: %v", err)
+	}
 }
 
-// gracefully shutdown the servers
-func waitForShutdown(srv *server.Server) {
+// gracefully shutdown the servers, then call finish to save the state
+func waitForShutdown(srv *server.Server, stopWorkers context.CancelFunc, finish func()) {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
 	<-stop
 	log.Println("Shutting down server...")
+	stopWorkers()
 
 	// timeout for graceful shutdown by default is 5 seconds
-	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	// Call graceful shutdown for the servers
-	if err := srv.Shutdown(); err != nil {
+	err := srv.Shutdown(ctx)
+
+	// The webhook queue is drained at this point, so the snapshot has everything that was accepted
+	finish()
+
+	if err != nil {
 		log.Fatalf("Server shutdown failed: %v", err)
 	}
 
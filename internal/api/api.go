@@ -2,62 +2,243 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
 	"github.com/Melsoft-Games/ant-watcher/internal/store"
 	"github.com/google/go-github/v66/github"
 )
 
-// FetchRecentWorkflows собирает данные о WorkflowRun за указанный период из всех репозиториев организации
-func FetchRecentWorkflows(client *github.Client, org string, store *store.Store, fetchHistory time.Duration) error {
-	// Получаем текущую дату и вычисляем дату начала
-	fromTime := time.Now().Add(-fetchHistory)
+// Backfill добирает из API запуски за fetchHistory, пропущенные во время простоя.
+// Без orgs обходятся все организации, доступные токену. Ошибка одной организации
+// не останавливает остальные, все ошибки возвращаются вместе.
+func (s *Scheduler) Backfill(ctx context.Context, orgs []string, fetchHistory time.Duration) error {
+	if len(orgs) == 0 {
+		var err error
+		if orgs, err = s.listOrganizations(ctx); err != nil {
+			return fmt.Errorf("list organizations: %w", err)
+		}
+	}
 
-	// Получаем список всех репозиториев организации
-	opt := &github.RepositoryListByOrgOptions{
-		ListOptions: github.ListOptions{PerPage: 50},
+	var errs []error
+	for _, org := range orgs {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		if err := s.FetchRecentWorkflows(ctx, org, fetchHistory); err != nil {
+			errs = append(errs, fmt.Errorf("organization %s: %w", org, err))
+		}
 	}
+	return errors.Join(errs...)
+}
 
+// listOrganizations возвращает логины организаций, в которых состоит владелец токена
+func (s *Scheduler) listOrganizations(ctx context.Context) ([]string, error) {
+	var logins []string
+	opt := &github.ListOptions{PerPage: 100}
 	for {
-		repos, resp, err := client.Repositories.ListByOrg(context.Background(), org, opt)
+		orgs, resp, err := callAPI(ctx, s, func() ([]*github.Organization, *github.Response, error) {
+			return s.Client.Organizations.List(ctx, "", opt)
+		})
 		if err != nil {
-			return err
+			return nil, err
+		}
+		for _, org := range orgs {
+			logins = append(logins, org.GetLogin())
 		}
+		if resp.NextPage == 0 {
+			return logins, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// FetchRecentWorkflows собирает данные о WorkflowRun за указанный период из всех репозиториев
+// организации. Репозитории обходятся Concurrency воркерами, ошибка репозитория не прерывает
+// обход остальных, завершённые репозитории записываются в Checkpoint.
+func (s *Scheduler) FetchRecentWorkflows(ctx context.Context, org string, fetchHistory time.Duration) error {
+	return s.fetchRepos(ctx, "organization "+org, org, fetchHistory, func(repos chan<- *github.Repository) error {
+		return s.listRepositories(ctx, org, repos)
+	})
+}
+
+// BackfillInstallation собирает данные о WorkflowRun за указанный период из репозиториев,
+// доступных установке GitHub App, как FetchRecentWorkflows. Репозитории берутся из самой
+// установки: токен установки не может перечислить организации, а ListByOrg не работает
+// для аккаунтов пользователей.
+func (s *Scheduler) BackfillInstallation(ctx context.Context, fetchHistory time.Duration) error {
+	return s.fetchRepos(ctx, "the GitHub App installation", "", fetchHistory, func(repos chan<- *github.Repository) error {
+		return s.listInstallationRepositories(ctx, repos)
+	})
+}
 
-		for _, repo := range repos {
-			err := syncRepoWorkflows(client, org, *repo.Name, store, fromTime)
-			if err != nil {
-				return err
+// fetchRepos синхронизирует репозитории, которые list отправляет воркерам. what описывает их
+// в логе, org - владелец репозиториев, у которых он не указан.
+func (s *Scheduler) fetchRepos(ctx context.Context, what, org string, fetchHistory time.Duration, list func(repos chan<- *github.Repository) error) error {
+	started := time.Now()
+	fromTime := started.Add(-fetchHistory)
+
+	var (
+		mu                      sync.Mutex
+		errs                    []error
+		synced, resumed, failed int
+	)
+	repos := make(chan *github.Repository)
+	var wg sync.WaitGroup
+	for i := 0; i < max(s.Concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repo := range repos {
+				wasResumed, err := s.syncRepo(ctx, org, repo, fromTime)
+				mu.Lock()
+				switch {
+				case err != nil && ctx.Err() != nil:
+					// Cancelled, the repository is picked up by the next backfill
+				case err != nil:
+					failed++
+					errs = append(errs, fmt.Errorf("repository %s: %w", repo.GetFullName(), err))
+				case wasResumed:
+					resumed++
+				default:
+					synced++
+				}
+				mu.Unlock()
 			}
-		}
+		}()
+	}
 
+	listErr := list(repos)
+	close(repos)
+	wg.Wait()
+
+	if listErr != nil {
+		errs = append(errs, fmt.Errorf("list repositories: %w", listErr))
+	} else if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	logger.Infof("Backfilled workflow runs of %s for the last %s in %s: %d repositories synced, %d resumed, %d failed",
+		what, fetchHistory, time.Since(started), synced, resumed, failed)
+	return errors.Join(errs...)
+}
+
+// listRepositories отправляет репозитории организации воркерам, пока ctx не отменён
+func (s *Scheduler) listRepositories(ctx context.Context, org string, repos chan<- *github.Repository) error {
+	opt := &github.RepositoryListByOrgOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		page, resp, err := callAPI(ctx, s, func() ([]*github.Repository, *github.Response, error) {
+			return s.Client.Repositories.ListByOrg(ctx, org, opt)
+		})
+		if err != nil {
+			return err
+		}
+		for _, repo := range page {
+			select {
+			case repos <- repo:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
 		// Если есть следующая страница, продолжаем
 		if resp.NextPage == 0 {
-			break
+			return nil
 		}
 		opt.Page = resp.NextPage
 	}
+}
 
-	return nil
+// listInstallationRepositories отправляет воркерам репозитории, доступные установке GitHub App
+func (s *Scheduler) listInstallationRepositories(ctx context.Context, repos chan<- *github.Repository) error {
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := callAPI(ctx, s, func() (*github.ListRepositories, *github.Response, error) {
+			return s.Client.Apps.ListRepos(ctx, opt)
+		})
+		if err != nil {
+			return err
+		}
+		for _, repo := range page.Repositories {
+			select {
+			case repos <- repo:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// syncRepo синхронизирует репозиторий с начала окна или, если он уже был завершён,
+// с последней синхронизации и сообщает, была ли она продолжена
+func (s *Scheduler) syncRepo(ctx context.Context, org string, repo *github.Repository, fromTime time.Time) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	from, resumed := s.Checkpoint.resumeFrom(repo.GetFullName(), fromTime)
+	started := time.Now()
+	// Владелец берётся из самого репозитория: он может отличаться от переданной организации
+	owner := repo.GetOwner().GetLogin()
+	if owner == "" {
+		owner = org
+	}
+	if err := syncRepoWorkflows(ctx, s, owner, repo, from); err != nil {
+		backfillRepos.Inc("failed")
+		return resumed, err
+	}
+	if err := s.Checkpoint.done(repo.GetFullName(), fromTime, started); err != nil {
+		logger.Warningf("Repository %s is backfilled, but not recorded: %v", repo.GetFullName(), err)
+	}
+	if resumed {
+		backfillRepos.Inc("resumed")
+	} else {
+		backfillRepos.Inc("synced")
+	}
+	return resumed, nil
 }
 
 // syncRepoWorkflows синхронизирует WorkflowRun репозитория за определённый период
-func syncRepoWorkflows(client *github.Client, owner, repo string, store *store.Store, fromTime time.Time) error {
+func syncRepoWorkflows(ctx context.Context, s *Scheduler, owner string, repo *github.Repository, fromTime time.Time) error {
 	opt := &github.ListWorkflowRunsOptions{
-		Created: fromTime.Format(time.RFC3339), // Форматируем время в строку ISO 8601
+		Created: ">=" + fromTime.UTC().Format(time.RFC3339), // Запуски, созданные не раньше fromTime
 		ListOptions: github.ListOptions{
 			PerPage: 50,
 		},
 	}
 
+	stored := false
 	for {
-		runs, resp, err := client.Actions.ListRepositoryWorkflowRuns(context.Background(), owner, repo, opt)
+		runs, resp, err := callAPI(ctx, s, func() (*github.WorkflowRuns, *github.Response, error) {
+			return s.Client.Actions.ListRepositoryWorkflowRuns(ctx, owner, repo.GetName(), opt)
+		})
 		if err != nil {
 			return err
 		}
-		// Добавляем или обновляем каждый WorkflowRun в store
-		for _, run := range runs.WorkflowRuns {
-			store.AddOrUpdateWorkflow(run.GetID(), run)
+		// Репозиторий сохраняется первым, чтобы запуски сразу попали в дерево
+		if !stored && len(runs.WorkflowRuns) > 0 {
+			s.Store.AddOrUpdateRepository(repo.GetID(), models.NewRepository(repo))
+			stored = true
+		}
+		// Добавляем или обновляем каждый WorkflowRun в store вместе с джобами,
+		// более свежие данные из вебхуков не перезаписываются
+		for _, raw := range runs.WorkflowRuns {
+			run := models.NewWorkflowRun(raw)
+			if run.RepositoryID == nil {
+				run.RepositoryID = repo.ID
+			}
+			s.Store.AddOrUpdateWorkflowRun(raw.GetID(), run)
+			if _, err := syncRunJobs(ctx, s.Client, s, owner, repo, raw.GetID(), s.Store); err != nil {
+				return fmt.Errorf("jobs of run %d: %w", raw.GetID(), err)
+			}
 		}
 		// Переход на следующую страницу
 		if resp.NextPage == 0 {
@@ -67,3 +248,42 @@ func syncRepoWorkflows(client *github.Client, owner, repo string, store *store.S
 	}
 	return nil
 }
+
+// syncRunJobs сохраняет джобы всех попыток запуска так же, как джобы из вебхуков workflow_job,
+// и возвращает число джобов, состояние которых в store изменилось. Запросы идут через sched,
+// без него каждый запрос отправляется один раз.
+func syncRunJobs(ctx context.Context, client *github.Client, sched *Scheduler, owner string, repo *github.Repository, runID int64, store store.Backend) (int, error) {
+	opt := &github.ListWorkflowJobsOptions{
+		Filter:      "all", // Джобы предыдущих попыток тоже нужны, по умолчанию отдаётся только последняя
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	changed := 0
+	for {
+		jobs, resp, err := callAPI(ctx, sched, func() (*github.Jobs, *github.Response, error) {
+			return client.Actions.ListWorkflowJobs(ctx, owner, repo.GetName(), runID, opt)
+		})
+		if err != nil {
+			return changed, err
+		}
+		// Джобы из REST API не содержат репозиторий, он берётся из запуска
+		for _, job := range jobs.Jobs {
+			if storeJob(store, models.NewJob(job, repo.GetID())) {
+				changed++
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return changed, nil
+}
+
+// storeJob сохраняет джоб и сообщает, появился ли он или изменились его статус или результат
+func storeJob(store store.Backend, job *models.Job) bool {
+	prev, existed := store.GetJob(job.GetID())
+	store.AddOrUpdateJob(job.GetID(), job)
+	next, _ := store.GetJob(job.GetID())
+	return !existed || prev.GetStatus() != next.GetStatus() || prev.GetConclusion() != next.GetConclusion()
+}
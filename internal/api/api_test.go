@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGitHub serves the endpoints used by the backfill like a GitHub Enterprise Server
+func fakeGitHub(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/api/v3/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer test-token", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `[{"login":"org"},{"login":"broken"}]`)
+	})
+	mux.HandleFunc("/api/v3/orgs/org/repos", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			// A repository transferred to another owner is still listed by the organization
+			fmt.Fprint(w, `[{"id":2,"name":"lib","full_name":"team/lib","owner":{"login":"team"}}]`)
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s/api/v3/orgs/org/repos?page=2>; rel="next"`, srv.URL))
+		fmt.Fprint(w, `[{"id":1,"name":"app","full_name":"org/app"}]`)
+	})
+	mux.HandleFunc("/api/v3/orgs/broken/repos", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Server Error"}`, http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/api/v3/repos/org/app/actions/runs", func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.URL.Query().Get("created"), ">="))
+		fmt.Fprint(w, `{"total_count":2,"workflow_runs":[
+			{"id":100,"workflow_id":10,"name":"CI","status":"in_progress","updated_at":"2024-01-01T10:00:00Z"},
+			{"id":101,"workflow_id":10,"name":"CI","status":"completed","conclusion":"success"}]}`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/app/actions/runs/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "all", r.URL.Query().Get("filter"))
+		switch r.URL.Path {
+		case "/api/v3/repos/org/app/actions/runs/100/jobs":
+			fmt.Fprint(w, `{"total_count":2,"jobs":[
+				{"id":1001,"run_id":100,"run_attempt":1,"name":"build","status":"completed","conclusion":"failure",
+				 "started_at":"2024-01-01T10:01:00Z","completed_at":"2024-01-01T10:05:00Z","runner_name":"runner-1","labels":["linux"],
+				 "steps":[{"number":1,"name":"checkout","status":"completed","conclusion":"success"}]},
+				{"id":1002,"run_id":100,"run_attempt":2,"name":"build","status":"in_progress","started_at":"2024-01-01T10:06:00Z"}]}`)
+		case "/api/v3/repos/org/app/actions/runs/101/jobs":
+			fmt.Fprint(w, `{"total_count":1,"jobs":[{"id":1011,"run_id":101,"run_attempt":1,"name":"test","status":"completed","conclusion":"success"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/api/v3/repos/team/lib/actions/runs", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total_count":0,"workflow_runs":[]}`)
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestNewClient(t *testing.T) {
+	client, err := NewClient("token", "https://api.github.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.github.com/", client.BaseURL.String())
+
+	client, err = NewClient("token", "https://github.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.example.com/api/v3/", client.BaseURL.String())
+
+	client, err = NewClient("token", "https://github.example.com/api/v3")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.example.com/api/v3/", client.BaseURL.String())
+	assert.Equal(t, "https://github.example.com/api/uploads/", client.UploadURL.String())
+
+	_, err = NewClient("token", "github.example.com")
+	assert.Error(t, err)
+}
+
+// TestBackfill checks that the runs of every organization of the token are stored as workflow runs
+func TestBackfill(t *testing.T) {
+	srv := fakeGitHub(t)
+	client, err := NewClient("test-token", srv.URL)
+	assert.NoError(t, err)
+
+	// A webhook has already brought a newer state of run 100
+	s := store.NewStore()
+	s.AddOrUpdateWorkflowRun(100, models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(100), WorkflowID: github.Int64(10),
+		Status: github.String("completed"), Conclusion: github.String("failure"),
+		UpdatedAt: &github.Timestamp{Time: time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)}, Repository: &github.Repository{ID: github.Int64(1)}}))
+
+	// The broken organization doesn't stop the others
+	err = testScheduler(client, s).Backfill(context.Background(), nil, time.Hour)
+	assert.ErrorContains(t, err, "organization broken")
+	assert.NotContains(t, err.Error(), "organization org")
+
+	run, exists := s.GetWorkflowRun(101)
+	if assert.True(t, exists) {
+		assert.Equal(t, int64(1), run.GetRepositoryID())
+		assert.Equal(t, "success", run.GetConclusion())
+	}
+	run, _ = s.GetWorkflowRun(100)
+	assert.Equal(t, "failure", run.GetConclusion())
+	assert.Len(t, s.GetWorkflowRuns(10), 2)
+	_, exists = s.GetWorkflow(101)
+	assert.False(t, exists, "runs are not stored as workflows")
+
+	repo, exists := s.GetRepository(1)
+	if assert.True(t, exists) {
+		assert.Equal(t, "org/app", repo.GetFullName())
+	}
+	_, exists = s.GetRepository(2)
+	assert.False(t, exists, "repositories without runs are not stored")
+
+	// Configured organizations are backfilled without listing them
+	s = store.NewStore()
+	assert.NoError(t, testScheduler(client, s).Backfill(context.Background(), []string{"org"}, time.Hour))
+	assert.Len(t, s.GetAllWorkflowRuns(), 2)
+}
+
+// TestBackfillJobs checks that the jobs of every attempt are stored with their steps,
+// and that the webhook state of a job is kept when it's newer
+func TestBackfillJobs(t *testing.T) {
+	srv := fakeGitHub(t)
+	client, err := NewClient("test-token", srv.URL)
+	assert.NoError(t, err)
+
+	s := store.NewStore()
+	s.AddOrUpdateJob(1002, models.NewJob(&github.WorkflowJob{ID: github.Int64(1002), RunID: github.Int64(100), RunAttempt: github.Int64(2),
+		Status: github.String("completed"), Conclusion: github.String("success"),
+		CompletedAt: &github.Timestamp{Time: time.Date(2024, 1, 1, 10, 9, 0, 0, time.UTC)}}, 1))
+
+	assert.NoError(t, testScheduler(client, s).Backfill(context.Background(), []string{"org"}, time.Hour))
+
+	jobs := s.GetRunJobs(100)
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, int64(1), jobs[0].GetAttempt())
+		assert.Equal(t, "runner-1", jobs[0].GetRunnerName())
+		assert.Equal(t, []string{"linux"}, jobs[0].Labels)
+		assert.Equal(t, int64(1), jobs[0].GetRepositoryID())
+		assert.Len(t, s.GetJobSteps(1001), 1)
+
+		assert.Equal(t, int64(2), jobs[1].GetAttempt())
+		assert.Equal(t, "success", jobs[1].GetConclusion(), "the newer webhook state wins")
+		assert.NotNil(t, jobs[1].StartedAt, "fields missing in the webhook are taken from the API")
+	}
+	assert.Len(t, s.GetRunJobs(101), 1)
+	assert.Len(t, s.GetRepositoryJobs(1, "completed"), 3)
+}
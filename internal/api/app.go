@@ -0,0 +1,159 @@
+// internal/api/app.go
+// authentication as an installation of a GitHub App
+
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/google/go-github/v66/github"
+)
+
+const (
+	// jwtLifetime is how long an App JWT is valid, GitHub accepts at most 10 minutes
+	jwtLifetime = 9 * time.Minute
+	// jwtClockSkew backdates the JWT in case the clock of GitHub is behind ours
+	jwtClockSkew = time.Minute
+	// tokenRefreshMargin is how long before the expiry an installation token is replaced,
+	// so a request started with it doesn't fail halfway through a paginated listing
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// NewAppClient creates a GitHub API client authenticated as the installation
+// installationID of the GitHub App appID, see AppCredential
+func NewAppClient(appID, installationID int64, privateKey []byte, apiURL string) (*github.Client, error) {
+	cred, err := AppCredential("app", appID, installationID, privateKey, apiURL)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(&http.Client{Transport: cred.Transport}, apiURL)
+}
+
+// AppCredential authenticates as the installation installationID of the GitHub App appID.
+// privateKey is the PEM key of the App. Installation tokens are requested on the first
+// call and refreshed before they expire. apiURL is handled like in NewClient.
+func AppCredential(name string, appID, installationID int64, privateKey []byte, apiURL string) (Credential, error) {
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	// The client exchanging the JWT for installation tokens
+	apps, err := newClient(&http.Client{Transport: &jwtTransport{appID: appID, key: key}}, apiURL)
+	if err != nil {
+		return Credential{}, err
+	}
+	tokens := &installationTokens{apps: apps.Apps, installationID: installationID}
+	return Credential{Name: name, Transport: &installationTransport{tokens: tokens}}, nil
+}
+
+// parsePrivateKey reads a PEM RSA key, GitHub issues PKCS #1 keys, converted PKCS #8 ones work too
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("GitHub App private key is not in PEM format")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub App private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("GitHub App private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// jwtTransport authenticates requests as the App itself, which is only allowed for the /app endpoints
+type jwtTransport struct {
+	appID int64
+	key   *rsa.PrivateKey
+}
+
+func (t *jwtTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := signJWT(t.appID, t.key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// signJWT returns the RS256 JWT GitHub expects from an App
+func signJWT(appID int64, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-jwtClockSkew).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": strconv.FormatInt(appID, 10),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("sign GitHub App JWT: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// installationTokens keeps the current installation token and replaces it before it expires
+type installationTokens struct {
+	apps           *github.AppsService // Authenticated with the JWT of the App
+	installationID int64
+
+	mu        sync.Mutex // Held during the exchange, so concurrent requests wait for one new token
+	token     string
+	expiresAt time.Time
+}
+
+// get returns a token valid for at least tokenRefreshMargin
+func (it *installationTokens) get(ctx context.Context) (string, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.token != "" && time.Until(it.expiresAt) > tokenRefreshMargin {
+		return it.token, nil
+	}
+
+	token, _, err := it.apps.CreateInstallationToken(ctx, it.installationID, nil)
+	if err != nil {
+		return "", fmt.Errorf("create installation token: %w", err)
+	}
+	it.token, it.expiresAt = token.GetToken(), token.GetExpiresAt().Time
+	logger.Debugf("Installation token of installation %d refreshed, expires at %s", it.installationID, it.expiresAt)
+	return it.token, nil
+}
+
+// installationTransport authenticates requests with the installation token
+type installationTransport struct {
+	tokens *installationTokens
+}
+
+func (t *installationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.tokens.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
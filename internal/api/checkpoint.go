@@ -0,0 +1,104 @@
+// internal/api/checkpoint.go
+// record of the repositories the backfill has completed, so a restarted backfill resumes
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// resumeOverlap is how far before its last sync a completed repository is fetched again,
+// runs created while its listing was in progress might have been missed
+const resumeOverlap = time.Minute
+
+// repoCheckpoint says that the runs of a repository created between From and Synced are in the store
+type repoCheckpoint struct {
+	From   time.Time `json:"from"`
+	Synced time.Time `json:"synced"`
+}
+
+// Checkpoint keeps the completed repositories in a file. A backfill started again, after
+// a restart or an error, fetches those repositories only from their last sync and the
+// others from the start of the window. A nil Checkpoint remembers nothing.
+type Checkpoint struct {
+	path string
+
+	mu    sync.Mutex
+	repos map[string]repoCheckpoint // By full name of the repository
+}
+
+// LoadCheckpoint reads the checkpoint from path, a missing file is an empty checkpoint
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, repos: make(map[string]repoCheckpoint)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read backfill checkpoint: %v", err)
+	}
+	if err := json.Unmarshal(data, &c.repos); err != nil {
+		return nil, fmt.Errorf("could not decode backfill checkpoint %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// resumeFrom returns the time to fetch the runs of the repository from when it was
+// completed since from, otherwise from itself
+func (c *Checkpoint) resumeFrom(repo string, from time.Time) (time.Time, bool) {
+	if c == nil {
+		return from, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	done, ok := c.repos[repo]
+	if !ok || done.From.After(from) {
+		return from, false
+	}
+	if resumed := done.Synced.Add(-resumeOverlap); resumed.After(from) {
+		return resumed, true
+	}
+	return from, true
+}
+
+// done records that the runs of the repository created since from were fetched by a sync started at synced
+func (c *Checkpoint) done(repo string, from, synced time.Time) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.repos[repo] = repoCheckpoint{From: from, Synced: synced}
+	return c.save()
+}
+
+// save replaces the file atomically, a crash leaves the previous checkpoint
+func (c *Checkpoint) save() error {
+	data, err := json.Marshal(c.repos)
+	if err != nil {
+		return fmt.Errorf("could not encode backfill checkpoint: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("could not create backfill checkpoint: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write backfill checkpoint: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close backfill checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("could not replace backfill checkpoint: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// internal/api/client.go
+// GitHub API client built from the configuration
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/google/go-github/v66/github"
+)
+
+// publicAPIHost is the host of the API of github.com, other hosts are GitHub Enterprise Server
+const publicAPIHost = "api.github.com"
+
+// NewClient creates a GitHub API client authenticated with token. When apiURL points
+// to a GitHub Enterprise Server, e.g. https://github.example.com/api/v3, the client
+// sends its requests there instead of github.com.
+func NewClient(token, apiURL string) (*github.Client, error) {
+	client, err := newClient(nil, apiURL)
+	if err != nil {
+		return nil, err
+	}
+	return client.WithAuthToken(token), nil
+}
+
+// newClient creates a GitHub API client sending its requests through httpClient to apiURL
+func newClient(httpClient *http.Client, apiURL string) (*github.Client, error) {
+	client := github.NewClient(httpClient)
+	if apiURL == "" {
+		return client, nil
+	}
+
+	base, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub API URL %q: %v", apiURL, err)
+	}
+	if base.Host == "" {
+		return nil, fmt.Errorf("invalid GitHub API URL %q: no host", apiURL)
+	}
+	if strings.EqualFold(base.Host, publicAPIHost) {
+		return client, nil
+	}
+
+	// Uploads aren't used, but the URL must belong to the same server
+	uploads := url.URL{Scheme: base.Scheme, Host: base.Host, Path: "/api/uploads/"}
+	return client.WithEnterpriseURLs(base.String(), uploads.String())
+}
+
+// NewPoolClient creates a GitHub API client sending requests with the first credential
+// of creds that isn't rate limited, see credentialPool. apiURL is handled like in NewClient.
+func NewPoolClient(creds []Credential, apiURL string) (*github.Client, error) {
+	if len(creds) == 0 {
+		return nil, errors.New("no GitHub API credentials")
+	}
+	return newClient(&http.Client{Transport: newCredentialPool(creds)}, apiURL)
+}
+
+// NewClientFromConfig creates the client of the credentials in cfg: the GitHub App
+// installation if GitHubAppID is set, with GitHubToken as the fallback while the App
+// is rate limited, or GitHubToken alone. A GitHubToken changed by a reload is used
+// from the next request on, whether the API is used at all is decided on start.
+func NewClientFromConfig(cfg *config.Config) (*github.Client, error) {
+	var creds []Credential
+	if cfg.UsesGitHubApp() {
+		cred, err := AppCredential("app", cfg.GitHubAppIDNum, cfg.GitHubInstallationIDNum, cfg.GitHubAppPrivateKeyPEM, cfg.GitHubAPIURL)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+	if cfg.GitHubToken != "" {
+		creds = append(creds, ReloadableTokenCredential("token", cfg.APIToken))
+	}
+	return NewPoolClient(creds, cfg.GitHubAPIURL)
+}
@@ -0,0 +1,272 @@
+// internal/api/pool.go
+// ordered pool of credentials, the next one is used while the previous ones are rate limited
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+)
+
+const (
+	// defSecondaryBackoff is how long a credential rests after a secondary rate limit
+	// response without Retry-After, GitHub asks to wait at least a minute
+	defSecondaryBackoff = time.Minute
+	// defFailureBackoff is how long a credential rests after its request failed without a
+	// response, e.g. a network error or an installation token that couldn't be created
+	defFailureBackoff = time.Minute
+	// maxErrorBody limits how much of an error response is read to recognize a secondary rate limit
+	maxErrorBody = 64 << 10
+)
+
+var (
+	rateLimitRemaining = metrics.NewGauge("ant_watcher_github_rate_limit_remaining",
+		"Requests left in the current primary rate limit window of each GitHub API credential.", "credential")
+	rateLimitReset = metrics.NewGauge("ant_watcher_github_rate_limit_reset_timestamp_seconds",
+		"Unix time the primary rate limit window of each GitHub API credential resets.", "credential")
+	rateLimited = metrics.NewCounter("ant_watcher_github_rate_limited_total",
+		"Number of GitHub API responses refused because a rate limit of the credential was hit.", "credential", "limit")
+)
+
+func init() {
+	metrics.Register(rateLimitRemaining, rateLimitReset, rateLimited)
+}
+
+// Credential is one way to authenticate GitHub API requests
+type Credential struct {
+	Name      string            // Label of the credential in logs and metrics
+	Transport http.RoundTripper // Sends requests authenticated with the credential
+}
+
+// TokenCredential authenticates with a personal access or OAuth token
+func TokenCredential(name, token string) Credential {
+	return ReloadableTokenCredential(name, func() string { return token })
+}
+
+// ReloadableTokenCredential authenticates with the token returned by token, which is
+// called for every request, so a token changed by a config reload is used from the next
+// request on. A request without a token fails, the pool moves on to the next credential.
+func ReloadableTokenCredential(name string, token func() string) Credential {
+	return Credential{Name: name, Transport: &tokenTransport{token: token}}
+}
+
+// tokenTransport authenticates requests with the current token
+type tokenTransport struct {
+	token func() string
+}
+
+// errNoToken is returned for requests of a token credential whose token was removed
+var errNoToken = errors.New("the GitHub token is not set")
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.token()
+	if token == "" {
+		return nil, errNoToken
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// pooledCredential is a credential with what the pool knows about its rate limits
+type pooledCredential struct {
+	Credential
+	blockedUntil time.Time // The credential is rate limited until then
+}
+
+// credentialPool sends every request with the first credential that isn't rate limited.
+// A credential is skipped when a response refused the request because of a primary or
+// secondary rate limit, or reported that no requests are left, until the limit resets.
+// Then the pool returns to it, so the credentials later in the list are only fallbacks.
+// A credential whose request failed without a response is skipped for defFailureBackoff.
+type credentialPool struct {
+	mu    sync.Mutex
+	creds []*pooledCredential
+}
+
+func newCredentialPool(creds []Credential) *credentialPool {
+	pool := &credentialPool{}
+	for _, cred := range creds {
+		pool.creds = append(pool.creds, &pooledCredential{Credential: cred})
+	}
+	return pool
+}
+
+func (p *credentialPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[*pooledCredential]bool, len(p.creds))
+	var errs []error
+	for {
+		cred := p.pick(tried)
+		tried[cred] = true
+
+		attempt := req
+		if len(tried) > 1 && req.Body != nil && req.Body != http.NoBody {
+			// The body of the first attempt is consumed, a retry needs a new one
+			if req.GetBody == nil {
+				return nil, errNoRetryBody
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt = req.Clone(req.Context())
+			attempt.Body = body
+		}
+
+		resp, err := cred.Transport.RoundTrip(attempt)
+		if err != nil {
+			if req.Context().Err() != nil {
+				// The caller gave up, the credential is not to blame
+				return nil, err
+			}
+			p.fail(cred, err)
+			errs = append(errs, err)
+			if len(tried) == len(p.creds) {
+				return nil, errors.Join(errs...)
+			}
+			continue
+		}
+		limited := p.observe(cred, resp)
+		if !limited || len(tried) == len(p.creds) {
+			p.hideExhausted(resp)
+			return resp, nil
+		}
+		// The next credential retries the request, this response is not returned
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// fail keeps the credential out of use for defFailureBackoff after its request failed without a response
+func (p *credentialPool) fail(cred *pooledCredential, err error) {
+	until := time.Now().Add(defFailureBackoff)
+	p.mu.Lock()
+	if until.After(cred.blockedUntil) {
+		cred.blockedUntil = until
+	}
+	p.mu.Unlock()
+	logger.Warningf("GitHub API request with credential %s failed, it is not used until %s: %v", cred.Name, until.Format(time.RFC3339), err)
+}
+
+// errNoRetryBody is returned when a rate limited request can't be retried with another credential
+var errNoRetryBody = errors.New("the request body can't be sent again with the next credential")
+
+// pick returns the first credential that is neither rate limited nor tried yet. When all
+// of them are limited, the one resetting first is tried, the response tells the caller
+// how long to wait.
+func (p *credentialPool) pick(tried map[*pooledCredential]bool) *pooledCredential {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var soonest *pooledCredential
+	for _, cred := range p.creds {
+		if tried[cred] {
+			continue
+		}
+		if !cred.blockedUntil.After(now) {
+			return cred
+		}
+		if soonest == nil || cred.blockedUntil.Before(soonest.blockedUntil) {
+			soonest = cred
+		}
+	}
+	return soonest
+}
+
+// observe records the rate limit headers of the response and reports whether the
+// request was refused because of a rate limit
+func (p *credentialPool) observe(cred *pooledCredential, resp *http.Response) bool {
+	remaining, hasRemaining := headerInt(resp, "X-RateLimit-Remaining")
+	reset, hasReset := headerInt(resp, "X-RateLimit-Reset")
+	if hasRemaining {
+		rateLimitRemaining.Set(float64(remaining), cred.Name)
+	}
+	if hasReset {
+		rateLimitReset.Set(float64(reset), cred.Name)
+	}
+
+	refused := resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests
+	var until time.Time
+	limit := ""
+	switch {
+	case hasRemaining && remaining == 0 && hasReset:
+		// The window is used up, whether or not this request still made it
+		until, limit = time.Unix(reset, 0), "primary"
+	case refused && isSecondaryLimit(resp):
+		until, limit = time.Now().Add(retryAfter(resp)), "secondary"
+	default:
+		return false
+	}
+
+	p.mu.Lock()
+	if until.After(cred.blockedUntil) {
+		cred.blockedUntil = until
+	}
+	p.mu.Unlock()
+
+	if !refused {
+		logger.Warningf("GitHub API credential %s has no requests left until %s", cred.Name, until.Format(time.RFC3339))
+		return false
+	}
+	rateLimited.Inc(cred.Name, limit)
+	logger.Warningf("GitHub API credential %s hit the %s rate limit, it is not used until %s", cred.Name, limit, until.Format(time.RFC3339))
+	return true
+}
+
+// hideExhausted drops the reset time from a response that used up the window of its
+// credential while another credential is still available. go-github remembers the
+// rate limit of the last response and refuses the next requests itself until the
+// reset, which would keep them from reaching the pool.
+func (p *credentialPool) hideExhausted(resp *http.Response) {
+	if remaining, ok := headerInt(resp, "X-RateLimit-Remaining"); !ok || remaining > 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, cred := range p.creds {
+		if !cred.blockedUntil.After(now) {
+			resp.Header.Del("X-RateLimit-Reset")
+			return
+		}
+	}
+}
+
+// isSecondaryLimit reports whether a refused response is a secondary rate limit. GitHub
+// sends Retry-After with some of them, others are only recognized by the message.
+func isSecondaryLimit(resp *http.Response) bool {
+	if resp.Header.Get("Retry-After") != "" {
+		return true
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return err == nil && strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+}
+
+// retryAfter returns how long GitHub asked to wait after a secondary rate limit
+func retryAfter(resp *http.Response) time.Duration {
+	if seconds, ok := headerInt(resp, "Retry-After"); ok && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defSecondaryBackoff
+}
+
+func headerInt(resp *http.Response, name string) (int64, bool) {
+	value := resp.Header.Get(name)
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRateLimits answers /api/v3/user with the rate limit state of the token of the request
+type fakeRateLimits struct {
+	mu        sync.Mutex
+	remaining map[string]int  // Requests left for each token, missing tokens are unlimited
+	secondary map[string]bool // Tokens refused with a secondary rate limit once
+	reset     time.Time       // When the primary windows reset
+	used      []string        // Tokens of the requests in order
+}
+
+func (f *fakeRateLimits) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	token := r.Header.Get("Authorization")[len("Bearer "):]
+	f.used = append(f.used, token)
+
+	if f.secondary[token] {
+		delete(f.secondary, token)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message":"You have exceeded a secondary rate limit. Please wait a few minutes before you try again."}`)
+		return
+	}
+	remaining, limited := f.remaining[token]
+	if !limited {
+		remaining = 5000
+	}
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(f.reset.Unix(), 10))
+	if remaining == 0 {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message":"API rate limit exceeded"}`)
+		return
+	}
+	if limited {
+		f.remaining[token] = remaining - 1
+	}
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining-1))
+	fmt.Fprintf(w, `{"login":%q}`, token)
+}
+
+// TestCredentialPool checks that a rate limited credential is replaced by the next one until it resets
+func TestCredentialPool(t *testing.T) {
+	limits := &fakeRateLimits{
+		remaining: map[string]int{"first": 2},
+		secondary: map[string]bool{},
+		reset:     time.Now().Add(time.Hour),
+	}
+	srv := httptest.NewServer(http.StripPrefix("/api/v3", limits))
+	defer srv.Close()
+
+	client, err := NewPoolClient([]Credential{TokenCredential("first", "first"), TokenCredential("second", "second")}, srv.URL)
+	assert.NoError(t, err)
+	login := func() string {
+		user, _, err := client.Users.Get(context.Background(), "")
+		assert.NoError(t, err)
+		return user.GetLogin()
+	}
+
+	// The second request uses up the window of the first credential, the next ones go to the second
+	assert.Equal(t, "first", login())
+	assert.Equal(t, "first", login())
+	assert.Equal(t, "second", login())
+	assert.Equal(t, []string{"first", "first", "second"}, limits.used)
+	assert.Equal(t, float64(0), rateLimitRemaining.Value("first"))
+	assert.Equal(t, float64(4999), rateLimitRemaining.Value("second"))
+	assert.Equal(t, float64(limits.reset.Unix()), rateLimitReset.Value("first"))
+
+	// Once the window of the first credential resets, it is used again
+	pool := client.Client().Transport.(*credentialPool)
+	pool.creds[0].blockedUntil = time.Now().Add(-time.Second)
+	limits.remaining["first"] = 1
+	assert.Equal(t, "first", login())
+
+	// A refused request is retried with the next credential
+	limits.remaining["first"] = 0
+	limits.used = nil
+	pool.creds[0].blockedUntil = time.Time{}
+	refused := rateLimited.Value("first", "primary")
+	assert.Equal(t, "second", login())
+	assert.Equal(t, []string{"first", "second"}, limits.used)
+	assert.Equal(t, refused+1, rateLimited.Value("first", "primary"))
+
+	// So is one refused with a secondary rate limit, the credential rests for a minute
+	limits.remaining["first"] = 5
+	limits.secondary["first"] = true
+	limits.used = nil
+	pool.creds[0].blockedUntil = time.Time{}
+	assert.Equal(t, "second", login())
+	assert.Equal(t, []string{"first", "second"}, limits.used)
+	assert.WithinDuration(t, time.Now().Add(defSecondaryBackoff), pool.creds[0].blockedUntil, 5*time.Second)
+	assert.Equal(t, "second", login())
+}
+
+// failingTransport fails every request without a response
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+// TestCredentialPoolFailure checks that a credential whose request fails without a response
+// is replaced by the next one, and that the error is returned once every credential failed
+func TestCredentialPoolFailure(t *testing.T) {
+	limits := &fakeRateLimits{reset: time.Now().Add(time.Hour)}
+	srv := httptest.NewServer(http.StripPrefix("/api/v3", limits))
+	defer srv.Close()
+
+	broken := Credential{Name: "broken", Transport: failingTransport{}}
+	client, err := NewPoolClient([]Credential{broken, TokenCredential("second", "second")}, srv.URL)
+	assert.NoError(t, err)
+	user, _, err := client.Users.Get(context.Background(), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "second", user.GetLogin())
+	}
+	pool := client.Client().Transport.(*credentialPool)
+	assert.WithinDuration(t, time.Now().Add(defFailureBackoff), pool.creds[0].blockedUntil, 5*time.Second)
+
+	// The failed credential rests, the next request goes straight to the second one
+	limits.used = nil
+	_, _, err = client.Users.Get(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"second"}, limits.used)
+
+	client, err = NewPoolClient([]Credential{broken, {Name: "also-broken", Transport: failingTransport{}}}, srv.URL)
+	assert.NoError(t, err)
+	_, _, err = client.Users.Get(context.Background(), "")
+	assert.ErrorContains(t, err, "connection refused")
+}
+
+// TestTokenReload checks that the client of the config sends the token of the last reload
+func TestTokenReload(t *testing.T) {
+	limits := &fakeRateLimits{reset: time.Now().Add(time.Hour)}
+	srv := httptest.NewServer(http.StripPrefix("/api/v3", limits))
+	defer srv.Close()
+
+	t.Setenv("CONFIG_FILE_PATH", "not-existing.json")
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_TOKEN", "old-token")
+	cfg, err := config.LoadConfig()
+	assert.NoError(t, err)
+	client, err := NewClientFromConfig(cfg)
+	assert.NoError(t, err)
+	login := func() string {
+		user, _, err := client.Users.Get(context.Background(), "")
+		assert.NoError(t, err)
+		return user.GetLogin()
+	}
+	assert.Equal(t, "old-token", login())
+
+	t.Setenv("GITHUB_TOKEN", "new-token")
+	assert.NoError(t, cfg.ReloadConfig())
+	assert.Equal(t, "new-token", login())
+}
+
+// TestCredentialPoolExhausted checks that the caller sees the rate limit error when every credential is limited
+func TestCredentialPoolExhausted(t *testing.T) {
+	limits := &fakeRateLimits{
+		remaining: map[string]int{"only": 0},
+		reset:     time.Now().Add(time.Hour),
+	}
+	srv := httptest.NewServer(http.StripPrefix("/api/v3", limits))
+	defer srv.Close()
+
+	client, err := NewPoolClient([]Credential{TokenCredential("only", "only")}, srv.URL)
+	assert.NoError(t, err)
+	_, _, err = client.Users.Get(context.Background(), "")
+	var rateErr *github.RateLimitError
+	assert.True(t, errors.As(err, &rateErr), "unexpected error %v", err)
+
+	_, err = NewPoolClient(nil, srv.URL)
+	assert.Error(t, err)
+}
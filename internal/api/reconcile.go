@@ -0,0 +1,244 @@
+// internal/api/reconcile.go
+// targeted repair of runs and jobs the webhooks left unfinished
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/google/go-github/v66/github"
+)
+
+var (
+	reconcileRepaired = metrics.NewCounter("ant_watcher_reconcile_repaired_total",
+		"Number of runs and jobs whose state was repaired from the GitHub API.", "object")
+	reconcileFailed = metrics.NewCounter("ant_watcher_reconcile_failed_total",
+		"Number of runs and jobs the reconciler failed to look up in the GitHub API.", "object")
+)
+
+func init() {
+	metrics.Register(reconcileRepaired, reconcileFailed)
+}
+
+// ReconcileResult is the outcome of one reconciliation pass
+type ReconcileResult struct {
+	Checked  int `json:"checked"`  // Runs and jobs looked up in the API
+	Repaired int `json:"repaired"` // Runs and jobs whose state in the store changed, or runs deleted on GitHub
+	Failed   int `json:"failed"`   // Lookups that failed, they are retried on the next pass
+}
+
+// Reconciler repairs the gaps left by lost webhooks. Instead of fetching the whole
+// FetchHistory window again, it only looks up runs and jobs that are unfinished and
+// haven't been updated for Config.ReconcileThresholdTime, and runs whose jobs never arrived.
+type Reconciler struct {
+	Config *config.Config
+	Store  store.Backend
+	Client *github.Client
+
+	mu sync.Mutex // One pass at a time, periodic ones and the ones triggered from the admin server
+}
+
+// NewReconciler инициализирует реконсилер
+func NewReconciler(cfg *config.Config, s store.Backend, client *github.Client) *Reconciler {
+	return &Reconciler{
+		Config: cfg,
+		Store:  s,
+		Client: client,
+	}
+}
+
+// Run reconciles the store every Config.ReconcileIntervalTime until ctx is cancelled.
+// The interval and the threshold are read on every pass, so a reload applies without restart.
+func (r *Reconciler) Run(ctx context.Context) {
+	for {
+		interval, _ := r.Config.Reconcile()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		r.Reconcile(ctx)
+	}
+}
+
+// reconcileTarget is a run to look up, either with all its jobs or only the stuck ones
+type reconcileTarget struct {
+	owner, repo string
+	repoID      int64
+	run         *models.WorkflowRun
+	refetchRun  bool          // The run itself is stuck or has no jobs, it is fetched with all its jobs
+	jobs        []*models.Job // Stuck jobs of a run that is fine otherwise
+}
+
+// Reconcile makes one pass over the store and looks the stuck objects up in the API
+func (r *Reconciler) Reconcile(ctx context.Context) ReconcileResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	started := time.Now()
+	_, threshold := r.Config.Reconcile()
+	targets, unknown := r.findTargets(started.Add(-threshold))
+	var result ReconcileResult
+	for i := 0; i < unknown; i++ {
+		r.failed(&result, store.ObjectRun)
+	}
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		if target.refetchRun {
+			r.repairRun(ctx, target, &result)
+			continue
+		}
+		for _, job := range target.jobs {
+			r.repairJob(ctx, target, job, &result)
+		}
+	}
+
+	if result.Checked > 0 || result.Failed > 0 {
+		logger.Infof("Reconciled %d runs and jobs in %s: %d repaired, %d failed",
+			result.Checked, time.Since(started), result.Repaired, result.Failed)
+	}
+	return result
+}
+
+// findTargets returns the runs with something to repair and the number of stuck runs
+// that can't be looked up because their repository is unknown
+func (r *Reconciler) findTargets(cutoff time.Time) ([]reconcileTarget, int) {
+	var targets []reconcileTarget
+	unknown := 0
+	r.Store.ForEachRun(func(snapshot store.RunSnapshot) bool {
+		target := reconcileTarget{run: snapshot.Run}
+		last := lastUpdate(snapshot.Run, snapshot.Jobs)
+		stale := last == nil || last.Before(cutoff)
+		target.refetchRun = stale && (!store.IsCompleted(snapshot.Run.GetStatus()) || len(snapshot.Jobs) == 0)
+		if !target.refetchRun {
+			for _, job := range snapshot.Jobs {
+				if at := jobUpdate(job); !store.IsCompleted(job.GetStatus()) && (at == nil || at.Before(cutoff)) {
+					target.jobs = append(target.jobs, job)
+				}
+			}
+		}
+		if !target.refetchRun && len(target.jobs) == 0 {
+			return true
+		}
+
+		owner, repo, found := strings.Cut(snapshot.Repository.GetFullName(), "/")
+		if !found {
+			logger.Debugf("Run %d needs reconciling, but the name of repository %d is unknown", snapshot.Run.GetRunID(), snapshot.Run.GetRepositoryID())
+			unknown++
+			return true
+		}
+		target.owner, target.repo, target.repoID = owner, repo, snapshot.Repository.GetID()
+		targets = append(targets, target)
+		return true
+	})
+	return targets, unknown
+}
+
+// repairRun fetches the run with the jobs of all its attempts. A run deleted on GitHub
+// is deleted from the store too.
+func (r *Reconciler) repairRun(ctx context.Context, target reconcileTarget, result *ReconcileResult) {
+	runID := target.run.GetRunID()
+	result.Checked++
+	raw, _, err := r.Client.Actions.GetWorkflowRunByID(ctx, target.owner, target.repo, runID)
+	if isNotFound(err) {
+		if r.Store.DeleteWorkflowRun(runID) {
+			logger.Infof("Run %d of %s/%s is deleted on GitHub, removed from the store", runID, target.owner, target.repo)
+			r.repaired(result, store.ObjectRun, 1)
+		}
+		return
+	}
+	if err != nil {
+		logger.Warningf("Failed to reconcile run %d of %s/%s: %v", runID, target.owner, target.repo, err)
+		r.failed(result, store.ObjectRun)
+		return
+	}
+
+	run := models.NewWorkflowRun(raw)
+	if run.RepositoryID == nil {
+		run.RepositoryID = github.Int64(target.repoID)
+	}
+	r.Store.AddOrUpdateWorkflowRun(runID, run)
+	if stored, _ := r.Store.GetWorkflowRun(runID); stored.GetStatus() != target.run.GetStatus() ||
+		stored.GetConclusion() != target.run.GetConclusion() {
+		r.repaired(result, store.ObjectRun, 1)
+	}
+
+	repo := &github.Repository{ID: github.Int64(target.repoID), Name: github.String(target.repo)}
+	changed, err := syncRunJobs(ctx, r.Client, nil, target.owner, repo, runID, r.Store)
+	r.repaired(result, store.ObjectJob, changed)
+	if err != nil {
+		logger.Warningf("Failed to reconcile the jobs of run %d of %s/%s: %v", runID, target.owner, target.repo, err)
+		r.failed(result, store.ObjectJob)
+	}
+}
+
+// repairJob fetches a stuck job of a run that is fine otherwise
+func (r *Reconciler) repairJob(ctx context.Context, target reconcileTarget, job *models.Job, result *ReconcileResult) {
+	result.Checked++
+	raw, _, err := r.Client.Actions.GetWorkflowJobByID(ctx, target.owner, target.repo, job.GetID())
+	if err != nil {
+		logger.Warningf("Failed to reconcile job %d of %s/%s: %v", job.GetID(), target.owner, target.repo, err)
+		r.failed(result, store.ObjectJob)
+		return
+	}
+	if storeJob(r.Store, models.NewJob(raw, target.repoID)) {
+		r.repaired(result, store.ObjectJob, 1)
+	}
+}
+
+func (r *Reconciler) repaired(result *ReconcileResult, object store.ObjectKind, n int) {
+	if n == 0 {
+		return
+	}
+	result.Repaired += n
+	reconcileRepaired.Add(float64(n), string(object))
+}
+
+func (r *Reconciler) failed(result *ReconcileResult, object store.ObjectKind) {
+	result.Failed++
+	reconcileFailed.Inc(string(object))
+}
+
+// lastUpdate returns the time of the last known update of the run. Stub runs created
+// by their jobs have no times, the latest time of the jobs is used for them.
+func lastUpdate(run *models.WorkflowRun, jobs []*models.Job) *time.Time {
+	last := firstSet(run.UpdatedAt, run.RunStartedAt, run.CreatedAt)
+	for _, job := range jobs {
+		if at := jobUpdate(job); at != nil && (last == nil || at.After(*last)) {
+			last = at
+		}
+	}
+	return last
+}
+
+// jobUpdate returns the latest known time of the job, jobs have no updated_at
+func jobUpdate(job *models.Job) *time.Time {
+	return firstSet(job.CompletedAt, job.StartedAt, job.CreatedAt)
+}
+
+func firstSet(timestamps ...*time.Time) *time.Time {
+	for _, ts := range timestamps {
+		if ts != nil {
+			return ts
+		}
+	}
+	return nil
+}
+
+// isNotFound reports whether the API answered 404, e.g. for a deleted run
+func isNotFound(err error) bool {
+	var resp *github.ErrorResponse
+	return errors.As(err, &resp) && resp.Response != nil && resp.Response.StatusCode == http.StatusNotFound
+}
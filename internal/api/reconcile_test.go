@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func stuckRun(runID, repoID int64, status string, updatedAt time.Time) *models.WorkflowRun {
+	return models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(runID), WorkflowID: github.Int64(10),
+		Status: github.String(status), UpdatedAt: &github.Timestamp{Time: updatedAt}, Repository: &github.Repository{ID: github.Int64(repoID)}})
+}
+
+// TestReconcile checks that only stuck runs and jobs are looked up and repaired
+func TestReconcile(t *testing.T) {
+	now := time.Now().UTC()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/repos/org/app/actions/runs/200", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":200,"workflow_id":10,"status":"completed","conclusion":"success"}`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/app/actions/runs/200/jobs", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total_count":2,"jobs":[
+			{"id":2001,"run_id":200,"status":"completed","conclusion":"success"},
+			{"id":2002,"run_id":200,"status":"completed","conclusion":"success"}]}`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/app/actions/runs/201", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":201,"workflow_id":10,"status":"completed","conclusion":"failure"}`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/app/actions/runs/201/jobs", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total_count":1,"jobs":[{"id":2011,"run_id":201,"status":"completed","conclusion":"failure"}]}`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/app/actions/jobs/2021", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":2021,"run_id":202,"status":"in_progress","started_at":%q}`, now.Format(time.RFC3339))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/repos/org/app/actions/runs/203" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client, err := NewClient("test-token", srv.URL)
+	assert.NoError(t, err)
+
+	s := store.NewStore()
+	s.AddOrUpdateRepository(1, &models.Repository{ID: github.Int64(1), FullName: github.String("org/app")})
+	stale, fresh := now.Add(-2*time.Hour), now.Add(-time.Minute)
+	// The run and its job are stuck
+	s.AddOrUpdateWorkflowRun(200, stuckRun(200, 1, "in_progress", stale))
+	s.AddOrUpdateJob(2001, models.NewJob(&github.WorkflowJob{ID: github.Int64(2001), RunID: github.Int64(200),
+		Status: github.String("in_progress"), StartedAt: &github.Timestamp{Time: stale}}, 1))
+	// The run is completed, but its jobs never arrived
+	s.AddOrUpdateWorkflowRun(201, stuckRun(201, 1, "completed", stale))
+	// The run is fine, one of its jobs is stuck in the queue
+	s.AddOrUpdateWorkflowRun(202, stuckRun(202, 1, "in_progress", fresh))
+	s.AddOrUpdateJob(2021, models.NewJob(&github.WorkflowJob{ID: github.Int64(2021), RunID: github.Int64(202),
+		Status: github.String("queued"), CreatedAt: &github.Timestamp{Time: now.Add(-time.Hour)}}, 1))
+	s.AddOrUpdateJob(2022, models.NewJob(&github.WorkflowJob{ID: github.Int64(2022), RunID: github.Int64(202),
+		Status: github.String("in_progress"), StartedAt: &github.Timestamp{Time: fresh}}, 1))
+	// The run is deleted on GitHub
+	s.AddOrUpdateWorkflowRun(203, stuckRun(203, 1, "queued", stale))
+	// The repository of the run is unknown, it can't be looked up
+	s.AddOrUpdateWorkflowRun(205, stuckRun(205, 9, "queued", stale))
+
+	r := NewReconciler(&config.Config{ReconcileThresholdTime: 30 * time.Minute}, s, client)
+	failedRuns, repairedRuns, repairedJobs := reconcileFailed.Value("run"), reconcileRepaired.Value("run"), reconcileRepaired.Value("job")
+	assert.Equal(t, ReconcileResult{Checked: 4, Repaired: 7, Failed: 1}, r.Reconcile(context.Background()))
+
+	run, _ := s.GetWorkflowRun(200)
+	assert.Equal(t, "success", run.GetConclusion())
+	assert.Len(t, s.GetRunJobs(200), 2)
+	assert.Len(t, s.GetRunJobs(201), 1)
+	job, _ := s.GetJob(2021)
+	assert.Equal(t, "in_progress", job.GetStatus())
+	_, exists := s.GetWorkflowRun(203)
+	assert.False(t, exists)
+
+	// Nothing is left to repair
+	assert.Equal(t, ReconcileResult{Failed: 1}, r.Reconcile(context.Background()))
+	assert.Equal(t, failedRuns+2, reconcileFailed.Value("run"))
+	assert.Equal(t, repairedRuns+3, reconcileRepaired.Value("run"))
+	assert.Equal(t, repairedJobs+4, reconcileRepaired.Value("job"))
+}
@@ -0,0 +1,207 @@
+// internal/api/scheduler.go
+// bounded concurrency, pacing and retries of the backfill requests
+
+package api
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/google/go-github/v66/github"
+)
+
+const (
+	// maxAttempts is how many times a request is sent before its error is returned
+	maxAttempts = 5
+	// defRetryDelay is the backoff after the first failed attempt, it doubles with every attempt
+	defRetryDelay = time.Second
+	// maxRetryDelay caps the backoff of server errors
+	maxRetryDelay = time.Minute
+	// paceBelow is the number of remaining requests below which the requests are spread
+	// over the rest of the rate limit window instead of using it up at once
+	paceBelow = 500
+)
+
+var (
+	backfillRepos = metrics.NewCounter("ant_watcher_backfill_repositories_total",
+		"Number of repositories the backfill went through, by result: synced, resumed or failed.", "result")
+	apiRetries = metrics.NewCounter("ant_watcher_github_api_retries_total",
+		"Number of GitHub API requests of the backfill sent again, by reason.", "reason")
+)
+
+func init() {
+	metrics.Register(backfillRepos, apiRetries)
+}
+
+// Scheduler backfills the repositories of organizations with Concurrency workers.
+// Its requests are paced against the remaining rate limit, server errors and rate
+// limits are retried with jittered backoff, and a failed repository doesn't stop the
+// others. Repositories completed before are resumed from Checkpoint.
+type Scheduler struct {
+	Client      *github.Client
+	Store       store.Backend
+	Concurrency int
+	Checkpoint  *Checkpoint // nil fetches every repository from the start of the window
+
+	retryDelay time.Duration
+	pace       pacer
+}
+
+// NewScheduler инициализирует планировщик добора
+func NewScheduler(cfg *config.Config, s store.Backend, client *github.Client) (*Scheduler, error) {
+	var checkpoint *Checkpoint
+	if cfg.BackfillCheckpointPath != "" {
+		var err error
+		if checkpoint, err = LoadCheckpoint(cfg.BackfillCheckpointPath); err != nil {
+			return nil, err
+		}
+	}
+	return &Scheduler{
+		Client:      client,
+		Store:       s,
+		Concurrency: cfg.BackfillConcurrencyNum,
+		Checkpoint:  checkpoint,
+		retryDelay:  defRetryDelay,
+	}, nil
+}
+
+// callAPI sends a request of the scheduler, waiting for its turn and retrying it.
+// A nil scheduler sends the request once, the reconciler retries on its next pass.
+func callAPI[T any](ctx context.Context, s *Scheduler, request func() (T, *github.Response, error)) (T, *github.Response, error) {
+	if s == nil {
+		return request()
+	}
+	for attempt := 1; ; attempt++ {
+		if err := sleep(ctx, s.pace.delay(time.Now())); err != nil {
+			var zero T
+			return zero, nil, err
+		}
+		result, resp, err := request()
+		s.pace.observe(resp)
+
+		wait, reason := s.retryAfter(err, attempt)
+		if reason == "" || attempt == maxAttempts {
+			return result, resp, err
+		}
+		apiRetries.Inc(reason)
+		logger.Debugf("GitHub API request failed (%s), attempt %d of %d in %s: %v", reason, attempt+1, maxAttempts, wait.Round(time.Millisecond), err)
+		if err := sleep(ctx, wait); err != nil {
+			return result, resp, err
+		}
+	}
+}
+
+// retryAfter returns how long to wait before the request is sent again, and why.
+// An empty reason means the error is final.
+func (s *Scheduler) retryAfter(err error, attempt int) (time.Duration, string) {
+	var (
+		rateErr  *github.RateLimitError
+		abuseErr *github.AbuseRateLimitError
+		respErr  *github.ErrorResponse
+	)
+	switch {
+	case err == nil:
+		return 0, ""
+	case errors.As(err, &abuseErr):
+		if abuseErr.RetryAfter != nil {
+			return *abuseErr.RetryAfter + jitter(s.retryDelay), "secondary_limit"
+		}
+		return s.backoff(attempt), "secondary_limit"
+	case errors.As(err, &rateErr):
+		// Every credential is used up, nothing gets through before the reset
+		return time.Until(rateErr.Rate.Reset.Time) + jitter(s.retryDelay), "primary_limit"
+	case errors.As(err, &respErr) && respErr.Response != nil:
+		status := respErr.Response.StatusCode
+		if status == http.StatusTooManyRequests ||
+			status == http.StatusForbidden && strings.Contains(strings.ToLower(respErr.Message), "secondary rate limit") {
+			return s.backoff(attempt), "secondary_limit"
+		}
+		if status >= http.StatusInternalServerError {
+			return s.backoff(attempt), "server_error"
+		}
+	}
+	return 0, ""
+}
+
+// backoff doubles the delay with every attempt, the jitter keeps the workers from retrying together
+func (s *Scheduler) backoff(attempt int) time.Duration {
+	delay := s.retryDelay << (attempt - 1)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	return delay/2 + jitter(delay/2)
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// sleep waits for d or until ctx is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pacer spreads the requests of all workers over the rest of the rate limit window
+// once fewer than paceBelow requests are left in it
+type pacer struct {
+	mu        sync.Mutex
+	remaining int
+	reset     time.Time // Zero while the rate limit is unknown, or another credential of the pool is free
+	next      time.Time // The earliest time of the next request
+}
+
+// observe remembers the rate limit reported with the response
+func (p *pacer) observe(resp *github.Response) {
+	if resp == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remaining, p.reset = resp.Rate.Remaining, resp.Rate.Reset.Time
+}
+
+// delay reserves the turn of a request and returns how long to wait for it
+func (p *pacer) delay(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reset.IsZero() || !now.Before(p.reset) || p.remaining >= paceBelow {
+		return 0
+	}
+
+	at := now
+	if p.next.After(at) {
+		at = p.next
+	}
+	if p.remaining == 0 {
+		// Nothing is left, the requests wait for the new window
+		if p.reset.After(at) {
+			at = p.reset
+		}
+		p.next = at
+		return at.Sub(now)
+	}
+	p.next = at.Add(p.reset.Sub(now) / time.Duration(p.remaining))
+	return at.Sub(now)
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// testScheduler creates a scheduler retrying without noticeable delays
+func testScheduler(client *github.Client, s store.Backend) *Scheduler {
+	return &Scheduler{Client: client, Store: s, Concurrency: 2, retryDelay: time.Millisecond}
+}
+
+// flakyOrg serves an organization whose repositories answer with the queued statuses before their runs
+type flakyOrg struct {
+	mu       sync.Mutex
+	failures map[string][]int  // Statuses answered by each repository before it succeeds
+	created  map[string]string // The created filter of the last request of each repository
+	inFlight atomic.Int32
+	peak     atomic.Int32
+}
+
+// runIDs are the IDs of the single run of each repository
+var runIDs = map[string]int{"app": 101, "lib": 102, "web": 103}
+
+func (f *flakyOrg) server(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/orgs/org/repos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id":1,"name":"app","full_name":"org/app"},{"id":2,"name":"lib","full_name":"org/lib"},{"id":3,"name":"web","full_name":"org/web"}]`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/jobs") {
+			fmt.Fprint(w, `{"total_count":0,"jobs":[]}`)
+			return
+		}
+		repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v3/repos/org/"), "/actions/runs")
+		if n := f.inFlight.Add(1); n > f.peak.Load() {
+			f.peak.Store(n)
+		}
+		defer f.inFlight.Add(-1)
+		time.Sleep(10 * time.Millisecond)
+
+		f.mu.Lock()
+		f.created[repo] = r.URL.Query().Get("created")
+		var status int
+		if queued := f.failures[repo]; len(queued) > 0 {
+			status, f.failures[repo] = queued[0], queued[1:]
+		}
+		f.mu.Unlock()
+
+		switch status {
+		case 0:
+			fmt.Fprintf(w, `{"total_count":1,"workflow_runs":[{"id":%d,"workflow_id":10,"status":"completed","conclusion":"success"}]}`, runIDs[repo])
+		case http.StatusForbidden:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"message":"You have exceeded a secondary rate limit.",
+				"documentation_url":"https://docs.github.com/rest/overview/rate-limits-for-the-rest-api#about-secondary-rate-limits"}`)
+		default:
+			http.Error(w, `{"message":"Server Error"}`, status)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestSchedulerRetries checks that server errors and secondary rate limits are retried,
+// and that a repository failing every attempt doesn't stop the others
+func TestSchedulerRetries(t *testing.T) {
+	org := &flakyOrg{
+		failures: map[string][]int{
+			"app": {http.StatusBadGateway, http.StatusForbidden},
+			"lib": {500, 500, 500, 500, 500},
+		},
+		created: map[string]string{},
+	}
+	client, err := NewClient("test-token", org.server(t).URL)
+	assert.NoError(t, err)
+
+	s := store.NewStore()
+	serverErrors, secondary := apiRetries.Value("server_error"), apiRetries.Value("secondary_limit")
+	err = testScheduler(client, s).FetchRecentWorkflows(context.Background(), "org", time.Hour)
+	assert.ErrorContains(t, err, "repository org/lib")
+	assert.NotContains(t, err.Error(), "org/app")
+
+	assert.Len(t, s.GetAllWorkflowRuns(), 2, "the runs of app and web are stored")
+	assert.Equal(t, serverErrors+5, apiRetries.Value("server_error"), "1 retry of app, 4 of lib")
+	assert.Equal(t, secondary+1, apiRetries.Value("secondary_limit"))
+	assert.LessOrEqual(t, org.peak.Load(), int32(2), "no more requests than workers at once")
+}
+
+// TestSchedulerCheckpoint checks that a backfill started again resumes the completed repositories
+// and fetches the failed ones from the start of the window
+func TestSchedulerCheckpoint(t *testing.T) {
+	org := &flakyOrg{
+		failures: map[string][]int{"lib": {500, 500, 500, 500, 500}},
+		created:  map[string]string{},
+	}
+	client, err := NewClient("test-token", org.server(t).URL)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "backfill.json")
+
+	checkpoint, err := LoadCheckpoint(path)
+	assert.NoError(t, err)
+	sched := testScheduler(client, store.NewStore())
+	sched.Checkpoint = checkpoint
+	firstSync := time.Now()
+	assert.Error(t, sched.FetchRecentWorkflows(context.Background(), "org", time.Hour))
+	windowStart := org.created["app"]
+
+	// The restarted backfill reads what the first one completed
+	checkpoint, err = LoadCheckpoint(path)
+	assert.NoError(t, err)
+	sched = testScheduler(client, store.NewStore())
+	sched.Checkpoint = checkpoint
+	resumed := backfillRepos.Value("resumed")
+	assert.NoError(t, sched.FetchRecentWorkflows(context.Background(), "org", time.Hour))
+	assert.Equal(t, resumed+2, backfillRepos.Value("resumed"))
+
+	from, err := time.Parse(time.RFC3339, strings.TrimPrefix(org.created["app"], ">="))
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, firstSync.Add(-resumeOverlap), from, 2*time.Second, "app is fetched from its last sync")
+	}
+	assert.NotEqual(t, org.created["app"], windowStart)
+	from, err = time.Parse(time.RFC3339, strings.TrimPrefix(org.created["lib"], ">="))
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, time.Now().Add(-time.Hour), from, 2*time.Second, "lib is fetched from the start of the window")
+	}
+
+	// A longer window isn't covered by the checkpoint, the repository is fetched from its start
+	longer := time.Now().Add(-2 * time.Hour)
+	from, ok := checkpoint.resumeFrom("org/app", longer)
+	assert.False(t, ok)
+	assert.Equal(t, longer, from)
+}
+
+// TestSchedulerCancel checks that a cancelled backfill stops waiting for its retries
+func TestSchedulerCancel(t *testing.T) {
+	org := &flakyOrg{
+		failures: map[string][]int{"app": {500}, "lib": {500}, "web": {500}},
+		created:  map[string]string{},
+	}
+	client, err := NewClient("test-token", org.server(t).URL)
+	assert.NoError(t, err)
+
+	sched := testScheduler(client, store.NewStore())
+	sched.retryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err = sched.Backfill(ctx, []string{"org", "other"}, time.Hour)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+	assert.NotContains(t, err.Error(), "repository", "cancelled repositories are not failures")
+	assert.NotContains(t, err.Error(), "organization other")
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
+
+// TestPacer checks that the requests are spread over the window once few are left
+func TestPacer(t *testing.T) {
+	now := time.Now()
+	rate := func(remaining int, reset time.Duration) *github.Response {
+		return &github.Response{Rate: github.Rate{Remaining: remaining, Reset: github.Timestamp{Time: now.Add(reset)}}}
+	}
+	var p pacer
+	assert.Equal(t, time.Duration(0), p.delay(now), "the rate limit is unknown")
+
+	p.observe(rate(4000, time.Hour))
+	assert.Equal(t, time.Duration(0), p.delay(now))
+
+	p.observe(rate(100, 100*time.Second))
+	assert.Equal(t, time.Duration(0), p.delay(now))
+	assert.Equal(t, time.Second, p.delay(now))
+	assert.Equal(t, 2*time.Second, p.delay(now))
+
+	p.observe(rate(0, time.Minute))
+	assert.Equal(t, time.Minute, p.delay(now))
+
+	p.observe(&github.Response{Rate: github.Rate{Remaining: 0}})
+	assert.Equal(t, time.Duration(0), p.delay(now), "another credential of the pool is free")
+}
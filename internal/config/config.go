@@ -9,56 +9,159 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Config contains the processed configuration
 type Config struct {
-	AdminAddress       string        `json:"admin_address"`        // Address to listen for admin requests
-	AdminPort          string        `json:"admin_port"`           // Port to listen for admin requests
-	DisableAdminServer string        `json:"disable_admin_server"` // Turn off the admin server, only while starting the app
-	MetricsAddress     string        `json:"metrics_address"`      // Address to listen for metrics requests
-	MetricsPort        string        `json:"metrics_port"`         // Port to listen for metrics requests
-	PushMetricsUrl     string        `json:"push_metrics_url"`     // Address to push metrics to Prometheus/VictoriaMetrics
-	DisableAPI         string        `json:"disable_api"`          // Turn off the API server, only while starting the app
-	WebhookAddress     string        `json:"webhook_address"`      // Address to listen for incoming webhooks
-	WebhookPort        string        `json:"webhook_port"`         // Port to listen for incoming webhooks
-	WebhookSecret      string        `json:"webhook_secret"`       // Secret key for webhook validation
-	GitHubToken        string        `json:"github_token"`         // Token for GitHub API, if empty, the API will not be used
-	GitHubAPIURL       string        `json:"github_api_url"`       // URL for GitHub API
-	LogLevel           string        `json:"log_level"`            // Log level [DEBUG, INFO, WARN, ERROR, FATAL]
-	MemoryTTL          string        `json:"memory_ttl"`           // Memory TTL in human-readable format
-	MemoryTTLTime      time.Duration `json:"-"`                    // Time to live for objects in memory (computed, not from JSON)
-	FetchHistory       string        `json:"fetch_history"`        // Time of previous events to fetch
-	FetchHistoryTime   time.Duration `json:"-"`                    // Time of previous events to fetch (computed, not from JSON)
-	MemoryLimit        string        `json:"memory_limit"`         // Memory limit in human-readable format
-	MemoryLimitBytes   uint64        `json:"-"`                    // Memory limit in bytes (computed, not from JSON)
+	AdminAddress       string          `json:"admin_address"`        // Address to listen for admin requests
+	AdminPort          string          `json:"admin_port"`           // Port to listen for admin requests
+	DisableAdminServer string          `json:"disable_admin_server"` // Turn off the admin server, only while starting the app
+	MetricsAddress     string          `json:"metrics_address"`      // Address to listen for metrics requests
+	MetricsPort        string          `json:"metrics_port"`         // Port to listen for metrics requests
+	PushMetricsUrl     string          `json:"push_metrics_url"`     // Address to push metrics to Prometheus/VictoriaMetrics
+	PushInterval       string          `json:"push_interval"`        // How often finished objects are pushed to PushMetricsUrl
+	PushIntervalTime   time.Duration   `json:"-"`                    // Push interval (computed, not from JSON)
+	DisableAPI         string          `json:"disable_api"`          // Turn off the API server, only while starting the app
+	WebhookAddress     string          `json:"webhook_address"`      // Address to listen for incoming webhooks
+	WebhookPort        string          `json:"webhook_port"`         // Port to listen for incoming webhooks
+	WebhookSecret      string          `json:"webhook_secret"`       // Secret key for webhook validation
+	AllowUnsignedHooks string          `json:"allow_unsigned_hooks"` // Accept webhooks without signature check when no secret is set, "false" by default
+	WebhookSecrets     []WebhookSecret `json:"webhook_secrets"`      // Active secrets for rotation and per-repository or per-organization overrides
+	GitHubToken        string          `json:"github_token"`         // Token for GitHub API, if empty, the API will not be used
+	GitHubAPIURL       string          `json:"github_api_url"`       // URL for GitHub API
+	GitHubOrgs         string          `json:"github_orgs"`          // Comma-separated organizations backfilled from the API, empty means every organization of the token, only while starting the app
+	GitHubOrgList      []string        `json:"-"`                    // Organizations to backfill (computed, not from JSON)
+	LogLevel           string          `json:"log_level"`            // Log level [DEBUG, INFO, WARN, ERROR, FATAL]
+	MemoryTTL          string          `json:"memory_ttl"`           // Memory TTL in human-readable format
+	MemoryTTLTime      time.Duration   `json:"-"`                    // Time to live for objects in memory (computed, not from JSON)
+	FetchHistory       string          `json:"fetch_history"`        // Time of previous events to fetch
+	FetchHistoryTime   time.Duration   `json:"-"`                    // Time of previous events to fetch (computed, not from JSON)
+	MemoryLimit        string          `json:"memory_limit"`         // Memory limit in human-readable format
+	MemoryLimitBytes   uint64          `json:"-"`                    // Memory limit in bytes (computed, not from JSON)
+
+	GitHubAppID             string `json:"github_app_id"`               // ID of the GitHub App the API is used as, preferred over GitHubToken, only while starting the app
+	GitHubAppIDNum          int64  `json:"-"`                           // GitHub App ID (computed, not from JSON)
+	GitHubInstallationID    string `json:"github_installation_id"`      // Installation of the GitHub App, required with GitHubAppID
+	GitHubInstallationIDNum int64  `json:"-"`                           // Installation ID (computed, not from JSON)
+	GitHubAppPrivateKey     string `json:"github_app_private_key"`      // PEM private key of the GitHub App, usually set in the environment
+	GitHubAppPrivateKeyPath string `json:"github_app_private_key_path"` // File with the PEM private key, used when GitHubAppPrivateKey is empty
+	GitHubAppPrivateKeyPEM  []byte `json:"-"`                           // Private key of the GitHub App (computed, not from JSON)
+
+	RunDurationBuckets         string    `json:"run_duration_buckets"`  // Bucket layout for workflow run duration, e.g. "30s,1m,5m"
+	RunDurationBucketsSeconds  []float64 `json:"-"`                     // Run duration buckets in seconds (computed, not from JSON)
+	JobQueueBuckets            string    `json:"job_queue_buckets"`     // Bucket layout for job queue time
+	JobQueueBucketsSeconds     []float64 `json:"-"`                     // Job queue time buckets in seconds (computed, not from JSON)
+	JobDurationBuckets         string    `json:"job_duration_buckets"`  // Bucket layout for job execution time
+	JobDurationBucketsSeconds  []float64 `json:"-"`                     // Job execution time buckets in seconds (computed, not from JSON)
+	StepDurationBuckets        string    `json:"step_duration_buckets"` // Bucket layout for step execution time
+	StepDurationBucketsSeconds []float64 `json:"-"`                     // Step execution time buckets in seconds (computed, not from JSON)
+
+	WebhookWorkers      string `json:"webhook_workers"`    // Number of workers applying queued webhooks to the store
+	WebhookWorkersNum   int    `json:"-"`                  // Number of webhook workers (computed, not from JSON)
+	WebhookQueueSize    string `json:"webhook_queue_size"` // Capacity of the webhook queue, deliveries above it get 503
+	WebhookQueueSizeNum int    `json:"-"`                  // Capacity of the webhook queue (computed, not from JSON)
+
+	DeliveryDedupTTL     string        `json:"delivery_dedup_ttl"`  // How long seen X-GitHub-Delivery IDs are remembered
+	DeliveryDedupTTLTime time.Duration `json:"-"`                   // Delivery dedup TTL (computed, not from JSON)
+	DeliveryDedupSize    string        `json:"delivery_dedup_size"` // Maximum number of remembered delivery IDs, only while starting the app
+	DeliveryDedupSizeNum int           `json:"-"`                   // Maximum number of remembered delivery IDs (computed, not from JSON)
+
+	MaxRunAge     string        `json:"max_run_age"` // Unfinished runs older than this are evicted even if updates keep coming
+	MaxRunAgeTime time.Duration `json:"-"`           // Hard max age of unfinished runs (computed, not from JSON)
+
+	ReconcileInterval      string        `json:"reconcile_interval"`  // How often stuck runs and jobs are looked up in the GitHub API, requires GitHubToken
+	ReconcileIntervalTime  time.Duration `json:"-"`                   // Reconcile interval (computed, not from JSON)
+	ReconcileThreshold     string        `json:"reconcile_threshold"` // Unfinished runs and jobs not updated for this long, and runs without jobs, are looked up
+	ReconcileThresholdTime time.Duration `json:"-"`                   // Reconcile threshold (computed, not from JSON)
+
+	BackfillConcurrency    string `json:"backfill_concurrency"`     // Number of repositories backfilled from the API at once, only while starting the app
+	BackfillConcurrencyNum int    `json:"-"`                        // Number of backfill workers (computed, not from JSON)
+	BackfillCheckpointPath string `json:"backfill_checkpoint_path"` // File the backfilled repositories are recorded in, so a restarted backfill resumes, requires a persistent store
+
+	SnapshotPath         string        `json:"snapshot_path"`     // File the store is saved to and restored from, empty turns snapshots off, only while starting the app
+	SnapshotInterval     string        `json:"snapshot_interval"` // How often the store is saved to SnapshotPath
+	SnapshotIntervalTime time.Duration `json:"-"`                 // Snapshot interval (computed, not from JSON)
+
+	WALDir              string `json:"wal_dir"`          // Directory of the write-ahead log of accepted webhooks, empty turns it off, requires SnapshotPath, only while starting the app
+	WALSegmentSize      string `json:"wal_segment_size"` // Size after which a new WAL segment is started, only while starting the app
+	WALSegmentSizeBytes uint64 `json:"-"`                // WAL segment size in bytes (computed, not from JSON)
+
+	StorageBackend string `json:"storage_backend"` // Where the store keeps runs: "memory" or "disk", only while starting the app
+	StoragePath    string `json:"storage_path"`    // File of the disk backend, only while starting the app
 }
 
+// reloadMu guards the fields ReloadConfig changes against the goroutines reading them
+// while the app runs. There is one Config in the app, so one lock for all of them is enough.
+var reloadMu sync.RWMutex
+
+// Storage backends accepted in StorageBackend
+const (
+	StorageBackendMemory = "memory"
+	StorageBackendDisk   = "disk"
+)
+
+// WebhookSecret is one of the secrets accepted for webhook validation.
+// A secret with Repository or Organization set overrides the global secrets
+// for that scope, several secrets of the same scope are accepted at once.
+type WebhookSecret struct {
+	ID           string `json:"id"`                     // Name reported in logs and metrics when the secret matches
+	Secret       string `json:"secret"`                 // Secret value configured in GitHub
+	Repository   string `json:"repository,omitempty"`   // "owner/name" of the repository the secret is limited to
+	Organization string `json:"organization,omitempty"` // Login of the organization the secret is limited to
+}
+
+// legacyWebhookSecretID is the ID of the secret taken from WebhookSecret
+const legacyWebhookSecretID = "default"
+
 // for administration and tests purposes
 type ConfigInterface interface {
 	ReloadConfig() error
 }
 
-var configlog *log.Logger
+var configlog = log.New(os.Stdout, localLogBanner+": ", log.LstdFlags)
 
 const (
 	defAdminAddress         = "127.0.0.1"
 	defAdminPort            = "8081"
+	defAllowUnsignedHooks   = "false"
+	defBackfillConcurrency  = "4"
+	defBackfillCheckpoint   = ""
 	defDisableAdminServer   = "false"
 	defDisableAPI           = "false"
+	defDeliveryDedupTTL     = "24h"
+	defDeliveryDedupSize    = "100000"
 	defFetchHistory         = "15m"
 	defGitHubAPIURL         = "https://api.github.com"
 	defGitHubAppID          = ""
+	defGitHubOrgs           = ""
 	defGitHubInstallationID = ""
+	defGitHubAppPrivateKey  = ""
 	defLogLevel             = "INFO"
 	defMemoryLimit          = "0"
 	defMemoryTTL            = "15m"
+	defMaxRunAge            = "24h"
+	defSnapshotPath         = ""
+	defSnapshotInterval     = "1m"
+	defWALDir               = ""
+	defWALSegmentSize       = "64MB"
+	defStorageBackend       = StorageBackendMemory
+	defStoragePath          = "data/ant-watcher.db"
 	defMetricsAddress       = "0.0.0.0"
 	defMetricsPort          = "3000"
 	defPushMetricsUrl       = ""
+	defPushInterval         = "30s"
+	defReconcileInterval    = "10m"
+	defReconcileThreshold   = "30m"
+	defRunDurationBuckets   = "30s,1m,2m,5m,10m,15m,30m,45m,1h,1h30m,2h,3h"
+	defJobQueueBuckets      = "1s,5s,10s,30s,1m,2m,5m,10m,30m,1h"
+	defJobDurationBuckets   = "10s,30s,1m,2m,5m,10m,15m,30m,45m,1h,1h30m,2h,3h"
+	defStepDurationBuckets  = "1s,5s,10s,30s,1m,2m,5m,10m,30m,1h"
 	defWebhookAddress       = "0.0.0.0"
 	defWebhookPort          = "8080"
+	defWebhookWorkers       = "4"
+	defWebhookQueueSize     = "1000"
 	localLogBanner          = "CONFIG"
 )
 
@@ -80,20 +183,46 @@ func loadAndProcessConfig() (*Config, error) {
 	// Default values, placed here because some of them are should be used as result of function
 	// and we can't use them as default values in struct fields
 	rawCfg := Config{
-		AdminAddress:       defAdminAddress,
-		MetricsAddress:     defMetricsAddress,
-		MetricsPort:        defMetricsPort,
-		AdminPort:          defAdminPort,
-		WebhookAddress:     defWebhookAddress,
-		WebhookPort:        defWebhookPort,
-		GitHubAPIURL:       defGitHubAPIURL,
-		LogLevel:           defLogLevel,
-		MemoryTTL:          defMemoryTTL,
-		MemoryLimit:        defMemoryLimit,
-		PushMetricsUrl:     defPushMetricsUrl,
-		FetchHistory:       defFetchHistory,
-		DisableAdminServer: defDisableAdminServer,
-		DisableAPI:         defDisableAPI,
+		AdminAddress:           defAdminAddress,
+		MetricsAddress:         defMetricsAddress,
+		MetricsPort:            defMetricsPort,
+		AdminPort:              defAdminPort,
+		WebhookAddress:         defWebhookAddress,
+		WebhookPort:            defWebhookPort,
+		AllowUnsignedHooks:     defAllowUnsignedHooks,
+		WebhookWorkers:         defWebhookWorkers,
+		WebhookQueueSize:       defWebhookQueueSize,
+		DeliveryDedupTTL:       defDeliveryDedupTTL,
+		DeliveryDedupSize:      defDeliveryDedupSize,
+		GitHubAPIURL:           defGitHubAPIURL,
+		GitHubOrgs:             defGitHubOrgs,
+		GitHubAppID:            defGitHubAppID,
+		GitHubInstallationID:   defGitHubInstallationID,
+		GitHubAppPrivateKey:    defGitHubAppPrivateKey,
+		LogLevel:               defLogLevel,
+		MemoryTTL:              defMemoryTTL,
+		MaxRunAge:              defMaxRunAge,
+		SnapshotPath:           defSnapshotPath,
+		SnapshotInterval:       defSnapshotInterval,
+		WALDir:                 defWALDir,
+		WALSegmentSize:         defWALSegmentSize,
+		StorageBackend:         defStorageBackend,
+		StoragePath:            defStoragePath,
+		MemoryLimit:            defMemoryLimit,
+		PushMetricsUrl:         defPushMetricsUrl,
+		PushInterval:           defPushInterval,
+		FetchHistory:           defFetchHistory,
+		ReconcileInterval:      defReconcileInterval,
+		ReconcileThreshold:     defReconcileThreshold,
+		BackfillConcurrency:    defBackfillConcurrency,
+		BackfillCheckpointPath: defBackfillCheckpoint,
+		DisableAdminServer:     defDisableAdminServer,
+		DisableAPI:             defDisableAPI,
+
+		RunDurationBuckets:  defRunDurationBuckets,
+		JobQueueBuckets:     defJobQueueBuckets,
+		JobDurationBuckets:  defJobDurationBuckets,
+		StepDurationBuckets: defStepDurationBuckets,
 	}
 
 	configFilePath := getEnv("CONFIG_FILE_PATH", "config/config.json")
@@ -114,28 +243,62 @@ func loadAndProcessConfig() (*Config, error) {
 
 	// Apply values from environment variables
 	envVars := map[string]*string{
-		"ADMIN_ADDRESS":        &rawCfg.AdminAddress,
-		"ADMIN_PORT":           &rawCfg.AdminPort,
-		"METRICS_ADDRESS":      &rawCfg.MetricsAddress,
-		"METRICS_PORT":         &rawCfg.MetricsPort,
-		"GITHUB_API_URL":       &rawCfg.GitHubAPIURL,
-		"GITHUB_TOKEN":         &rawCfg.GitHubToken,
-		"LOG_LEVEL":            &rawCfg.LogLevel,
-		"PUSH_METRICS_URL":     &rawCfg.PushMetricsUrl,
-		"WEBHOOK_ADDRESS":      &rawCfg.WebhookAddress,
-		"WEBHOOK_PORT":         &rawCfg.WebhookPort,
-		"WEBHOOK_SECRET":       &rawCfg.WebhookSecret,
-		"DISABLE_ADMIN_SERVER": &rawCfg.DisableAdminServer,
-		"DISABLE_API":          &rawCfg.DisableAPI,
-		"MEMORY_TTL":           &rawCfg.MemoryTTL,
-		"FETCH_HISTORY":        &rawCfg.FetchHistory,
-		"MEMORY_LIMIT":         &rawCfg.MemoryLimit,
+		"ADMIN_ADDRESS":               &rawCfg.AdminAddress,
+		"ADMIN_PORT":                  &rawCfg.AdminPort,
+		"METRICS_ADDRESS":             &rawCfg.MetricsAddress,
+		"METRICS_PORT":                &rawCfg.MetricsPort,
+		"GITHUB_API_URL":              &rawCfg.GitHubAPIURL,
+		"GITHUB_TOKEN":                &rawCfg.GitHubToken,
+		"GITHUB_ORGS":                 &rawCfg.GitHubOrgs,
+		"GITHUB_APP_ID":               &rawCfg.GitHubAppID,
+		"GITHUB_INSTALLATION_ID":      &rawCfg.GitHubInstallationID,
+		"GITHUB_APP_PRIVATE_KEY":      &rawCfg.GitHubAppPrivateKey,
+		"GITHUB_APP_PRIVATE_KEY_PATH": &rawCfg.GitHubAppPrivateKeyPath,
+		"LOG_LEVEL":                   &rawCfg.LogLevel,
+		"PUSH_METRICS_URL":            &rawCfg.PushMetricsUrl,
+		"PUSH_INTERVAL":               &rawCfg.PushInterval,
+		"WEBHOOK_ADDRESS":             &rawCfg.WebhookAddress,
+		"WEBHOOK_PORT":                &rawCfg.WebhookPort,
+		"WEBHOOK_SECRET":              &rawCfg.WebhookSecret,
+		"ALLOW_UNSIGNED_HOOKS":        &rawCfg.AllowUnsignedHooks,
+		"WEBHOOK_WORKERS":             &rawCfg.WebhookWorkers,
+		"WEBHOOK_QUEUE_SIZE":          &rawCfg.WebhookQueueSize,
+		"DELIVERY_DEDUP_TTL":          &rawCfg.DeliveryDedupTTL,
+		"DELIVERY_DEDUP_SIZE":         &rawCfg.DeliveryDedupSize,
+		"DISABLE_ADMIN_SERVER":        &rawCfg.DisableAdminServer,
+		"DISABLE_API":                 &rawCfg.DisableAPI,
+		"MEMORY_TTL":                  &rawCfg.MemoryTTL,
+		"MAX_RUN_AGE":                 &rawCfg.MaxRunAge,
+		"SNAPSHOT_PATH":               &rawCfg.SnapshotPath,
+		"SNAPSHOT_INTERVAL":           &rawCfg.SnapshotInterval,
+		"WAL_DIR":                     &rawCfg.WALDir,
+		"WAL_SEGMENT_SIZE":            &rawCfg.WALSegmentSize,
+		"STORAGE_BACKEND":             &rawCfg.StorageBackend,
+		"STORAGE_PATH":                &rawCfg.StoragePath,
+		"FETCH_HISTORY":               &rawCfg.FetchHistory,
+		"RECONCILE_INTERVAL":          &rawCfg.ReconcileInterval,
+		"RECONCILE_THRESHOLD":         &rawCfg.ReconcileThreshold,
+		"BACKFILL_CONCURRENCY":        &rawCfg.BackfillConcurrency,
+		"BACKFILL_CHECKPOINT_PATH":    &rawCfg.BackfillCheckpointPath,
+		"MEMORY_LIMIT":                &rawCfg.MemoryLimit,
+		"RUN_DURATION_BUCKETS":        &rawCfg.RunDurationBuckets,
+		"JOB_QUEUE_BUCKETS":           &rawCfg.JobQueueBuckets,
+		"JOB_DURATION_BUCKETS":        &rawCfg.JobDurationBuckets,
+		"STEP_DURATION_BUCKETS":       &rawCfg.StepDurationBuckets,
 	}
 
 	for key, ptr := range envVars {
 		*ptr = getEnv(key, *ptr)
 	}
 
+	// The list of secrets comes from the environment as a JSON array
+	if value, exists := os.LookupEnv("WEBHOOK_SECRETS"); exists {
+		rawCfg.WebhookSecrets = nil
+		if err := json.Unmarshal([]byte(value), &rawCfg.WebhookSecrets); err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_SECRETS: %v", err)
+		}
+	}
+
 	// Validate the configuration
 	if net.ParseIP(rawCfg.AdminAddress) == nil {
 		return nil, fmt.Errorf("invalid AdminAddress: %s", rawCfg.AdminAddress)
@@ -157,12 +320,41 @@ func loadAndProcessConfig() (*Config, error) {
 		return nil, fmt.Errorf("invalid GitHubAPIURL: %s", rawCfg.GitHubAPIURL)
 	}
 
+	rawCfg.GitHubOrgList = nil
+	for _, org := range strings.Split(rawCfg.GitHubOrgs, ",") {
+		if org = strings.TrimSpace(org); org != "" {
+			rawCfg.GitHubOrgList = append(rawCfg.GitHubOrgList, org)
+		}
+	}
+
 	if rawCfg.PushMetricsUrl != "" {
 		if _, err := url.ParseRequestURI(rawCfg.PushMetricsUrl); err != nil {
 			return nil, fmt.Errorf("invalid PushMetricsUrl: %s", rawCfg.PushMetricsUrl)
 		}
 	}
 
+	// The GitHub App needs all three settings, the key may come as a file
+	rawCfg.GitHubAppIDNum, rawCfg.GitHubInstallationIDNum, rawCfg.GitHubAppPrivateKeyPEM = 0, 0, nil
+	if rawCfg.GitHubAppID != "" {
+		if rawCfg.GitHubAppIDNum, err = strconv.ParseInt(rawCfg.GitHubAppID, 10, 64); err != nil || rawCfg.GitHubAppIDNum <= 0 {
+			return nil, fmt.Errorf("invalid GitHubAppID: %s", rawCfg.GitHubAppID)
+		}
+		if rawCfg.GitHubInstallationIDNum, err = strconv.ParseInt(rawCfg.GitHubInstallationID, 10, 64); err != nil || rawCfg.GitHubInstallationIDNum <= 0 {
+			return nil, fmt.Errorf("invalid GitHubInstallationID: %q, it must be set with GitHubAppID", rawCfg.GitHubInstallationID)
+		}
+		switch {
+		case rawCfg.GitHubAppPrivateKey != "":
+			// Line breaks are often escaped when the key is passed in the environment
+			rawCfg.GitHubAppPrivateKeyPEM = []byte(strings.ReplaceAll(rawCfg.GitHubAppPrivateKey, `\n`, "\n"))
+		case rawCfg.GitHubAppPrivateKeyPath != "":
+			if rawCfg.GitHubAppPrivateKeyPEM, err = os.ReadFile(rawCfg.GitHubAppPrivateKeyPath); err != nil {
+				return nil, fmt.Errorf("invalid GitHubAppPrivateKeyPath: %v", err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid GitHubAppPrivateKey: it or GitHubAppPrivateKeyPath must be set with GitHubAppID")
+		}
+	}
+
 	if net.ParseIP(rawCfg.WebhookAddress) == nil {
 		return nil, fmt.Errorf("invalid WebhookAddress: %s", rawCfg.WebhookAddress)
 	}
@@ -171,22 +363,121 @@ func loadAndProcessConfig() (*Config, error) {
 		return nil, fmt.Errorf("invalid WebhookPort: %s", rawCfg.WebhookPort)
 	}
 
+	if rawCfg.WebhookWorkersNum, err = strconv.Atoi(rawCfg.WebhookWorkers); err != nil || rawCfg.WebhookWorkersNum < 1 {
+		return nil, fmt.Errorf("invalid WebhookWorkers: %s", rawCfg.WebhookWorkers)
+	}
+
+	if rawCfg.BackfillConcurrencyNum, err = strconv.Atoi(rawCfg.BackfillConcurrency); err != nil || rawCfg.BackfillConcurrencyNum < 1 {
+		return nil, fmt.Errorf("invalid BackfillConcurrency: %s", rawCfg.BackfillConcurrency)
+	}
+
+	if rawCfg.WebhookQueueSizeNum, err = strconv.Atoi(rawCfg.WebhookQueueSize); err != nil || rawCfg.WebhookQueueSizeNum < 1 {
+		return nil, fmt.Errorf("invalid WebhookQueueSize: %s", rawCfg.WebhookQueueSize)
+	}
+
+	rawCfg.DeliveryDedupTTLTime, err = time.ParseDuration(rawCfg.DeliveryDedupTTL)
+	if err != nil || rawCfg.DeliveryDedupTTLTime <= 0 {
+		return nil, fmt.Errorf("invalid DeliveryDedupTTL: %s", rawCfg.DeliveryDedupTTL)
+	}
+
+	if rawCfg.DeliveryDedupSizeNum, err = strconv.Atoi(rawCfg.DeliveryDedupSize); err != nil || rawCfg.DeliveryDedupSizeNum < 1 {
+		return nil, fmt.Errorf("invalid DeliveryDedupSize: %s", rawCfg.DeliveryDedupSize)
+	}
+
+	if err := validateWebhookSecrets(rawCfg.WebhookSecrets); err != nil {
+		return nil, fmt.Errorf("invalid WebhookSecrets: %v", err)
+	}
+
+	if _, err := strconv.ParseBool(rawCfg.AllowUnsignedHooks); err != nil {
+		return nil, fmt.Errorf("invalid AllowUnsignedHooks: %s", rawCfg.AllowUnsignedHooks)
+	}
+
 	// Processing MemoryTTL, FetchHistory and MemoryLimit values
 	rawCfg.MemoryTTLTime, err = time.ParseDuration(rawCfg.MemoryTTL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid MemoryTTL: %v", err)
 	}
 
+	rawCfg.MaxRunAgeTime, err = time.ParseDuration(rawCfg.MaxRunAge)
+	if err != nil || rawCfg.MaxRunAgeTime <= 0 {
+		return nil, fmt.Errorf("invalid MaxRunAge: %s", rawCfg.MaxRunAge)
+	}
+
+	rawCfg.PushIntervalTime, err = time.ParseDuration(rawCfg.PushInterval)
+	if err != nil || rawCfg.PushIntervalTime <= 0 {
+		return nil, fmt.Errorf("invalid PushInterval: %s", rawCfg.PushInterval)
+	}
+
+	rawCfg.SnapshotIntervalTime, err = time.ParseDuration(rawCfg.SnapshotInterval)
+	if err != nil || rawCfg.SnapshotIntervalTime <= 0 {
+		return nil, fmt.Errorf("invalid SnapshotInterval: %s", rawCfg.SnapshotInterval)
+	}
+
+	// Without snapshots the log would never be compacted
+	if rawCfg.WALDir != "" && rawCfg.SnapshotPath == "" {
+		return nil, fmt.Errorf("invalid WALDir: SnapshotPath must be set to use the write-ahead log")
+	}
+	rawCfg.WALSegmentSizeBytes, err = parseSize(rawCfg.WALSegmentSize)
+	if err != nil || rawCfg.WALSegmentSizeBytes == 0 {
+		return nil, fmt.Errorf("invalid WALSegmentSize: %s", rawCfg.WALSegmentSize)
+	}
+
+	switch rawCfg.StorageBackend {
+	case StorageBackendMemory:
+	case StorageBackendDisk:
+		if rawCfg.StoragePath == "" {
+			return nil, fmt.Errorf("invalid StoragePath: must be set for the %s backend", StorageBackendDisk)
+		}
+		// The disk backend persists every update itself, snapshots and the log are for the memory one
+		if rawCfg.SnapshotPath != "" || rawCfg.WALDir != "" {
+			return nil, fmt.Errorf("invalid StorageBackend: SnapshotPath and WALDir are only supported by the %s backend", StorageBackendMemory)
+		}
+	default:
+		return nil, fmt.Errorf("invalid StorageBackend: %s", rawCfg.StorageBackend)
+	}
+
+	// A resumed backfill skips the runs it stored before the restart, an empty store would miss them
+	if rawCfg.BackfillCheckpointPath != "" && rawCfg.StorageBackend == StorageBackendMemory && rawCfg.SnapshotPath == "" {
+		return nil, fmt.Errorf("invalid BackfillCheckpointPath: SnapshotPath or the %s backend must be set to resume the backfill", StorageBackendDisk)
+	}
+
 	rawCfg.FetchHistoryTime, err = time.ParseDuration(rawCfg.FetchHistory)
 	if err != nil {
 		return nil, fmt.Errorf("invalid FetchHistory: %v", err)
 	}
 
+	rawCfg.ReconcileIntervalTime, err = time.ParseDuration(rawCfg.ReconcileInterval)
+	if err != nil || rawCfg.ReconcileIntervalTime <= 0 {
+		return nil, fmt.Errorf("invalid ReconcileInterval: %s", rawCfg.ReconcileInterval)
+	}
+
+	rawCfg.ReconcileThresholdTime, err = time.ParseDuration(rawCfg.ReconcileThreshold)
+	if err != nil || rawCfg.ReconcileThresholdTime <= 0 {
+		return nil, fmt.Errorf("invalid ReconcileThreshold: %s", rawCfg.ReconcileThreshold)
+	}
+
 	rawCfg.MemoryLimitBytes, err = parseSize(rawCfg.MemoryLimit)
 	if err != nil {
 		return nil, fmt.Errorf("invalid MemoryLimit: %v", err)
 	}
 
+	// Processing histogram bucket layouts
+	buckets := []struct {
+		name string
+		raw  string
+		dst  *[]float64
+	}{
+		{"RunDurationBuckets", rawCfg.RunDurationBuckets, &rawCfg.RunDurationBucketsSeconds},
+		{"JobQueueBuckets", rawCfg.JobQueueBuckets, &rawCfg.JobQueueBucketsSeconds},
+		{"JobDurationBuckets", rawCfg.JobDurationBuckets, &rawCfg.JobDurationBucketsSeconds},
+		{"StepDurationBuckets", rawCfg.StepDurationBuckets, &rawCfg.StepDurationBucketsSeconds},
+	}
+	for _, b := range buckets {
+		if *b.dst, err = parseBuckets(b.raw); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", b.name, err)
+		}
+	}
+
 	return &rawCfg, nil
 }
 
@@ -210,6 +501,9 @@ func (cfg *Config) ReloadConfig() error {
 	if err != nil {
 		return err
 	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
 	if cfg.GitHubToken != newCfg.GitHubToken {
 		printConfigEvent("GitHub token has changed")
 		cfg.GitHubToken = newCfg.GitHubToken
@@ -223,22 +517,295 @@ func (cfg *Config) ReloadConfig() error {
 		cfg.MemoryLimitBytes = newCfg.MemoryLimitBytes
 	}
 	if cfg.MemoryTTL != newCfg.MemoryTTL {
-		printConfigEventf("Memory TTL has changed from %s to %s (seconds)", cfg.MemoryTTL, newCfg.MemoryTTL)
+		printConfigEventf("Memory TTL has changed from %s to %s", cfg.MemoryTTL, newCfg.MemoryTTL)
 		cfg.MemoryTTL = newCfg.MemoryTTL
+		cfg.MemoryTTLTime = newCfg.MemoryTTLTime
+	}
+	if cfg.MaxRunAge != newCfg.MaxRunAge {
+		printConfigEventf("Max run age has changed from %s to %s", cfg.MaxRunAge, newCfg.MaxRunAge)
+		cfg.MaxRunAge = newCfg.MaxRunAge
+		cfg.MaxRunAgeTime = newCfg.MaxRunAgeTime
+	}
+	if cfg.ReconcileInterval != newCfg.ReconcileInterval {
+		printConfigEventf("Reconcile interval has changed from %s to %s", cfg.ReconcileInterval, newCfg.ReconcileInterval)
+		cfg.ReconcileInterval = newCfg.ReconcileInterval
+		cfg.ReconcileIntervalTime = newCfg.ReconcileIntervalTime
+	}
+	if cfg.ReconcileThreshold != newCfg.ReconcileThreshold {
+		printConfigEventf("Reconcile threshold has changed from %s to %s", cfg.ReconcileThreshold, newCfg.ReconcileThreshold)
+		cfg.ReconcileThreshold = newCfg.ReconcileThreshold
+		cfg.ReconcileThresholdTime = newCfg.ReconcileThresholdTime
 	}
 	if cfg.PushMetricsUrl != newCfg.PushMetricsUrl {
 		printConfigEventf("Push metrics address has changed to %s", newCfg.PushMetricsUrl)
 		cfg.PushMetricsUrl = newCfg.PushMetricsUrl
 	}
+	if cfg.PushInterval != newCfg.PushInterval {
+		printConfigEventf("Push interval has changed from %s to %s", cfg.PushInterval, newCfg.PushInterval)
+		cfg.PushInterval = newCfg.PushInterval
+		cfg.PushIntervalTime = newCfg.PushIntervalTime
+	}
+	if cfg.SnapshotInterval != newCfg.SnapshotInterval {
+		printConfigEventf("Snapshot interval has changed from %s to %s", cfg.SnapshotInterval, newCfg.SnapshotInterval)
+		cfg.SnapshotInterval = newCfg.SnapshotInterval
+		cfg.SnapshotIntervalTime = newCfg.SnapshotIntervalTime
+	}
+	if cfg.DeliveryDedupTTL != newCfg.DeliveryDedupTTL {
+		printConfigEventf("Delivery dedup TTL has changed from %s to %s", cfg.DeliveryDedupTTL, newCfg.DeliveryDedupTTL)
+		cfg.DeliveryDedupTTL = newCfg.DeliveryDedupTTL
+		cfg.DeliveryDedupTTLTime = newCfg.DeliveryDedupTTLTime
+	}
+	if cfg.RunDurationBuckets != newCfg.RunDurationBuckets {
+		printConfigEventf("Run duration buckets have changed to %s", newCfg.RunDurationBuckets)
+		cfg.RunDurationBuckets = newCfg.RunDurationBuckets
+		cfg.RunDurationBucketsSeconds = newCfg.RunDurationBucketsSeconds
+	}
+	if cfg.JobQueueBuckets != newCfg.JobQueueBuckets {
+		printConfigEventf("Job queue buckets have changed to %s", newCfg.JobQueueBuckets)
+		cfg.JobQueueBuckets = newCfg.JobQueueBuckets
+		cfg.JobQueueBucketsSeconds = newCfg.JobQueueBucketsSeconds
+	}
+	if cfg.JobDurationBuckets != newCfg.JobDurationBuckets {
+		printConfigEventf("Job duration buckets have changed to %s", newCfg.JobDurationBuckets)
+		cfg.JobDurationBuckets = newCfg.JobDurationBuckets
+		cfg.JobDurationBucketsSeconds = newCfg.JobDurationBucketsSeconds
+	}
+	if cfg.StepDurationBuckets != newCfg.StepDurationBuckets {
+		printConfigEventf("Step duration buckets have changed to %s", newCfg.StepDurationBuckets)
+		cfg.StepDurationBuckets = newCfg.StepDurationBuckets
+		cfg.StepDurationBucketsSeconds = newCfg.StepDurationBucketsSeconds
+	}
 	if cfg.WebhookSecret != newCfg.WebhookSecret {
 		printConfigEvent("Webhook secret has changed")
 		cfg.WebhookSecret = newCfg.WebhookSecret
 	}
+	if !equalWebhookSecrets(cfg.WebhookSecrets, newCfg.WebhookSecrets) {
+		printConfigEventf("Webhook secrets have changed, %d secrets are active", len(newCfg.WebhookSecrets))
+		cfg.WebhookSecrets = newCfg.WebhookSecrets
+	}
+	if cfg.AllowUnsignedHooks != newCfg.AllowUnsignedHooks {
+		printConfigEventf("Accepting unsigned webhooks has changed from %s to %s", cfg.AllowUnsignedHooks, newCfg.AllowUnsignedHooks)
+		cfg.AllowUnsignedHooks = newCfg.AllowUnsignedHooks
+	}
 
 	printConfigEvent("Configuration reloaded successfully")
 	return nil
 }
 
+// redacted replaces the values of secrets in the output of Redacted
+const redacted = "<redacted>"
+
+// Redacted returns a copy of the config to show to admins, read under the reload lock.
+// The private key of the GitHub App is replaced, whoever has it can act as the App, and
+// so are the values of the webhook secrets, which would let anyone sign deliveries.
+func (cfg *Config) Redacted() Config {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	c := *cfg
+	if c.GitHubAppPrivateKey != "" {
+		c.GitHubAppPrivateKey = redacted
+	}
+	c.GitHubAppPrivateKeyPEM = nil
+	if c.WebhookSecrets != nil {
+		// A new slice, the secrets of cfg are never changed in place
+		c.WebhookSecrets = make([]WebhookSecret, len(cfg.WebhookSecrets))
+		for i, secret := range cfg.WebhookSecrets {
+			secret.Secret = redacted
+			c.WebhookSecrets[i] = secret
+		}
+	}
+	return c
+}
+
+// UsesGitHubApp reports whether the GitHub API is used as a GitHub App installation
+func (cfg *Config) UsesGitHubApp() bool {
+	return cfg.GitHubAppIDNum != 0
+}
+
+// Eviction returns the memory TTL, the max age of unfinished runs and the memory limit,
+// read together under the reload lock
+func (cfg *Config) Eviction() (ttl, maxAge time.Duration, limit uint64) {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return cfg.MemoryTTLTime, cfg.MaxRunAgeTime, cfg.MemoryLimitBytes
+}
+
+// PushTarget returns the address finished runs are pushed to and the push interval,
+// read together under the reload lock
+func (cfg *Config) PushTarget() (url string, interval time.Duration) {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return cfg.PushMetricsUrl, cfg.PushIntervalTime
+}
+
+// APIToken returns the GitHub API token, read under the reload lock
+func (cfg *Config) APIToken() string {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return cfg.GitHubToken
+}
+
+// Reconcile returns the reconcile interval and threshold, read together under the reload lock
+func (cfg *Config) Reconcile() (interval, threshold time.Duration) {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return cfg.ReconcileIntervalTime, cfg.ReconcileThresholdTime
+}
+
+// SnapshotPeriod returns how often the store is saved, read under the reload lock
+func (cfg *Config) SnapshotPeriod() time.Duration {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return cfg.SnapshotIntervalTime
+}
+
+// DeliveryTTL returns how long seen delivery IDs are remembered, read under the reload lock
+func (cfg *Config) DeliveryTTL() time.Duration {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return cfg.DeliveryDedupTTLTime
+}
+
+// WebhookAuth is the webhook validation settings at one moment. A delivery is checked
+// against one WebhookAuth, so a reload in the middle can't mix the old and new settings.
+type WebhookAuth struct {
+	secret   string
+	secrets  []WebhookSecret // Replaced as a whole on reload, never changed in place
+	unsigned bool
+}
+
+// WebhookAuth returns the current webhook validation settings
+func (cfg *Config) WebhookAuth() WebhookAuth {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	allowed, _ := strconv.ParseBool(cfg.AllowUnsignedHooks)
+	return WebhookAuth{secret: cfg.WebhookSecret, secrets: cfg.WebhookSecrets, unsigned: allowed}
+}
+
+// UnsignedHooksAllowed reports whether webhooks may be accepted without
+// signature validation. It only has effect while WebhookSecret is empty.
+func (cfg *Config) UnsignedHooksAllowed() bool {
+	return cfg.WebhookAuth().UnsignedAllowed()
+}
+
+// HasWebhookSecrets reports whether at least one webhook secret is configured
+func (cfg *Config) HasWebhookSecrets() bool {
+	return cfg.WebhookAuth().HasSecrets()
+}
+
+// WebhookSecretsFor returns the secrets a delivery from the given repository
+// and organization may be signed with, see WebhookAuth.SecretsFor.
+func (cfg *Config) WebhookSecretsFor(repository, organization string) []WebhookSecret {
+	return cfg.WebhookAuth().SecretsFor(repository, organization)
+}
+
+// UnsignedAllowed reports whether webhooks may be accepted without signature validation
+func (a WebhookAuth) UnsignedAllowed() bool {
+	return a.unsigned
+}
+
+// HasSecrets reports whether at least one webhook secret is configured
+func (a WebhookAuth) HasSecrets() bool {
+	return a.secret != "" || len(a.secrets) > 0
+}
+
+// SecretsFor returns the secrets a delivery from the given repository
+// ("owner/name") and organization may be signed with. Repository-scoped secrets
+// take precedence over organization-scoped ones, which take precedence over
+// the global secrets, including the legacy WebhookSecret.
+func (a WebhookAuth) SecretsFor(repository, organization string) []WebhookSecret {
+	var repoSecrets, orgSecrets, globalSecrets []WebhookSecret
+	if a.secret != "" {
+		globalSecrets = append(globalSecrets, WebhookSecret{ID: legacyWebhookSecretID, Secret: a.secret})
+	}
+	for _, secret := range a.secrets {
+		switch {
+		case secret.Repository != "":
+			if repository != "" && strings.EqualFold(secret.Repository, repository) {
+				repoSecrets = append(repoSecrets, secret)
+			}
+		case secret.Organization != "":
+			if organization != "" && strings.EqualFold(secret.Organization, organization) {
+				orgSecrets = append(orgSecrets, secret)
+			}
+		default:
+			globalSecrets = append(globalSecrets, secret)
+		}
+	}
+
+	if len(repoSecrets) > 0 {
+		return repoSecrets
+	}
+	if len(orgSecrets) > 0 {
+		return orgSecrets
+	}
+	return globalSecrets
+}
+
+// validateWebhookSecrets checks that every secret has a value and a unique ID
+func validateWebhookSecrets(secrets []WebhookSecret) error {
+	ids := map[string]bool{legacyWebhookSecretID: true}
+	for i, secret := range secrets {
+		if secret.ID == "" {
+			return fmt.Errorf("secret #%d has no id", i+1)
+		}
+		if ids[secret.ID] {
+			return fmt.Errorf("duplicate secret id %q", secret.ID)
+		}
+		ids[secret.ID] = true
+		if secret.Secret == "" {
+			return fmt.Errorf("secret %q is empty", secret.ID)
+		}
+		if secret.Repository != "" && secret.Organization != "" {
+			return fmt.Errorf("secret %q can't be limited to a repository and an organization at once", secret.ID)
+		}
+		if secret.Repository != "" && !strings.Contains(secret.Repository, "/") {
+			return fmt.Errorf("secret %q: repository must be in owner/name form, got %q", secret.ID, secret.Repository)
+		}
+	}
+	return nil
+}
+
+func equalWebhookSecrets(a, b []WebhookSecret) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseBuckets parses a comma-separated list of durations (e.g. "30s,1m,1h30m")
+// into strictly increasing histogram bucket bounds in seconds
+func parseBuckets(bucketsStr string) ([]float64, error) {
+	var buckets []float64
+	for _, part := range strings.Split(bucketsStr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %v", part, err)
+		}
+		bound := d.Seconds()
+		if bound <= 0 {
+			return nil, fmt.Errorf("bucket %q must be positive", part)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be in increasing order, got %q after %gs", part, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bound)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("bucket list is empty")
+	}
+	return buckets, nil
+}
+
 // parseSize parses a human-readable size string (e.g. "10G", "512M") into bytes
 func parseSize(sizeStr string) (uint64, error) {
 	sizeStr = strings.TrimSpace(sizeStr)
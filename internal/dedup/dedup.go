@@ -0,0 +1,103 @@
+// internal/dedup/dedup.go
+// bounded set of recently seen keys with a time to live
+
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Set remembers keys for a limited time. When it grows above its size,
+// the oldest keys are forgotten first, so memory usage stays bounded
+// even if keys are never repeated.
+type Set struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // oldest entry at the front
+	now     func() time.Time
+}
+
+type entry struct {
+	key  string
+	seen time.Time
+}
+
+// New creates a set keeping at most size keys for ttl
+func New(size int, ttl time.Duration) *Set {
+	if size < 1 {
+		size = 1
+	}
+	return &Set{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Add remembers key and reports whether it was not seen within the TTL
+func (s *Set) Add(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.expire(now)
+
+	if _, exists := s.entries[key]; exists {
+		return false
+	}
+	s.entries[key] = s.order.PushBack(&entry{key: key, seen: now})
+	for s.order.Len() > s.size {
+		s.removeElement(s.order.Front())
+	}
+	return true
+}
+
+// Remove forgets key, e.g. when its processing failed and a retry is expected
+func (s *Set) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, exists := s.entries[key]; exists {
+		s.removeElement(el)
+	}
+}
+
+// Len returns the number of remembered keys
+func (s *Set) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(s.now())
+	return s.order.Len()
+}
+
+// SetTTL changes the time keys are remembered for
+func (s *Set) SetTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ttl = ttl
+}
+
+// expire drops keys older than the TTL. Keys are added with
+// non-decreasing time, so expired ones are always at the front. Caller holds s.mu.
+func (s *Set) expire(now time.Time) {
+	for el := s.order.Front(); el != nil; el = s.order.Front() {
+		if now.Sub(el.Value.(*entry).seen) < s.ttl {
+			return
+		}
+		s.removeElement(el)
+	}
+}
+
+// removeElement removes el from both the list and the map. Caller holds s.mu.
+func (s *Set) removeElement(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.entries, el.Value.(*entry).key)
+}
@@ -0,0 +1,49 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetTTL(t *testing.T) {
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	s := New(10, time.Minute)
+	s.now = func() time.Time { return now }
+
+	assert.True(t, s.Add("a"))
+	assert.False(t, s.Add("a"))
+
+	now = now.Add(30 * time.Second)
+	assert.True(t, s.Add("b"))
+	assert.False(t, s.Add("a"))
+
+	// "a" expires, "b" is still remembered
+	now = now.Add(31 * time.Second)
+	assert.Equal(t, 1, s.Len())
+	assert.True(t, s.Add("a"))
+	assert.False(t, s.Add("b"))
+}
+
+func TestSetSize(t *testing.T) {
+	s := New(2, time.Hour)
+
+	assert.True(t, s.Add("a"))
+	assert.True(t, s.Add("b"))
+	assert.True(t, s.Add("c"))
+	assert.Equal(t, 2, s.Len())
+
+	// The oldest key was evicted
+	assert.True(t, s.Add("a"))
+	assert.False(t, s.Add("c"))
+}
+
+func TestSetRemove(t *testing.T) {
+	s := New(10, time.Hour)
+
+	assert.True(t, s.Add("a"))
+	s.Remove("a")
+	s.Remove("missing")
+	assert.True(t, s.Add("a"))
+}
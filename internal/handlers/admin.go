@@ -2,8 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/Melsoft-Games/ant-watcher/internal/api"
 	"github.com/Melsoft-Games/ant-watcher/internal/config"
 	"github.com/Melsoft-Games/ant-watcher/internal/logger"
 	"github.com/Melsoft-Games/ant-watcher/internal/store"
@@ -11,12 +17,13 @@ import (
 
 // AdminHandler отвечает за административные функции сервиса
 type AdminHandler struct {
-	Config *config.Config
-	Store  *store.Store
+	Config     *config.Config
+	Store      store.Backend
+	Reconciler *api.Reconciler // nil when the GitHub API is not used
 }
 
 // NewAdminHandler инициализирует хендлер для административных операций
-func NewAdminHandler(cfg *config.Config, s *store.Store) http.Handler {
+func NewAdminHandler(cfg *config.Config, s store.Backend) *AdminHandler {
 	return &AdminHandler{
 		Config: cfg,
 		Store:  s,
@@ -38,6 +45,12 @@ func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleGetAllOrganizations(w, r)
 	case "/admin/repositories":
 		h.handleGetAllRepositories(w, r)
+	case "/admin/runs":
+		h.handleFindRuns(w, r)
+	case "/admin/jobs":
+		h.handleFindJobs(w, r)
+	case "/admin/reconcile":
+		h.handleReconcile(w, r)
 	default:
 		http.Error(w, "Not Found", http.StatusNotFound)
 	}
@@ -67,20 +80,21 @@ func (h *AdminHandler) handleReloadConfig(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Failed to reload configuration", http.StatusInternalServerError)
 		return
 	}
+	store.ConfigureHistograms(h.Config)
 
 	logger.Info("Configuration reloaded successfully")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Configuration reloaded successfully"))
 }
 
-// handlePrintConfig выводит текущую конфигурацию в формате JSON
+// handlePrintConfig выводит текущую конфигурацию в формате JSON, без значений секретов
 func (h *AdminHandler) handlePrintConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	configData, err := json.Marshal(h.Config)
+	configData, err := json.Marshal(h.Config.Redacted())
 	if err != nil {
 		logger.Errorf("Failed to marshal configuration: %v", err)
 		http.Error(w, "Failed to print configuration", http.StatusInternalServerError)
@@ -94,10 +108,11 @@ func (h *AdminHandler) handlePrintConfig(w http.ResponseWriter, r *http.Request)
 
 // handleGetOrganizations выводит все организации и их содержимое
 func (h *AdminHandler) handleGetAllOrganizations(w http.ResponseWriter, r *http.Request) {
-	h.Store.Mu.RLock()
-	defer h.Store.Mu.RUnlock()
-
-	organizations := h.Store.Organizations
+	if jw, ok := h.Store.(store.JSONWriter); ok {
+		writeJSONStream(w, "organizations", jw.WriteOrganizationsJSON)
+		return
+	}
+	organizations := h.Store.GetAllOrganizations()
 	response, err := json.MarshalIndent(organizations, "", "  ")
 	if err != nil {
 		logger.Errorf("Failed to marshal organizations: %v", err)
@@ -112,6 +127,10 @@ func (h *AdminHandler) handleGetAllOrganizations(w http.ResponseWriter, r *http.
 
 // handleGetRepositories выводит все репозитории в указанной организации
 func (h *AdminHandler) handleGetAllRepositories(w http.ResponseWriter, r *http.Request) {
+	if jw, ok := h.Store.(store.JSONWriter); ok {
+		writeJSONStream(w, "repositories", jw.WriteRepositoriesJSON)
+		return
+	}
 	repos := h.Store.GetAllRepositories()
 	if repos == nil {
 		http.Error(w, "Failed to retrieve repositories", http.StatusInternalServerError)
@@ -132,12 +151,10 @@ func (h *AdminHandler) handleGetAllRepositories(w http.ResponseWriter, r *http.R
 
 // handleGetStore выводит информацию о хранилище
 func (h *AdminHandler) handleGetStore(w http.ResponseWriter, r *http.Request) {
-	h.Store.Mu.RLock()
-	defer h.Store.Mu.RUnlock()
-
-	logger.Infof("Users: %+v", h.Store.Users)
-	logger.Infof("Organizations: %+v", h.Store.Organizations)
-
+	if jw, ok := h.Store.(store.JSONWriter); ok {
+		writeJSONStream(w, "store", jw.WriteJSON)
+		return
+	}
 	response, err := json.MarshalIndent(h.Store, "", "  ")
 	if err != nil {
 		logger.Errorf("Failed to marshal store: %v", err)
@@ -149,3 +166,149 @@ func (h *AdminHandler) handleGetStore(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(response)
 }
+
+// writeJSONStream отдаёт JSON, который хранилище пишет по частям, не собирая его в памяти.
+// Ответ уже начат, поэтому ошибка посреди записи только логируется.
+func writeJSONStream(w http.ResponseWriter, what string, write func(io.Writer) error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := write(w); err != nil {
+		logger.Errorf("Failed to write %s: %v", what, err)
+	}
+}
+
+// handleFindRuns выводит запуски, подходящие под параметры запроса, см. parseRunFilter
+func (h *AdminHandler) handleFindRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseRunFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, "runs", h.Store.FindRuns(filter))
+}
+
+// handleFindJobs выводит джобы, подходящие под параметры запроса, см. parseJobFilter
+func (h *AdminHandler) handleFindJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseJobFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, "jobs", h.Store.FindJobs(filter))
+}
+
+// handleReconcile запускает проход реконсилера и выводит, сколько объектов он проверил и исправил
+func (h *AdminHandler) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Reconciler == nil {
+		http.Error(w, "Reconciler is not running, GitHub API credentials are not set", http.StatusServiceUnavailable)
+		return
+	}
+
+	logger.Info("Reconciliation initiated via admin endpoint")
+	response, err := json.Marshal(h.Reconciler.Reconcile(r.Context()))
+	if err != nil {
+		logger.Errorf("Failed to marshal reconcile result: %v", err)
+		http.Error(w, "Failed to reconcile", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// writeJSON отвечает списком объектов, пустой список выводится как []
+func writeJSON[T any](w http.ResponseWriter, what string, objects []T) {
+	if objects == nil {
+		objects = []T{}
+	}
+	response, err := json.MarshalIndent(objects, "", "  ")
+	if err != nil {
+		logger.Errorf("Failed to marshal %s: %v", what, err)
+		http.Error(w, "Failed to retrieve "+what, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// parseRunFilter reads repository_id, workflow_id, status, conclusion, branch, since and until
+func parseRunFilter(q url.Values) (store.RunFilter, error) {
+	f := store.RunFilter{Status: q.Get("status"), Conclusion: q.Get("conclusion"), HeadBranch: q.Get("branch")}
+	var err error
+	if f.RepositoryID, err = parseID(q, "repository_id"); err != nil {
+		return f, err
+	}
+	if f.WorkflowID, err = parseID(q, "workflow_id"); err != nil {
+		return f, err
+	}
+	f.Since, f.Until, err = parseTimeRange(q)
+	return f, err
+}
+
+// parseJobFilter reads the parameters of parseRunFilter and runner, label
+func parseJobFilter(q url.Values) (store.JobFilter, error) {
+	runs, err := parseRunFilter(q)
+	return store.JobFilter{
+		RepositoryID: runs.RepositoryID,
+		WorkflowID:   runs.WorkflowID,
+		Status:       runs.Status,
+		Conclusion:   runs.Conclusion,
+		HeadBranch:   runs.HeadBranch,
+		RunnerName:   q.Get("runner"),
+		RunnerLabel:  q.Get("label"),
+		Since:        runs.Since,
+		Until:        runs.Until,
+	}, err
+}
+
+func parseID(q url.Values, name string) (int64, error) {
+	value := q.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return id, nil
+}
+
+// parseTimeRange reads since and until, either RFC 3339 times or durations back from now, like since=1h
+func parseTimeRange(q url.Values) (since, until time.Time, err error) {
+	now := time.Now()
+	if since, err = parseTime(q, "since", now); err != nil {
+		return
+	}
+	until, err = parseTime(q, "until", now)
+	return
+}
+
+func parseTime(q url.Values, name string, now time.Time) (time.Time, error) {
+	value := q.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+		return now.Add(-ago), nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %q, expected a RFC 3339 time or a duration like 1h", name, value)
+	}
+	return at, nil
+}
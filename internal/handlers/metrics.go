@@ -7,12 +7,46 @@ import (
 	"net/http"
 
 	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
 )
 
+// MetricsHandler отдаёт содержимое хранилища в формате Prometheus
+type MetricsHandler struct {
+	Config     *config.Config
+	Store      store.Backend
+	Registry   *metrics.Registry
+	Collectors []metrics.Collector // Коллекторы, живущие столько же, сколько сервер (например, очередь вебхуков)
+}
+
 // NewMetricsHandler инициализирует хендлер для метрик Prometheus/VictoriaMetrics
-func NewMetricsHandler(cfg *config.Config) http.Handler {
-	// Здесь будет логика хендлера для метрик
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Metrics handler"))
-	})
+func NewMetricsHandler(cfg *config.Config, s store.Backend, collectors ...metrics.Collector) http.Handler {
+	return &MetricsHandler{
+		Config:     cfg,
+		Store:      s,
+		Registry:   metrics.Default,
+		Collectors: collectors,
+	}
+}
+
+// ServeHTTP рендерит метрики в текстовом формате экспозиции
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mw := metrics.NewWriter()
+	h.Store.Collect(mw)
+	h.Registry.Collect(mw)
+	for _, c := range h.Collectors {
+		c.Collect(mw)
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := mw.WriteTo(w); err != nil {
+		logger.Errorf("Failed to write metrics: %v", err)
+	}
 }
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	s := store.NewStore()
+	repo := &github.Repository{ID: github.Int64(5), FullName: github.String("org/repo")}
+	s.AddOrUpdateRepository(5, models.NewRepository(repo))
+	s.AddOrUpdateWorkflowRun(1, models.NewWorkflowRun(&github.WorkflowRun{
+		ID:         github.Int64(1),
+		Name:       github.String("CI"),
+		HeadBranch: github.String("main"),
+		Event:      github.String("push"),
+		Status:     github.String("in_progress"),
+		Repository: repo,
+	}))
+	s.AddOrUpdateJob(10, models.NewJob(&github.WorkflowJob{
+		ID:     github.Int64(10),
+		RunID:  github.Int64(1),
+		Status: github.String("completed"),
+		Steps: []*github.TaskStep{
+			{Number: github.Int64(1), Status: github.String("completed"), Conclusion: github.String("success")},
+			{Number: github.Int64(2), Status: github.String("completed"), Conclusion: github.String("failure")},
+		},
+		Conclusion: github.String("failure"),
+	}, 5))
+
+	handler := &MetricsHandler{Config: &config.Config{}, Store: s, Registry: &metrics.Registry{}}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, metrics.ContentType, w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	assert.Contains(t, body,
+		`ant_watcher_workflow_runs{repository="org/repo",workflow="CI",branch="main",event="push",status="in_progress",conclusion=""} 1`)
+	assert.Contains(t, body,
+		`ant_watcher_workflow_jobs{repository="org/repo",workflow="CI",branch="main",event="push",status="completed",conclusion="failure"} 1`)
+	assert.Contains(t, body,
+		`ant_watcher_workflow_steps{repository="org/repo",workflow="CI",branch="main",event="push",status="completed",conclusion="success"} 1`)
+	assert.Contains(t, body,
+		`ant_watcher_workflow_steps{repository="org/repo",workflow="CI",branch="main",event="push",status="completed",conclusion="failure"} 1`)
+
+	// Wrong method
+	req = httptest.NewRequest(http.MethodPost, "/metrics", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,73 @@
+// internal/handlers/signature.go
+// webhook signature validation against the active secrets
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/google/go-github/v66/github"
+)
+
+// Метрики позволяют увидеть, когда старый секрет перестал использоваться и его можно удалить
+var (
+	secretMatches = metrics.NewCounter("ant_watcher_webhook_secret_matches_total",
+		"Number of webhook deliveries verified with each secret.", "secret_id")
+	secretLastMatch = metrics.NewGauge("ant_watcher_webhook_secret_last_match_timestamp_seconds",
+		"Unix time of the last webhook delivery verified with each secret.", "secret_id")
+	webhooksRejected = metrics.NewCounter("ant_watcher_webhook_rejected_total",
+		"Number of webhook deliveries rejected by reason.", "reason")
+)
+
+func init() {
+	metrics.Register(secretMatches, secretLastMatch, webhooksRejected)
+}
+
+// payloadScope содержит поля вебхука, по которым выбираются секреты
+type payloadScope struct {
+	Repository struct {
+		FullName string `json:"full_name"`
+		Owner    struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+	Organization struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+}
+
+// verifySignature проверяет X-Hub-Signature-256 всеми секретами, подходящими
+// для репозитория и организации доставки, и возвращает ID совпавшего секрета.
+// Поля для выбора секретов читаются из ещё не проверенного payload, но подделка
+// ничего не даёт: подпись всё равно должна совпасть с одним из настроенных секретов.
+func verifySignature(auth config.WebhookAuth, signature string, body, payload []byte) (string, error) {
+	if signature == "" {
+		return "", fmt.Errorf("missing %s header", github.SHA256SignatureHeader)
+	}
+
+	var scope payloadScope
+	if err := json.Unmarshal(payload, &scope); err != nil {
+		return "", fmt.Errorf("could not read repository from payload: %v", err)
+	}
+	organization := scope.Organization.Login
+	if organization == "" {
+		organization = scope.Repository.Owner.Login
+	}
+
+	secrets := auth.SecretsFor(scope.Repository.FullName, organization)
+	if len(secrets) == 0 {
+		return "", fmt.Errorf("no webhook secret configured for repository %q", scope.Repository.FullName)
+	}
+	for _, secret := range secrets {
+		if github.ValidateSignature(signature, body, []byte(secret.Secret)) == nil {
+			secretMatches.Inc(secret.ID)
+			secretLastMatch.Set(float64(time.Now().Unix()), secret.ID)
+			return secret.ID, nil
+		}
+	}
+	return "", fmt.Errorf("payload signature doesn't match any of %d secrets for repository %q", len(secrets), scope.Repository.FullName)
+}
@@ -1,44 +1,268 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"time"
 
 	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/dedup"
 	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/Melsoft-Games/ant-watcher/internal/queue"
 	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/Melsoft-Games/ant-watcher/internal/wal"
 	"github.com/google/go-github/v66/github"
 )
 
+// GitHub не присылает вебхуки больше 25 МБ
+const maxPayloadSize = 25 << 20
+
+// Delivery is a validated webhook delivery waiting for a worker
+type Delivery struct {
+	ID       string      // X-GitHub-Delivery
+	Type     string      // X-GitHub-Event
+	Payload  []byte      // JSON payload
+	Received time.Time   // Time the delivery was accepted
+	event    interface{} // Parsed payload, so workers don't parse it twice
+	seq      uint64      // Record of the delivery in the write-ahead log, 0 if it is not logged
+}
+
+// walRecord is a delivery as it is kept in the write-ahead log
+type walRecord struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Received time.Time       `json:"received"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
 // WebhookHandler обрабатывает входящие запросы GitHub Webhook
 type WebhookHandler struct {
-	Store  *store.Store
-	Secret []byte
+	Store  store.Backend
+	Config *config.Config // Секрет читается на каждый запрос, чтобы работала перезагрузка конфигурации
+	Queue  *queue.Queue[Delivery]
+
+	Deliveries *dedup.Set // Недавно принятые X-GitHub-Delivery, повторы подтверждаются без применения
+	WAL        *wal.Log   // Журнал принятых доставок, nil если журнал выключен. Задаётся до запуска сервера
+}
+
+var (
+	queueDropped = metrics.NewCounter("ant_watcher_webhook_queue_dropped_total",
+		"Number of webhook deliveries rejected with 503 because the queue was full.")
+	duplicateDeliveries = metrics.NewCounter("ant_watcher_webhook_duplicate_deliveries_total",
+		"Number of webhook deliveries acknowledged without processing because their X-GitHub-Delivery was already seen.")
+)
+
+func init() {
+	metrics.Register(queueDropped, duplicateDeliveries)
 }
 
-// NewWebhookHandler инициализирует хендлер для вебхуков
-func NewWebhookHandler(store *store.Store, cfg *config.Config) http.Handler {
-	return &WebhookHandler{
-		Store:  store,
-		Secret: []byte(cfg.WebhookSecret),
+// NewWebhookHandler инициализирует хендлер для вебхуков и запускает пул воркеров.
+// Воркеры останавливаются через Close.
+func NewWebhookHandler(store store.Backend, cfg *config.Config) *WebhookHandler {
+	if !cfg.HasWebhookSecrets() {
+		if cfg.UnsignedHooksAllowed() {
+			logger.Warning("Webhook secret is not set, signatures of incoming webhooks will NOT be checked")
+		} else {
+			logger.Error("Webhook secret is not set, all incoming webhooks will be rejected until it is configured")
+		}
 	}
+	h := &WebhookHandler{
+		Store:      store,
+		Config:     cfg,
+		Deliveries: dedup.New(cfg.DeliveryDedupSizeNum, cfg.DeliveryDedupTTLTime),
+	}
+	h.Queue = queue.New(cfg.WebhookQueueSizeNum, cfg.WebhookWorkersNum, h.Process)
+	h.Queue.Start()
+	return h
+}
+
+// Collect отдаёт состояние очереди вебхуков
+func (h *WebhookHandler) Collect(w *metrics.Writer) {
+	metrics.NewGaugeFunc("ant_watcher_webhook_queue_depth",
+		"Number of webhook deliveries waiting for a worker.",
+		func() float64 { return float64(h.Queue.Len()) }).Collect(w)
+	metrics.NewGaugeFunc("ant_watcher_webhook_queue_capacity",
+		"Capacity of the webhook queue.",
+		func() float64 { return float64(h.Queue.Cap()) }).Collect(w)
+	metrics.NewGaugeFunc("ant_watcher_webhook_remembered_deliveries",
+		"Number of delivery IDs remembered for deduplication.",
+		func() float64 { return float64(h.Deliveries.Len()) }).Collect(w)
+}
+
+// Close перестаёт принимать вебхуки и ждёт, пока воркеры обработают очередь
+func (h *WebhookHandler) Close(ctx context.Context) error {
+	return h.Queue.Close(ctx)
 }
 
 // ServeHTTP обрабатывает запросы вебхуков
 func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// payload, err := github.ValidatePayload(r, h.Secret)
-	payload, err := github.ValidatePayload(r, nil)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Настройки читаются один раз, чтобы перезагрузка посреди запроса не смешала старые и новые
+	auth := h.Config.WebhookAuth()
+	if !auth.HasSecrets() && !auth.UnsignedAllowed() {
+		logger.Errorf("Rejected webhook %s: webhook secret is not configured", github.DeliveryID(r))
+		webhooksRejected.Inc("no_secret")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		logger.Errorf("Invalid content type: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		logger.Errorf("Failed to read webhook body: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	// Извлекаем JSON из тела, подпись проверяется отдельно ниже
+	payload, err := github.ValidatePayloadFromBody(contentType, bytes.NewReader(body), "", nil)
 	if err != nil {
 		logger.Errorf("Invalid payload: %v", err)
 		http.Error(w, "Invalid payload", http.StatusBadRequest)
 		return
 	}
 
+	// Без секретов сюда доходят только при явно разрешённом режиме AllowUnsignedHooks
+	if auth.HasSecrets() {
+		secretID, err := verifySignature(auth, r.Header.Get(github.SHA256SignatureHeader), body, payload)
+		if err != nil {
+			logger.Errorf("Rejected webhook %s: %v", github.DeliveryID(r), err)
+			webhooksRejected.Inc("signature")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		logger.Debugf("Webhook %s verified with secret %q", github.DeliveryID(r), secretID)
+	}
+
 	event, err := github.ParseWebHook(github.WebHookType(r), payload)
 	if err != nil {
 		logger.Errorf("Failed to parse webhook: %v", err)
-		http.Error(w, "Failed to parse webhook", http.StatusInternalServerError)
+		http.Error(w, "Failed to parse webhook", http.StatusBadRequest)
+		return
+	}
+
+	deliveryType := github.WebHookType(r)
+	switch event.(type) {
+	case *github.WorkflowRunEvent, *github.WorkflowJobEvent, *github.WorkflowDispatchEvent:
+	default:
+		logger.Infof("Unhandled event type: %s", deliveryType)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	delivery := Delivery{
+		ID:       github.DeliveryID(r),
+		Type:     deliveryType,
+		Payload:  payload,
+		Received: time.Now(),
+		event:    event,
+	}
+
+	// GitHub повторяет доставку с тем же ID, если не дождался ответа, и при ручном Redeliver
+	h.Deliveries.SetTTL(h.Config.DeliveryTTL())
+	if delivery.ID != "" && !h.Deliveries.Add(delivery.ID) {
+		logger.Infof("Webhook %s is a duplicate, skipping", delivery.ID)
+		duplicateDeliveries.Inc()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Доставка пишется в журнал до подтверждения, чтобы пережить падение, пока она в очереди
+	if h.WAL != nil {
+		if delivery.seq, err = h.appendToWAL(delivery); err != nil {
+			logger.Errorf("Webhook %s is not accepted: %v", delivery.ID, err)
+			h.Deliveries.Remove(delivery.ID)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if err := h.Queue.Enqueue(delivery); err != nil {
+		logger.Warningf("Webhook %s is not accepted: %v", delivery.ID, err)
+		// Доставка не принята, поэтому её повтор должен пройти.
+		// Запись в журнале остаётся, повторное применение безвредно
+		h.Deliveries.Remove(delivery.ID)
+		h.done(delivery)
+		// При остановке очередь закрыта, это не потеря из-за переполнения
+		if errors.Is(err, queue.ErrFull) {
+			queueDropped.Inc()
+		}
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// appendToWAL пишет доставку в журнал и возвращает номер записи
+func (h *WebhookHandler) appendToWAL(d Delivery) (uint64, error) {
+	data, err := json.Marshal(walRecord{ID: d.ID, Type: d.Type, Received: d.Received, Payload: d.Payload})
+	if err != nil {
+		return 0, fmt.Errorf("could not encode WAL record: %v", err)
+	}
+	return h.WAL.Append(data)
+}
+
+// done отмечает запись доставки в журнале применённой
+func (h *WebhookHandler) done(d Delivery) {
+	if h.WAL != nil && d.seq != 0 {
+		h.WAL.Done(d.seq)
+	}
+}
+
+// Replay применяет к хранилищу доставки из журнала после записи after,
+// вызывается при старте до запуска сервера. Возвращает число применённых доставок.
+func (h *WebhookHandler) Replay(after uint64) (int, error) {
+	if h.WAL == nil {
+		return 0, nil
+	}
+	replayed := 0
+	err := h.WAL.Replay(after, func(seq uint64, data []byte) error {
+		var record walRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			// Контрольная сумма сошлась, значит запись написана несовместимой версией
+			return fmt.Errorf("could not decode WAL record %d: %v", seq, err)
+		}
+		if record.ID != "" {
+			h.Deliveries.Add(record.ID)
+		}
+		h.Process(Delivery{ID: record.ID, Type: record.Type, Payload: record.Payload, Received: record.Received})
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// Process применяет доставку к хранилищу, вызывается воркерами очереди
+func (h *WebhookHandler) Process(d Delivery) {
+	defer h.done(d)
+
+	event := d.event
+	if event == nil {
+		var err error
+		if event, err = github.ParseWebHook(d.Type, d.Payload); err != nil {
+			logger.Errorf("Failed to parse webhook %s: %v", d.ID, err)
+			return
+		}
+	}
 
 	switch e := event.(type) {
 	// case *github.CheckRunEvent:
@@ -52,8 +276,7 @@ func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case *github.WorkflowDispatchEvent:
 		h.handleWorkflowDispatch(e)
 	default:
-		logger.Infof("Unhandled event type: %s", github.WebHookType(r))
-		w.WriteHeader(http.StatusOK)
+		logger.Infof("Unhandled event type: %s", d.Type)
 	}
 }
 
@@ -63,68 +286,60 @@ func (h *WebhookHandler) handleWorkflowRun(event *github.WorkflowRunEvent) {
 
 	logger.Debug("WorkflowRunEvent: ", runRaw)
 
-    // Проверка, что это действительно WorkflowRun
-    if runRaw == nil {
-        logger.Errorf("WorkflowRun is nil")
-        return
-    }
+	// Проверка, что это действительно WorkflowRun
+	if runRaw == nil {
+		logger.Errorf("WorkflowRun is nil")
+		return
+	}
 
 	runID := runRaw.GetID()
-	runNumber := runRaw.GetRunNumber()
 	status := runRaw.GetStatus()
 
- 	// Проверяем статус на наличие
-    if status == "" {
-        logger.Errorf("Status is nil or empty for RunID=%d", runID)
-        return
-    }
-
-	workflowRun := &github.WorkflowRun{
-	    ID:           github.Int64(runID),             // Проверяем, что runID не nil
-	    RunNumber:    &runNumber,                      // Убираем github.Int, если runNumber уже int
-		Status:       github.String(status),
-	    Conclusion:   runRaw.Conclusion,
-	    CreatedAt:    runRaw.CreatedAt,
-	    RunStartedAt: runRaw.RunStartedAt,
-	    UpdatedAt:    runRaw.UpdatedAt,
-	    Actor:        runRaw.Actor,
-	}
-
-	// Обновляем хранилище воркфлоу-ранов
-	//h.Store.AddOrUpdateWorkflowRun(runID, workflowRun)
-	h.Store.AddOrUpdateWorkflowRun(event.WorkflowRun.GetID(), workflowRun)
-	h.Store.AddOrUpdateOrganization(event.Org.GetID(), event.Org)
-	h.Store.AddOrUpdateRepository(event.Repo.GetID(), event.Repo)
+	// Проверяем статус на наличие
+	if status == "" {
+		logger.Errorf("Status is nil or empty for RunID=%d", runID)
+		return
+	}
+
+	// Сначала родители, чтобы запуск сразу попал в дерево
+	h.storeOwnerAndRepository(event.Org, event.Repo)
+	run := models.NewWorkflowRun(runRaw)
+	if run.RepositoryID == nil && event.Repo != nil {
+		run.RepositoryID = event.Repo.ID
+	}
+	if event.Workflow != nil {
+		h.Store.AddOrUpdateWorkflow(event.Workflow.GetID(), models.NewWorkflow(event.Workflow, run.GetRepositoryID()))
+	}
+	h.Store.AddOrUpdateWorkflowRun(runID, run)
 
 	logger.Infof("WorkflowRun handled: RunID=%d, RunNumber=%d, Status=%s, Conclusion=%s, CreatedAt=%s, RunStartedAt=%s",
-		runID, runNumber, runRaw.GetStatus(), runRaw.GetConclusion(), runRaw.GetCreatedAt(), runRaw.GetRunStartedAt())
+		runID, runRaw.GetRunNumber(), status, runRaw.GetConclusion(), runRaw.GetCreatedAt(), runRaw.GetRunStartedAt())
 }
 
 // handleWorkflowJob обрабатывает событие WorkflowJobEvent
 func (h *WebhookHandler) handleWorkflowJob(event *github.WorkflowJobEvent) {
 	job := event.WorkflowJob
-	// Ищем запуск воркфлоу
-	runID := job.GetRunID()
-
-	// Обработка времени создания, начала и завершения джоба
-	jobModel := &github.WorkflowJob{
-		ID:          github.Int64(job.GetID()),
-		Status:      job.Status,
-		Conclusion:  job.Conclusion,
-		CreatedAt:   job.CreatedAt,  // Добавляем время создания
-		StartedAt:   job.StartedAt,  // Добавляем время начала
-		CompletedAt: job.CompletedAt,  // Добавляем время завершения
-		RunnerID:    job.RunnerID,
-		RunnerName:  job.RunnerName,
-		Labels:      job.Labels,
-		Steps:       job.Steps,
-	}
-
-	// Добавляем или обновляем джоб
-	h.Store.AddOrUpdateJob(runID, jobModel)
+	if job == nil {
+		logger.Errorf("WorkflowJob is nil")
+		return
+	}
+
+	// Джобы одного запуска связываются с ним по RunID
+	h.storeOwnerAndRepository(event.Org, event.Repo)
+	h.Store.AddOrUpdateJob(job.GetID(), models.NewJob(job, event.GetRepo().GetID()))
 
 	logger.Infof("WorkflowJob handled: JobID=%d, RunID=%d, Status=%s, Conclusion=%s, CreatedAt=%s, StartedAt=%s, CompletedAt=%s",
-		job.GetID(), runID, job.GetStatus(), job.GetConclusion(), job.GetCreatedAt(), job.GetStartedAt(), job.GetCompletedAt())
+		job.GetID(), job.GetRunID(), job.GetStatus(), job.GetConclusion(), job.GetCreatedAt(), job.GetStartedAt(), job.GetCompletedAt())
+}
+
+// storeOwnerAndRepository сохраняет организацию и репозиторий из события, если они есть
+func (h *WebhookHandler) storeOwnerAndRepository(org *github.Organization, repo *github.Repository) {
+	if org != nil {
+		h.Store.AddOrUpdateOrganization(org.GetID(), models.NewOrganization(org))
+	}
+	if repo != nil {
+		h.Store.AddOrUpdateRepository(repo.GetID(), models.NewRepository(repo))
+	}
 }
 
 // handleWorkflowDispatch обрабатывает событие WorkflowDispatchEvent
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/Melsoft-Games/ant-watcher/internal/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRunPayload = `{
+	"action": "completed",
+	"workflow_run": {"id": 42, "name": "CI", "status": "completed", "conclusion": "success"},
+	"repository": {"id": 5, "full_name": "org/repo"}
+}`
+
+// sign returns the X-Hub-Signature-256 value of payload
+func sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookRequest(payload, signature string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "workflow_run")
+	req.Header.Set("X-GitHub-Delivery", "delivery-1")
+	if signature != "" {
+		req.Header.Set("X-Hub-Signature-256", signature)
+	}
+	return req
+}
+
+// TestWebhookSignature checks HMAC validation against the configured secret
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.Config
+		signature string
+		code      int
+		stored    bool
+	}{
+		{"valid signature", config.Config{WebhookSecret: "s3cret"}, sign("s3cret", testRunPayload), http.StatusAccepted, true},
+		{"wrong secret", config.Config{WebhookSecret: "s3cret"}, sign("other", testRunPayload), http.StatusUnauthorized, false},
+		{"malformed signature", config.Config{WebhookSecret: "s3cret"}, "sha256=zz", http.StatusUnauthorized, false},
+		{"missing signature", config.Config{WebhookSecret: "s3cret"}, "", http.StatusUnauthorized, false},
+		{"no secret, opt-out disabled", config.Config{AllowUnsignedHooks: "false"}, sign("s3cret", testRunPayload), http.StatusUnauthorized, false},
+		{"no secret, opt-out not set", config.Config{}, "", http.StatusUnauthorized, false},
+		{"no secret, opt-out enabled", config.Config{AllowUnsignedHooks: "true"}, "", http.StatusAccepted, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewStore()
+			cfg := tt.cfg
+			handler := NewWebhookHandler(s, &cfg)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newWebhookRequest(testRunPayload, tt.signature))
+
+			assert.Equal(t, tt.code, w.Code)
+			assert.NoError(t, handler.Close(context.Background()))
+			_, stored := s.GetWorkflowRun(42)
+			assert.Equal(t, tt.stored, stored)
+		})
+	}
+}
+
+// TestWebhookSecretReload checks that a changed secret is used without restart
+func TestWebhookSecretReload(t *testing.T) {
+	cfg := &config.Config{WebhookSecret: "old"}
+	handler := NewWebhookHandler(store.NewStore(), cfg)
+
+	cfg.WebhookSecret = "new"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newWebhookRequest(testRunPayload, sign("new", testRunPayload)))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
+
+// TestWebhookSecretReloadInFlight checks that deliveries checked while the secrets are reloaded
+// see either the old or the new settings, run it with -race
+func TestWebhookSecretReloadInFlight(t *testing.T) {
+	t.Setenv("CONFIG_FILE_PATH", "not-existing.json")
+	t.Setenv("ALLOW_UNSIGNED_HOOKS", "false")
+	t.Setenv("WEBHOOK_SECRET", "")
+	t.Setenv("WEBHOOK_SECRETS", `[{"id": "a", "secret": "s3cret"}]`)
+	cfg, err := config.LoadConfig()
+	assert.NoError(t, err)
+	handler := NewWebhookHandler(store.NewStore(), cfg)
+	defer handler.Close(context.Background())
+
+	// The secret moves between WebhookSecrets and WebhookSecret, there is always one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if i%2 == 0 {
+				os.Setenv("WEBHOOK_SECRET", "s3cret")
+				os.Setenv("WEBHOOK_SECRETS", "[]")
+			} else {
+				os.Setenv("WEBHOOK_SECRET", "")
+				os.Setenv("WEBHOOK_SECRETS", `[{"id": "a", "secret": "s3cret"}]`)
+			}
+			assert.NoError(t, cfg.ReloadConfig())
+		}
+	}()
+
+	// Rejected deliveries aren't queued, nothing but the config orders them after the reloads
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for _, signature := range []string{"", sign("other", testRunPayload)} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newWebhookRequest(testRunPayload, signature))
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
+
+// TestWebhookBadRequest checks non-signature failures
+func TestWebhookBadRequest(t *testing.T) {
+	handler := NewWebhookHandler(store.NewStore(), &config.Config{WebhookSecret: "s3cret"})
+
+	req := newWebhookRequest(testRunPayload, sign("s3cret", testRunPayload))
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+// TestWebhookSecretRotation checks that any active secret is accepted and the match is recorded
+func TestWebhookSecretRotation(t *testing.T) {
+	cfg := &config.Config{
+		WebhookQueueSizeNum: 100,
+		WebhookSecret:       "legacy",
+		WebhookSecrets: []config.WebhookSecret{
+			{ID: "rotation-new", Secret: "new"},
+			{ID: "repo-override", Secret: "repo-only", Repository: "org/special"},
+			{ID: "org-override", Secret: "org-only", Organization: "other-org"},
+		},
+	}
+	handler := NewWebhookHandler(store.NewStore(), cfg)
+
+	tests := []struct {
+		name     string
+		payload  string
+		secret   string
+		code     int
+		secretID string
+	}{
+		{"legacy secret", testRunPayload, "legacy", http.StatusAccepted, "default"},
+		{"new secret", testRunPayload, "new", http.StatusAccepted, "rotation-new"},
+		{"repository override", strings.Replace(testRunPayload, "org/repo", "org/special", 1), "repo-only", http.StatusAccepted, "repo-override"},
+		{"global secret is not accepted for overridden repository", strings.Replace(testRunPayload, "org/repo", "org/special", 1), "new", http.StatusUnauthorized, ""},
+		{"override is not accepted for other repositories", testRunPayload, "repo-only", http.StatusUnauthorized, ""},
+		{"organization override", `{"action":"completed","workflow_run":{"id":7,"status":"completed"},"repository":{"full_name":"other-org/repo","owner":{"login":"other-org"}}}`, "org-only", http.StatusAccepted, "org-override"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := secretMatches.Value(tt.secretID)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newWebhookRequest(tt.payload, sign(tt.secret, tt.payload)))
+			assert.Equal(t, tt.code, w.Code)
+			if tt.secretID != "" {
+				assert.Equal(t, before+1, secretMatches.Value(tt.secretID))
+				assert.NotZero(t, secretLastMatch.Value(tt.secretID))
+			}
+		})
+	}
+}
+
+// TestWebhookQueueFull checks the 503 push back when workers can't keep up
+func TestWebhookQueueFull(t *testing.T) {
+	s := store.NewStore()
+	cfg := &config.Config{AllowUnsignedHooks: "true", WebhookWorkersNum: 1, WebhookQueueSizeNum: 1}
+	handler := NewWebhookHandler(s, cfg)
+
+	// Block the only worker on the lock of the repositories
+	s.Mu.Lock()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newWebhookRequest(testRunPayload, ""))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Eventually(t, func() bool { return handler.Queue.Len() == 0 }, time.Second, time.Millisecond)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newWebhookRequest(testRunPayload, ""))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	before := queueDropped.Value()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newWebhookRequest(testRunPayload, ""))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, before+1, queueDropped.Value())
+
+	// Queue depth is exposed as a metric
+	mw := metrics.NewWriter()
+	handler.Collect(mw)
+	assert.Contains(t, string(mw.Bytes()), "ant_watcher_webhook_queue_depth 1\n")
+
+	s.Mu.Unlock()
+	assert.NoError(t, handler.Close(context.Background()))
+	_, stored := s.GetWorkflowRun(42)
+	assert.True(t, stored)
+
+	// Deliveries refused during shutdown are not counted as dropped
+	before = queueDropped.Value()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newWebhookRequest(testRunPayload, ""))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, before, queueDropped.Value())
+}
+
+// TestWebhookUnhandledEvent checks that other events are acknowledged without queueing
+func TestWebhookUnhandledEvent(t *testing.T) {
+	handler := NewWebhookHandler(store.NewStore(), &config.Config{AllowUnsignedHooks: "true"})
+	req := newWebhookRequest(`{"zen": "Keep it logically awesome."}`, "")
+	req.Header.Set("X-GitHub-Event", "ping")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, handler.Queue.Len())
+}
+
+// TestWebhookDuplicateDelivery checks that a redelivered webhook is acknowledged but not applied again
+func TestWebhookDuplicateDelivery(t *testing.T) {
+	s := store.NewStore()
+	cfg := &config.Config{
+		AllowUnsignedHooks:   "true",
+		WebhookQueueSizeNum:  10,
+		DeliveryDedupSizeNum: 10,
+		DeliveryDedupTTLTime: time.Hour,
+	}
+	handler := NewWebhookHandler(s, cfg)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newWebhookRequest(testRunPayload, ""))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	before := duplicateDeliveries.Value()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newWebhookRequest(testRunPayload, ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, before+1, duplicateDeliveries.Value())
+
+	// An in_progress event delivered after completed must not roll the job back
+	job := func(delivery, status string) *http.Request {
+		req := newWebhookRequest(`{"action":"`+status+`","workflow_job":{"id":7,"run_id":42,"status":"`+status+`"}}`, "")
+		req.Header.Set("X-GitHub-Event", "workflow_job")
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		return req
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, job("delivery-2", "completed"))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Eventually(t, func() bool { _, ok := s.GetJob(7); return ok }, time.Second, time.Millisecond)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, job("delivery-3", "in_progress"))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	assert.NoError(t, handler.Close(context.Background()))
+	stored, _ := s.GetJob(7)
+	assert.Equal(t, "completed", stored.GetStatus())
+}
+
+// TestWebhookWAL checks that accepted deliveries are logged and replayed into a fresh store
+func TestWebhookWAL(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		AllowUnsignedHooks:   "true",
+		WebhookQueueSizeNum:  10,
+		DeliveryDedupSizeNum: 10,
+		DeliveryDedupTTLTime: time.Hour,
+	}
+	job := func(delivery, status string) *http.Request {
+		req := newWebhookRequest(`{"action":"`+status+`","workflow_job":{"id":7,"run_id":42,"status":"`+status+`"}}`, "")
+		req.Header.Set("X-GitHub-Event", "workflow_job")
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		return req
+	}
+
+	log, err := wal.Open(dir, 1<<20)
+	assert.NoError(t, err)
+	handler := NewWebhookHandler(store.NewStore(), cfg)
+	handler.WAL = log
+	for _, req := range []*http.Request{job("delivery-1", "queued"), job("delivery-2", "completed")} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+	assert.NoError(t, handler.Close(context.Background()))
+	assert.Equal(t, uint64(2), log.Applied())
+	assert.NoError(t, log.Close())
+
+	// After a restart the log is replayed on top of a snapshot which covers the first record
+	log, err = wal.Open(dir, 1<<20)
+	assert.NoError(t, err)
+	defer log.Close()
+	s := store.NewStore()
+	restarted := NewWebhookHandler(s, cfg)
+	defer restarted.Close(context.Background())
+	restarted.WAL = log
+	replayed, err := restarted.Replay(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	stored, _ := s.GetJob(7)
+	assert.Equal(t, "completed", stored.GetStatus())
+
+	// Replayed deliveries are remembered, so their redelivery is not applied again
+	w := httptest.NewRecorder()
+	restarted.ServeHTTP(w, job("delivery-2", "completed"))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
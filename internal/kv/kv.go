@@ -0,0 +1,401 @@
+// internal/kv/kv.go
+// embedded key-value store in a single append-only file
+
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+)
+
+// Record layout: CRC-32C of the rest of the record (uint32), kind (uint8),
+// key length (uint32), value length (uint32), key, value. Little endian.
+const headerSize = 13
+
+const (
+	recordPut    byte = 1
+	recordDelete byte = 2
+)
+
+// maxRecordSize protects the scan from allocating garbage lengths of a damaged header
+const maxRecordSize = 256 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTorn is returned by the reader when a record is incomplete or its checksum doesn't match
+var errTorn = errors.New("torn record")
+
+// ErrClosed is returned by operations on a closed store
+var ErrClosed = errors.New("kv store is closed")
+
+// Store keeps all records in one file, every write is appended and synced
+// to disk before it returns. Keys and the offsets of their last values are
+// kept in memory, values are read from the file. Overwritten and deleted
+// values stay in the file until Compact rewrites it.
+type Store struct {
+	mu   sync.RWMutex
+	path string
+	file *os.File
+	size int64            // Size of the file, the next record is written at this offset
+	live int64            // Size of the records referenced by keys
+	keys map[string]entry // Key -> location of its last value
+}
+
+type entry struct {
+	offset int64 // Offset of the record
+	size   int64 // Size of the whole record
+}
+
+// Open opens the store at path, creating the file and its directory if needed.
+// A torn record at the end of the file, left by a crash in the middle of a write,
+// is cut off. Damage anywhere else is reported as an error.
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create kv directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open kv file: %v", err)
+	}
+	s := &Store{path: path, file: file, keys: make(map[string]entry)}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the keys from the file
+func (s *Store) load() error {
+	var offset int64
+	reader := &offsetReader{r: s.file}
+	for {
+		kind, key, _, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tail, tailErr := s.isTail(offset)
+			if tailErr != nil {
+				return tailErr
+			}
+			if !tail {
+				return fmt.Errorf("kv file %s is damaged at offset %d: %v", s.path, offset, err)
+			}
+			logger.Warningf("Truncating torn record at offset %d of %s: %v", offset, s.path, err)
+			if err := s.file.Truncate(offset); err != nil {
+				return fmt.Errorf("could not truncate kv file: %v", err)
+			}
+			break
+		}
+		if old, ok := s.keys[key]; ok {
+			s.live -= old.size
+		}
+		if kind == recordPut {
+			s.keys[key] = entry{offset: offset, size: size}
+			s.live += size
+		} else {
+			delete(s.keys, key)
+		}
+		offset += size
+	}
+	s.size = offset
+	return nil
+}
+
+// isTail reports whether the damaged record at offset is the last one of the file:
+// it is cut short by the end of the file, or only zeros follow it, as a crash in the
+// middle of a write leaves it. Records after it mean the file is damaged otherwise.
+func (s *Store) isTail(offset int64) (bool, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("could not stat kv file: %v", err)
+	}
+	rest := info.Size() - offset
+	if rest < headerSize {
+		return true, nil
+	}
+	var header [headerSize]byte
+	if _, err := s.file.ReadAt(header[:], offset); err != nil {
+		return false, fmt.Errorf("could not read kv record at offset %d: %v", offset, err)
+	}
+	kind := header[4]
+	bodySize := int64(binary.LittleEndian.Uint32(header[5:])) + int64(binary.LittleEndian.Uint32(header[9:]))
+	if (kind == recordPut || kind == recordDelete) && bodySize <= maxRecordSize && headerSize+bodySize >= rest {
+		return true, nil
+	}
+
+	buf := make([]byte, 32<<10)
+	for pos := offset; pos < info.Size(); {
+		n, err := s.file.ReadAt(buf, pos)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		pos += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not read kv file: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// Get returns the value of key
+func (s *Store) Get(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return nil, false, ErrClosed
+	}
+
+	e, ok := s.keys[key]
+	if !ok {
+		return nil, false, nil
+	}
+	value, err := s.read(e)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// read returns the value of the record at e. Caller holds s.mu.
+func (s *Store) read(e entry) ([]byte, error) {
+	_, _, value, _, err := readRecord(io.NewSectionReader(s.file, e.offset, e.size))
+	if err != nil {
+		return nil, fmt.Errorf("could not read kv record at offset %d: %v", e.offset, err)
+	}
+	return value, nil
+}
+
+// Put stores value under key
+func (s *Store) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(recordPut, key, value)
+}
+
+// Delete removes key, deleting a missing key is not an error
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key]; !ok {
+		return nil
+	}
+	return s.append(recordDelete, key, nil)
+}
+
+// append writes a record to the end of the file and updates the keys. Caller holds s.mu.
+func (s *Store) append(kind byte, key string, value []byte) error {
+	if s.file == nil {
+		return ErrClosed
+	}
+	record := encodeRecord(kind, key, value)
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		// Cut a partial write off, so the next record doesn't follow garbage
+		s.file.Truncate(s.size)
+		return fmt.Errorf("could not write kv record: %v", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync kv file: %v", err)
+	}
+
+	size := int64(len(record))
+	if old, ok := s.keys[key]; ok {
+		s.live -= old.size
+	}
+	if kind == recordPut {
+		s.keys[key] = entry{offset: s.size, size: size}
+		s.live += size
+	} else {
+		delete(s.keys, key)
+	}
+	s.size += size
+	return nil
+}
+
+// Scan calls fn with every key starting with prefix and its value, in key order,
+// until fn returns false. fn must not modify the store.
+func (s *Store) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return ErrClosed
+	}
+
+	for _, key := range s.sortedKeys(prefix) {
+		value, err := s.read(s.keys[key])
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys starting with prefix in key order
+func (s *Store) Keys(prefix string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sortedKeys(prefix)
+}
+
+// sortedKeys returns the keys starting with prefix in key order. Caller holds s.mu.
+func (s *Store) sortedKeys(prefix string) []string {
+	var keys []string
+	for key := range s.keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Size returns the size of the file and the part of it taken by current values
+func (s *Store) Size() (total, live int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size, s.live
+}
+
+// Compact rewrites the file with current values only. The new file is written
+// next to the old one and replaces it, so a crash leaves one of them intact.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return ErrClosed
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".compact-*")
+	if err != nil {
+		return fmt.Errorf("could not create kv file: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	keys := make(map[string]entry, len(s.keys))
+	var offset int64
+	for _, key := range s.sortedKeys("") {
+		e := s.keys[key]
+		record := make([]byte, e.size)
+		if _, err := s.file.ReadAt(record, e.offset); err != nil {
+			tmp.Close()
+			return fmt.Errorf("could not read kv record at offset %d: %v", e.offset, err)
+		}
+		if _, err := tmp.Write(record); err != nil {
+			tmp.Close()
+			return fmt.Errorf("could not write kv file: %v", err)
+		}
+		keys[key] = entry{offset: offset, size: e.size}
+		offset += e.size
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync kv file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not replace kv file: %v", err)
+	}
+
+	logger.Debugf("Compacted %s from %d to %d bytes", s.path, s.size, offset)
+	s.file.Close()
+	s.file, s.keys, s.size, s.live = tmp, keys, offset, offset
+	// Without it a crash could bring the old file back after new records went to the new one
+	return syncDir(filepath.Dir(s.path))
+}
+
+// Close closes the file
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// syncDir makes the rename of a file in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open kv directory: %v", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync kv directory: %v", err)
+	}
+	return nil
+}
+
+func encodeRecord(kind byte, key string, value []byte) []byte {
+	record := make([]byte, headerSize+len(key)+len(value))
+	record[4] = kind
+	binary.LittleEndian.PutUint32(record[5:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[9:], uint32(len(value)))
+	copy(record[headerSize:], key)
+	copy(record[headerSize+len(key):], value)
+	binary.LittleEndian.PutUint32(record[0:], crc32.Checksum(record[4:], crcTable))
+	return record
+}
+
+// readRecord reads the next record. It returns io.EOF at a clean end of the
+// file and errTorn if the record is incomplete or damaged.
+func readRecord(r io.Reader) (kind byte, key string, value []byte, size int64, err error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, "", nil, 0, io.EOF
+		}
+		return 0, "", nil, 0, errTorn
+	}
+	kind = header[4]
+	keyLen := binary.LittleEndian.Uint32(header[5:])
+	valueLen := binary.LittleEndian.Uint32(header[9:])
+	if (kind != recordPut && kind != recordDelete) || uint64(keyLen)+uint64(valueLen) > maxRecordSize {
+		return 0, "", nil, 0, errTorn
+	}
+	body := make([]byte, int(keyLen)+int(valueLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, "", nil, 0, errTorn
+	}
+	crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, body)
+	if crc != binary.LittleEndian.Uint32(header[0:]) {
+		return 0, "", nil, 0, errTorn
+	}
+	return kind, string(body[:keyLen]), body[keyLen:], int64(headerSize) + int64(len(body)), nil
+}
+
+// offsetReader reads a file sequentially from the start without moving its offset
+type offsetReader struct {
+	r      io.ReaderAt
+	offset int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.ReadAt(p, o.offset)
+	o.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,126 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStoreReopen checks that puts and deletes survive reopening
+func TestStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "store.kv")
+	s, err := Open(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put("run/1", []byte("queued")))
+	assert.NoError(t, s.Put("run/2", []byte("queued")))
+	assert.NoError(t, s.Put("run/1", []byte("completed")))
+	assert.NoError(t, s.Put("job/1", []byte("completed")))
+	assert.NoError(t, s.Delete("run/2"))
+	assert.NoError(t, s.Delete("run/3"))
+	assert.NoError(t, s.Close())
+
+	s, err = Open(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	value, ok, err := s.Get("run/1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "completed", string(value))
+	_, ok, _ = s.Get("run/2")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"run/1"}, s.Keys("run/"))
+
+	var scanned []string
+	assert.NoError(t, s.Scan("", func(key string, value []byte) bool {
+		scanned = append(scanned, key+"="+string(value))
+		return true
+	}))
+	assert.Equal(t, []string{"job/1=completed", "run/1=completed"}, scanned)
+}
+
+// TestStoreTornTail checks that a half-written last record is cut off
+func TestStoreTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.kv")
+	s, err := Open(path)
+	assert.NoError(t, err)
+	s.Put("a", []byte("1"))
+	s.Put("b", []byte("2"))
+	s.Close()
+
+	info, _ := os.Stat(path)
+	assert.NoError(t, os.Truncate(path, info.Size()-1))
+
+	s, err = Open(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, s.Keys(""))
+	assert.NoError(t, s.Put("c", []byte("3")))
+	s.Close()
+
+	s, err = Open(path)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, []string{"a", "c"}, s.Keys(""))
+}
+
+// TestStoreDamaged checks that a damaged record followed by others is reported instead of cutting them off,
+// and that zeros left after the last record by a crash are cut off
+func TestStoreDamaged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.kv")
+	s, err := Open(path)
+	assert.NoError(t, err)
+	s.Put("a", []byte("1"))
+	s.Put("b", []byte("2"))
+	s.Close()
+
+	// The value of the first record is flipped
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	data[headerSize+1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	_, err = Open(path)
+	assert.ErrorContains(t, err, "damaged at offset 0")
+	info, _ := os.Stat(path)
+	assert.Equal(t, int64(len(data)), info.Size(), "the file is left as it is")
+
+	data[headerSize+1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, append(data, make([]byte, 100)...), 0o644))
+	s, err = Open(path)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, []string{"a", "b"}, s.Keys(""))
+	total, _ := s.Size()
+	assert.Equal(t, int64(len(data)), total)
+}
+
+// TestStoreCompact checks that compaction drops old values and keeps the current ones
+func TestStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.kv")
+	s, err := Open(path)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		s.Put("key", []byte{byte('0' + i)})
+	}
+	s.Put("gone", []byte("x"))
+	s.Delete("gone")
+
+	total, live := s.Size()
+	assert.Greater(t, total, live)
+	assert.NoError(t, s.Compact())
+	total, live = s.Size()
+	assert.Equal(t, total, live)
+
+	value, _, _ := s.Get("key")
+	assert.Equal(t, "9", string(value))
+	assert.NoError(t, s.Put("other", []byte("y")))
+	s.Close()
+
+	s, err = Open(path)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, []string{"key", "other"}, s.Keys(""))
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, entries, 1, "temporary files must not be left behind")
+}
@@ -22,6 +22,11 @@ const (
 	FATAL
 )
 
+// loggers are usable before Init is called, e.g. from tests
+func init() {
+	Init()
+}
+
 // Init initializes the loggers and sets the log level
 func Init() {
 	debugLogger = log.New(os.Stdout, "DEBUG: ", log.Ldate|log.Ltime)
@@ -0,0 +1,138 @@
+// internal/metrics/histogram.go
+// cumulative histograms with a replaceable bucket layout
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Histogram is a histogram family that differs only by label values
+type Histogram struct {
+	Name       string
+	Help       string
+	LabelNames []string
+
+	mu      sync.Mutex
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // per-bucket (non-cumulative) counts, the last one is +Inf
+	sum         float64
+	count       uint64
+}
+
+// NewHistogram creates a histogram family with the given upper bounds
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{
+		Name:       name,
+		Help:       help,
+		LabelNames: labelNames,
+		buckets:    append([]float64(nil), buckets...),
+		series:     make(map[string]*histogramSeries),
+	}
+}
+
+// SetBuckets replaces the bucket layout. Observations made with
+// the previous layout are dropped, since they can't be re-bucketed.
+func (h *Histogram) SetBuckets(buckets []float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if equalBuckets(h.buckets, buckets) {
+		return
+	}
+	h.buckets = append([]float64(nil), buckets...)
+	h.series = make(map[string]*histogramSeries)
+}
+
+// Buckets returns the current bucket layout
+func (h *Histogram) Buckets() []float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]float64(nil), h.buckets...)
+}
+
+// Observe adds a single observation to the series with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.LabelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", h.Name, len(h.LabelNames), len(labelValues)))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := seriesKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)+1),
+		}
+		h.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+// Count returns the number of observations of the series with the given label values
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.series[seriesKey(labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+// Collect writes the _bucket, _sum and _count samples of every series
+func (h *Histogram) Collect(w *Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w.Header(h.Name, h.Help, TypeHistogram)
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string(nil), h.LabelNames...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		values := append(append([]string(nil), s.labelValues...), "")
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			values[len(values)-1] = formatFloat(bound)
+			w.Sample(h.Name+"_bucket", bucketLabels, values, float64(cumulative))
+		}
+		values[len(values)-1] = formatFloat(math.Inf(1))
+		w.Sample(h.Name+"_bucket", bucketLabels, values, float64(s.count))
+		w.Sample(h.Name+"_sum", h.LabelNames, s.labelValues, s.sum)
+		w.Sample(h.Name+"_count", h.LabelNames, s.labelValues, float64(s.count))
+	}
+}
+
+func equalBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,283 @@
+// internal/metrics/metrics.go
+// minimal Prometheus text exposition primitives
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric types of the Prometheus text exposition format
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+
+	// ContentType is the content type of the text exposition format
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Collector is implemented by everything that can write metric families
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// Writer formats metric families in the Prometheus text exposition format
+type Writer struct {
+	buf bytes.Buffer
+}
+
+// NewWriter creates an empty Writer
+func NewWriter() *Writer {
+	return &Writer{}
+}
+
+// Header writes the HELP and TYPE lines of a metric family
+func (w *Writer) Header(name, help, typ string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n", name, escapeHelp(help))
+	fmt.Fprintf(&w.buf, "# TYPE %s %s\n", name, typ)
+}
+
+// Sample writes a single sample line
+func (w *Writer) Sample(name string, labelNames, labelValues []string, value float64) {
+	w.buf.WriteString(name)
+	writeLabels(&w.buf, labelNames, labelValues)
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatFloat(value))
+	w.buf.WriteByte('\n')
+}
+
+// SampleAt writes a single sample line with an explicit timestamp
+func (w *Writer) SampleAt(name string, labelNames, labelValues []string, value float64, ts time.Time) {
+	w.buf.WriteString(name)
+	writeLabels(&w.buf, labelNames, labelValues)
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatFloat(value))
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(strconv.FormatInt(ts.UnixMilli(), 10))
+	w.buf.WriteByte('\n')
+}
+
+// Bytes returns the formatted output
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// WriteTo writes the formatted output into out
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	n, err := out.Write(w.buf.Bytes())
+	return int64(n), err
+}
+
+// Family is a set of samples of one metric that differ only by label values
+type Family struct {
+	Name       string
+	Help       string
+	Type       string
+	LabelNames []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounter creates a counter family
+func NewCounter(name, help string, labelNames ...string) *Family {
+	return newFamily(name, help, TypeCounter, labelNames)
+}
+
+// NewGauge creates a gauge family
+func NewGauge(name, help string, labelNames ...string) *Family {
+	return newFamily(name, help, TypeGauge, labelNames)
+}
+
+func newFamily(name, help, typ string, labelNames []string) *Family {
+	return &Family{
+		Name:       name,
+		Help:       help,
+		Type:       typ,
+		LabelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+}
+
+// Inc increments the sample with the given label values by one
+func (f *Family) Inc(labelValues ...string) {
+	f.Add(1, labelValues...)
+}
+
+// Add adds v to the sample with the given label values
+func (f *Family) Add(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.get(labelValues).value += v
+}
+
+// Set sets the sample with the given label values to v
+func (f *Family) Set(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.get(labelValues).value = v
+}
+
+// Value returns the current value of the sample with the given label values
+func (f *Family) Value(labelValues ...string) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s, ok := f.series[seriesKey(labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// Reset removes all samples
+func (f *Family) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.series = make(map[string]*series)
+}
+
+// get returns the series for label values, creating it if needed. Caller holds f.mu.
+func (f *Family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.LabelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.Name, len(f.LabelNames), len(labelValues)))
+	}
+	key := seriesKey(labelValues)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Collect writes the family with its samples sorted by label values
+func (f *Family) Collect(w *Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header(f.Name, f.Help, f.Type)
+	for _, key := range sortedKeys(f.series) {
+		s := f.series[key]
+		w.Sample(f.Name, f.LabelNames, s.labelValues, s.value)
+	}
+}
+
+// GaugeFunc is a gauge without labels whose value is read on every scrape
+type GaugeFunc struct {
+	Name  string
+	Help  string
+	Value func() float64
+}
+
+// NewGaugeFunc creates a gauge reading its value from fn
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{Name: name, Help: help, Value: fn}
+}
+
+// Collect writes the current value
+func (g *GaugeFunc) Collect(w *Writer) {
+	w.Header(g.Name, g.Help, TypeGauge)
+	w.Sample(g.Name, nil, nil, g.Value())
+}
+
+// Registry holds long-living collectors, such as counters updated by the store
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// Default is the registry rendered by the /metrics handler
+var Default = &Registry{}
+
+// Register adds collectors to the default registry
+func Register(cs ...Collector) {
+	Default.Register(cs...)
+}
+
+// Register adds collectors to the registry
+func (r *Registry) Register(cs ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, cs...)
+}
+
+// Collect writes all registered collectors
+func (r *Registry) Collect(w *Writer) {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.Collect(w)
+	}
+}
+
+// seriesKey joins label values with a separator that can't appear in valid UTF-8
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys(m map[string]*series) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeLabels(buf *bytes.Buffer, names, values []string) {
+	if len(names) == 0 {
+		return
+	}
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(name)
+		buf.WriteString(`="`)
+		buf.WriteString(escapeLabelValue(values[i]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+}
+
+var (
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string { return labelValueReplacer.Replace(v) }
+func escapeHelp(v string) string       { return helpReplacer.Replace(v) }
+
+// formatFloat formats a sample value the way Prometheus expects it
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
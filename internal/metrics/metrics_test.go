@@ -0,0 +1,86 @@
+package metrics_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFamilyCollect checks the exposition format of counters and gauges
+func TestFamilyCollect(t *testing.T) {
+	counter := metrics.NewCounter("test_total", "Test counter.", "repository", "status")
+	counter.Inc("org/b", "completed")
+	counter.Add(2, "org/a", "queued")
+	counter.Inc("org/a", "queued")
+
+	w := metrics.NewWriter()
+	counter.Collect(w)
+
+	assert.Equal(t,
+		"# HELP test_total Test counter.\n"+
+			"# TYPE test_total counter\n"+
+			`test_total{repository="org/a",status="queued"} 3`+"\n"+
+			`test_total{repository="org/b",status="completed"} 1`+"\n",
+		string(w.Bytes()))
+	assert.Equal(t, float64(3), counter.Value("org/a", "queued"))
+}
+
+// TestLabelEscaping checks that label values and help are escaped
+func TestLabelEscaping(t *testing.T) {
+	gauge := metrics.NewGauge("test_gauge", "Line one\nline two.", "branch")
+	gauge.Set(math.Inf(1), "feature/\"quoted\"\\path\n")
+
+	w := metrics.NewWriter()
+	gauge.Collect(w)
+
+	assert.Equal(t,
+		"# HELP test_gauge Line one\\nline two.\n"+
+			"# TYPE test_gauge gauge\n"+
+			`test_gauge{branch="feature/\"quoted\"\\path\n"} +Inf`+"\n",
+		string(w.Bytes()))
+}
+
+// TestRegistry checks that all registered collectors are rendered
+func TestRegistry(t *testing.T) {
+	registry := &metrics.Registry{}
+	first := metrics.NewGauge("first", "First.")
+	second := metrics.NewGauge("second", "Second.")
+	first.Set(1)
+	second.Set(2)
+	registry.Register(first, second)
+
+	w := metrics.NewWriter()
+	registry.Collect(w)
+
+	assert.Contains(t, string(w.Bytes()), "first 1\n")
+	assert.Contains(t, string(w.Bytes()), "second 2\n")
+}
+
+// TestHistogram checks cumulative buckets, sum and count
+func TestHistogram(t *testing.T) {
+	h := metrics.NewHistogram("test_seconds", "Test histogram.", []float64{1, 10}, "repository")
+	h.Observe(0.5, "org/a")
+	h.Observe(1, "org/a")
+	h.Observe(5, "org/a")
+	h.Observe(100, "org/a")
+
+	w := metrics.NewWriter()
+	h.Collect(w)
+
+	assert.Equal(t,
+		"# HELP test_seconds Test histogram.\n"+
+			"# TYPE test_seconds histogram\n"+
+			`test_seconds_bucket{repository="org/a",le="1"} 2`+"\n"+
+			`test_seconds_bucket{repository="org/a",le="10"} 3`+"\n"+
+			`test_seconds_bucket{repository="org/a",le="+Inf"} 4`+"\n"+
+			`test_seconds_sum{repository="org/a"} 106.5`+"\n"+
+			`test_seconds_count{repository="org/a"} 4`+"\n",
+		string(w.Bytes()))
+
+	// Changing the layout drops observations made with the old one
+	h.SetBuckets([]float64{60})
+	assert.Equal(t, []float64{60}, h.Buckets())
+	assert.Equal(t, uint64(0), h.Count("org/a"))
+}
@@ -0,0 +1,517 @@
+package models
+
+import "time"
+
+// Аксессоры в стиле go-github: возвращают нулевое значение, если поле или сам объект nil
+
+// GetID returns the ID field if it's non-nil, zero value otherwise.
+func (s *Step) GetID() int64 {
+	if s == nil || s.ID == nil {
+		return 0
+	}
+	return *s.ID
+}
+
+// GetName returns the Name field if it's non-nil, zero value otherwise.
+func (s *Step) GetName() string {
+	if s == nil || s.Name == nil {
+		return ""
+	}
+	return *s.Name
+}
+
+// GetStatus returns the Status field if it's non-nil, zero value otherwise.
+func (s *Step) GetStatus() string {
+	if s == nil || s.Status == nil {
+		return ""
+	}
+	return *s.Status
+}
+
+// GetConclusion returns the Conclusion field if it's non-nil, zero value otherwise.
+func (s *Step) GetConclusion() string {
+	if s == nil || s.Conclusion == nil {
+		return ""
+	}
+	return *s.Conclusion
+}
+
+// GetNumber returns the Number field if it's non-nil, zero value otherwise.
+func (s *Step) GetNumber() int64 {
+	if s == nil || s.Number == nil {
+		return 0
+	}
+	return *s.Number
+}
+
+// GetStartedAt returns the StartedAt field if it's non-nil, zero value otherwise.
+func (s *Step) GetStartedAt() time.Time {
+	if s == nil || s.StartedAt == nil {
+		return time.Time{}
+	}
+	return *s.StartedAt
+}
+
+// GetCompletedAt returns the CompletedAt field if it's non-nil, zero value otherwise.
+func (s *Step) GetCompletedAt() time.Time {
+	if s == nil || s.CompletedAt == nil {
+		return time.Time{}
+	}
+	return *s.CompletedAt
+}
+
+// GetID returns the ID field if it's non-nil, zero value otherwise.
+func (j *Job) GetID() int64 {
+	if j == nil || j.ID == nil {
+		return 0
+	}
+	return *j.ID
+}
+
+// GetRunID returns the RunID field if it's non-nil, zero value otherwise.
+func (j *Job) GetRunID() int64 {
+	if j == nil || j.RunID == nil {
+		return 0
+	}
+	return *j.RunID
+}
+
+// GetRepositoryID returns the RepositoryID field if it's non-nil, zero value otherwise.
+func (j *Job) GetRepositoryID() int64 {
+	if j == nil || j.RepositoryID == nil {
+		return 0
+	}
+	return *j.RepositoryID
+}
+
+// GetAttempt returns the Attempt field if it's non-nil, zero value otherwise.
+func (j *Job) GetAttempt() int64 {
+	if j == nil || j.Attempt == nil {
+		return 0
+	}
+	return *j.Attempt
+}
+
+// GetName returns the Name field if it's non-nil, zero value otherwise.
+func (j *Job) GetName() string {
+	if j == nil || j.Name == nil {
+		return ""
+	}
+	return *j.Name
+}
+
+// GetWorkflowName returns the WorkflowName field if it's non-nil, zero value otherwise.
+func (j *Job) GetWorkflowName() string {
+	if j == nil || j.WorkflowName == nil {
+		return ""
+	}
+	return *j.WorkflowName
+}
+
+// GetHeadBranch returns the HeadBranch field if it's non-nil, zero value otherwise.
+func (j *Job) GetHeadBranch() string {
+	if j == nil || j.HeadBranch == nil {
+		return ""
+	}
+	return *j.HeadBranch
+}
+
+// GetHeadSHA returns the HeadSHA field if it's non-nil, zero value otherwise.
+func (j *Job) GetHeadSHA() string {
+	if j == nil || j.HeadSHA == nil {
+		return ""
+	}
+	return *j.HeadSHA
+}
+
+// GetStatus returns the Status field if it's non-nil, zero value otherwise.
+func (j *Job) GetStatus() string {
+	if j == nil || j.Status == nil {
+		return ""
+	}
+	return *j.Status
+}
+
+// GetConclusion returns the Conclusion field if it's non-nil, zero value otherwise.
+func (j *Job) GetConclusion() string {
+	if j == nil || j.Conclusion == nil {
+		return ""
+	}
+	return *j.Conclusion
+}
+
+// GetCreatedAt returns the CreatedAt field if it's non-nil, zero value otherwise.
+func (j *Job) GetCreatedAt() time.Time {
+	if j == nil || j.CreatedAt == nil {
+		return time.Time{}
+	}
+	return *j.CreatedAt
+}
+
+// GetStartedAt returns the StartedAt field if it's non-nil, zero value otherwise.
+func (j *Job) GetStartedAt() time.Time {
+	if j == nil || j.StartedAt == nil {
+		return time.Time{}
+	}
+	return *j.StartedAt
+}
+
+// GetCompletedAt returns the CompletedAt field if it's non-nil, zero value otherwise.
+func (j *Job) GetCompletedAt() time.Time {
+	if j == nil || j.CompletedAt == nil {
+		return time.Time{}
+	}
+	return *j.CompletedAt
+}
+
+// GetRunnerID returns the RunnerID field if it's non-nil, zero value otherwise.
+func (j *Job) GetRunnerID() int64 {
+	if j == nil || j.RunnerID == nil {
+		return 0
+	}
+	return *j.RunnerID
+}
+
+// GetRunnerName returns the RunnerName field if it's non-nil, zero value otherwise.
+func (j *Job) GetRunnerName() string {
+	if j == nil || j.RunnerName == nil {
+		return ""
+	}
+	return *j.RunnerName
+}
+
+// GetRunnerOS returns the RunnerOS field if it's non-nil, zero value otherwise.
+func (j *Job) GetRunnerOS() string {
+	if j == nil || j.RunnerOS == nil {
+		return ""
+	}
+	return *j.RunnerOS
+}
+
+// GetRunnerGroupID returns the RunnerGroupID field if it's non-nil, zero value otherwise.
+func (j *Job) GetRunnerGroupID() int64 {
+	if j == nil || j.RunnerGroupID == nil {
+		return 0
+	}
+	return *j.RunnerGroupID
+}
+
+// GetRunnerGroupName returns the RunnerGroupName field if it's non-nil, zero value otherwise.
+func (j *Job) GetRunnerGroupName() string {
+	if j == nil || j.RunnerGroupName == nil {
+		return ""
+	}
+	return *j.RunnerGroupName
+}
+
+// GetRunID returns the RunID field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetRunID() int64 {
+	if w == nil || w.RunID == nil {
+		return 0
+	}
+	return *w.RunID
+}
+
+// GetRepositoryID returns the RepositoryID field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetRepositoryID() int64 {
+	if w == nil || w.RepositoryID == nil {
+		return 0
+	}
+	return *w.RepositoryID
+}
+
+// GetWorkflowID returns the WorkflowID field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetWorkflowID() int64 {
+	if w == nil || w.WorkflowID == nil {
+		return 0
+	}
+	return *w.WorkflowID
+}
+
+// GetName returns the Name field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetName() string {
+	if w == nil || w.Name == nil {
+		return ""
+	}
+	return *w.Name
+}
+
+// GetRunNumber returns the RunNumber field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetRunNumber() int64 {
+	if w == nil || w.RunNumber == nil {
+		return 0
+	}
+	return *w.RunNumber
+}
+
+// GetAttempt returns the Attempt field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetAttempt() int64 {
+	if w == nil || w.Attempt == nil {
+		return 0
+	}
+	return *w.Attempt
+}
+
+// GetEvent returns the Event field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetEvent() string {
+	if w == nil || w.Event == nil {
+		return ""
+	}
+	return *w.Event
+}
+
+// GetHeadBranch returns the HeadBranch field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetHeadBranch() string {
+	if w == nil || w.HeadBranch == nil {
+		return ""
+	}
+	return *w.HeadBranch
+}
+
+// GetHeadSHA returns the HeadSHA field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetHeadSHA() string {
+	if w == nil || w.HeadSHA == nil {
+		return ""
+	}
+	return *w.HeadSHA
+}
+
+// GetStatus returns the Status field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetStatus() string {
+	if w == nil || w.Status == nil {
+		return ""
+	}
+	return *w.Status
+}
+
+// GetConclusion returns the Conclusion field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetConclusion() string {
+	if w == nil || w.Conclusion == nil {
+		return ""
+	}
+	return *w.Conclusion
+}
+
+// GetCreatedAt returns the CreatedAt field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetCreatedAt() time.Time {
+	if w == nil || w.CreatedAt == nil {
+		return time.Time{}
+	}
+	return *w.CreatedAt
+}
+
+// GetRunStartedAt returns the RunStartedAt field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetRunStartedAt() time.Time {
+	if w == nil || w.RunStartedAt == nil {
+		return time.Time{}
+	}
+	return *w.RunStartedAt
+}
+
+// GetUpdatedAt returns the UpdatedAt field if it's non-nil, zero value otherwise.
+func (w *WorkflowRun) GetUpdatedAt() time.Time {
+	if w == nil || w.UpdatedAt == nil {
+		return time.Time{}
+	}
+	return *w.UpdatedAt
+}
+
+// GetID returns the ID field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetID() int64 {
+	if w == nil || w.ID == nil {
+		return 0
+	}
+	return *w.ID
+}
+
+// GetRepositoryID returns the RepositoryID field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetRepositoryID() int64 {
+	if w == nil || w.RepositoryID == nil {
+		return 0
+	}
+	return *w.RepositoryID
+}
+
+// GetName returns the Name field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetName() string {
+	if w == nil || w.Name == nil {
+		return ""
+	}
+	return *w.Name
+}
+
+// GetPath returns the Path field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetPath() string {
+	if w == nil || w.Path == nil {
+		return ""
+	}
+	return *w.Path
+}
+
+// GetState returns the State field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetState() string {
+	if w == nil || w.State == nil {
+		return ""
+	}
+	return *w.State
+}
+
+// GetCreatedAt returns the CreatedAt field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetCreatedAt() time.Time {
+	if w == nil || w.CreatedAt == nil {
+		return time.Time{}
+	}
+	return *w.CreatedAt
+}
+
+// GetUpdatedAt returns the UpdatedAt field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetUpdatedAt() time.Time {
+	if w == nil || w.UpdatedAt == nil {
+		return time.Time{}
+	}
+	return *w.UpdatedAt
+}
+
+// GetURL returns the URL field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetURL() string {
+	if w == nil || w.URL == nil {
+		return ""
+	}
+	return *w.URL
+}
+
+// GetHTMLURL returns the HTMLURL field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetHTMLURL() string {
+	if w == nil || w.HTMLURL == nil {
+		return ""
+	}
+	return *w.HTMLURL
+}
+
+// GetBadgeURL returns the BadgeURL field if it's non-nil, zero value otherwise.
+func (w *Workflow) GetBadgeURL() string {
+	if w == nil || w.BadgeURL == nil {
+		return ""
+	}
+	return *w.BadgeURL
+}
+
+// GetID returns the ID field if it's non-nil, zero value otherwise.
+func (r *Repository) GetID() int64 {
+	if r == nil || r.ID == nil {
+		return 0
+	}
+	return *r.ID
+}
+
+// GetName returns the Name field if it's non-nil, zero value otherwise.
+func (r *Repository) GetName() string {
+	if r == nil || r.Name == nil {
+		return ""
+	}
+	return *r.Name
+}
+
+// GetFullName returns the FullName field if it's non-nil, zero value otherwise.
+func (r *Repository) GetFullName() string {
+	if r == nil || r.FullName == nil {
+		return ""
+	}
+	return *r.FullName
+}
+
+// GetOwnerID returns the OwnerID field if it's non-nil, zero value otherwise.
+func (r *Repository) GetOwnerID() int64 {
+	if r == nil || r.OwnerID == nil {
+		return 0
+	}
+	return *r.OwnerID
+}
+
+// GetOwnerLogin returns the OwnerLogin field if it's non-nil, zero value otherwise.
+func (r *Repository) GetOwnerLogin() string {
+	if r == nil || r.OwnerLogin == nil {
+		return ""
+	}
+	return *r.OwnerLogin
+}
+
+// GetOwnerType returns the OwnerType field if it's non-nil, zero value otherwise.
+func (r *Repository) GetOwnerType() string {
+	if r == nil || r.OwnerType == nil {
+		return ""
+	}
+	return *r.OwnerType
+}
+
+// GetPrivate returns the Private field if it's non-nil, zero value otherwise.
+func (r *Repository) GetPrivate() bool {
+	if r == nil || r.Private == nil {
+		return false
+	}
+	return *r.Private
+}
+
+// GetHTMLURL returns the HTMLURL field if it's non-nil, zero value otherwise.
+func (r *Repository) GetHTMLURL() string {
+	if r == nil || r.HTMLURL == nil {
+		return ""
+	}
+	return *r.HTMLURL
+}
+
+// GetDescription returns the Description field if it's non-nil, zero value otherwise.
+func (r *Repository) GetDescription() string {
+	if r == nil || r.Description == nil {
+		return ""
+	}
+	return *r.Description
+}
+
+// GetFork returns the Fork field if it's non-nil, zero value otherwise.
+func (r *Repository) GetFork() bool {
+	if r == nil || r.Fork == nil {
+		return false
+	}
+	return *r.Fork
+}
+
+// GetURL returns the URL field if it's non-nil, zero value otherwise.
+func (r *Repository) GetURL() string {
+	if r == nil || r.URL == nil {
+		return ""
+	}
+	return *r.URL
+}
+
+// GetSteps returns the Steps map, nil if the job is nil.
+func (j *Job) GetSteps() map[int64]*Step {
+	if j == nil {
+		return nil
+	}
+	return j.Steps
+}
+
+// GetJobs returns the Jobs map, nil if the run is nil.
+func (w *WorkflowRun) GetJobs() map[int64]*Job {
+	if w == nil {
+		return nil
+	}
+	return w.Jobs
+}
+
+// GetRuns returns the Runs map, nil if the workflow is nil.
+func (w *Workflow) GetRuns() map[int64]*WorkflowRun {
+	if w == nil {
+		return nil
+	}
+	return w.Runs
+}
+
+// GetWorkflows returns the Workflows map, nil if the repository is nil.
+func (r *Repository) GetWorkflows() map[int64]*Workflow {
+	if r == nil {
+		return nil
+	}
+	return r.Workflows
+}
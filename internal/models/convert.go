@@ -0,0 +1,181 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/go-github/v66/github"
+)
+
+// Конвертеры из типов go-github. Вебхуки и REST API GitHub отдают одни и те же
+// объекты, поэтому конвертеры общие. Дочерние объекты (джобы запуска, запуски
+// воркфлоу) не заполняются, связи между объектами строит хранилище по ID.
+// Все конвертеры возвращают nil для nil.
+
+// NewOrganization конвертирует организацию
+func NewOrganization(org *github.Organization) *Organization {
+	if org == nil {
+		return nil
+	}
+	return &Organization{
+		ID:          org.ID,
+		Login:       org.Login,
+		Name:        org.Name,
+		URL:         org.URL,
+		HTMLURL:     org.HTMLURL,
+		Description: org.Description,
+	}
+}
+
+// NewUser конвертирует пользователя
+func NewUser(user *github.User) *User {
+	if user == nil {
+		return nil
+	}
+	return &User{
+		ID:    user.ID,
+		Login: user.Login,
+		Name:  user.Name,
+		Email: user.Email,
+	}
+}
+
+// NewRepository конвертирует репозиторий, владелец сохраняется ссылкой по ID
+func NewRepository(repo *github.Repository) *Repository {
+	if repo == nil {
+		return nil
+	}
+	result := &Repository{
+		ID:          repo.ID,
+		Name:        repo.Name,
+		FullName:    repo.FullName,
+		Private:     repo.Private,
+		HTMLURL:     repo.HTMLURL,
+		Description: repo.Description,
+		Fork:        repo.Fork,
+		URL:         repo.URL,
+	}
+	if owner := repo.Owner; owner != nil {
+		result.OwnerID = owner.ID
+		result.OwnerLogin = owner.Login
+		result.OwnerType = owner.Type
+	}
+	return result
+}
+
+// NewWorkflow конвертирует воркфлоу репозитория repoID
+func NewWorkflow(workflow *github.Workflow, repoID int64) *Workflow {
+	if workflow == nil {
+		return nil
+	}
+	return &Workflow{
+		ID:           workflow.ID,
+		RepositoryID: github.Int64(repoID),
+		Name:         workflow.Name,
+		Path:         workflow.Path,
+		State:        workflow.State,
+		CreatedAt:    timeOf(workflow.CreatedAt),
+		UpdatedAt:    timeOf(workflow.UpdatedAt),
+		URL:          workflow.URL,
+		HTMLURL:      workflow.HTMLURL,
+		BadgeURL:     workflow.BadgeURL,
+	}
+}
+
+// NewWorkflowRun конвертирует запуск воркфлоу
+func NewWorkflowRun(run *github.WorkflowRun) *WorkflowRun {
+	if run == nil {
+		return nil
+	}
+	triggeredBy := run.TriggeringActor
+	if triggeredBy == nil {
+		triggeredBy = run.Actor
+	}
+	result := &WorkflowRun{
+		RunID:        run.ID,
+		WorkflowID:   run.WorkflowID,
+		Name:         run.Name,
+		RunNumber:    int64Of(run.RunNumber),
+		Attempt:      int64Of(run.RunAttempt),
+		Event:        run.Event,
+		HeadBranch:   run.HeadBranch,
+		HeadSHA:      run.HeadSHA,
+		Status:       run.Status,
+		Conclusion:   run.Conclusion,
+		CreatedAt:    timeOf(run.CreatedAt),
+		RunStartedAt: timeOf(run.RunStartedAt),
+		UpdatedAt:    timeOf(run.UpdatedAt),
+		TriggeredBy:  NewUser(triggeredBy),
+	}
+	if run.Repository != nil {
+		result.RepositoryID = run.Repository.ID
+	}
+	return result
+}
+
+// NewJob конвертирует джоб запуска из репозитория repoID. Джобы из REST API
+// не содержат репозиторий, поэтому он передаётся отдельно.
+func NewJob(job *github.WorkflowJob, repoID int64) *Job {
+	if job == nil {
+		return nil
+	}
+	result := &Job{
+		ID:              job.ID,
+		RunID:           job.RunID,
+		Attempt:         job.RunAttempt,
+		Name:            job.Name,
+		WorkflowName:    job.WorkflowName,
+		HeadBranch:      job.HeadBranch,
+		HeadSHA:         job.HeadSHA,
+		Status:          job.Status,
+		Conclusion:      job.Conclusion,
+		CreatedAt:       timeOf(job.CreatedAt),
+		StartedAt:       timeOf(job.StartedAt),
+		CompletedAt:     timeOf(job.CompletedAt),
+		RunnerID:        job.RunnerID,
+		RunnerName:      job.RunnerName,
+		RunnerGroupID:   job.RunnerGroupID,
+		RunnerGroupName: job.RunnerGroupName,
+		Labels:          job.Labels,
+	}
+	if repoID != 0 {
+		result.RepositoryID = github.Int64(repoID)
+	}
+	if len(job.Steps) > 0 {
+		result.Steps = make(map[int64]*Step, len(job.Steps))
+		for _, step := range job.Steps {
+			result.Steps[step.GetNumber()] = NewStep(step)
+		}
+	}
+	return result
+}
+
+// NewStep конвертирует шаг джоба
+func NewStep(step *github.TaskStep) *Step {
+	if step == nil {
+		return nil
+	}
+	return &Step{
+		Name:        step.Name,
+		Status:      step.Status,
+		Conclusion:  step.Conclusion,
+		Number:      step.Number,
+		StartedAt:   timeOf(step.StartedAt),
+		CompletedAt: timeOf(step.CompletedAt),
+	}
+}
+
+func timeOf(ts *github.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.Time
+	return &t
+}
+
+func int64Of(i *int) *int64 {
+	if i == nil {
+		return nil
+	}
+	v := int64(*i)
+	return &v
+}
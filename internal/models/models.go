@@ -18,9 +18,16 @@ type Step struct {
 // Job представляет задачу в рамках запуска воркфлоу
 type Job struct {
 	ID              *int64          `json:"id,omitempty"`
+	RunID           *int64          `json:"run_id,omitempty"`        // Запуск, к которому относится джоб
+	RepositoryID    *int64          `json:"repository_id,omitempty"` // Репозиторий запуска, известен раньше самого запуска
+	Attempt         *int64          `json:"attempt,omitempty"`       // Попытка запуска, в которой создан джоб
 	Name            *string         `json:"name,omitempty"`
+	WorkflowName    *string         `json:"workflow_name,omitempty"`
+	HeadBranch      *string         `json:"head_branch,omitempty"`
+	HeadSHA         *string         `json:"head_sha,omitempty"`
 	Status          *string         `json:"status,omitempty"`
 	Conclusion      *string         `json:"conclusion,omitempty"`
+	CreatedAt       *time.Time      `json:"created_at,omitempty"`
 	StartedAt       *time.Time      `json:"started_at,omitempty"`
 	CompletedAt     *time.Time      `json:"completed_at,omitempty"`
 	RunnerID        *int64          `json:"runner_id,omitempty"`
@@ -28,42 +35,52 @@ type Job struct {
 	RunnerOS        *string         `json:"runner_os,omitempty"`
 	RunnerGroupID   *int64          `json:"runner_group_id,omitempty"`
 	RunnerGroupName *string         `json:"runner_group_name,omitempty"`
-	Steps           map[int64]*Step `json:"steps,omitempty"` // Этапы внутри джоба
+	Labels          []string        `json:"labels,omitempty"` // Метки раннера из runs-on
+	Steps           map[int64]*Step `json:"steps,omitempty"`  // Этапы внутри джоба по номеру
 }
 
 // WorkflowRun представляет запуск воркфлоу с возможными перезапусками
 type WorkflowRun struct {
-	RunID       *int64         `json:"run_id,omitempty"`
-	WorkflowID  *int64         `json:"workflow_id,omitempty"`
-	RunNumber   *int64         `json:"run_number,omitempty"`
-	Attempt     *int64         `json:"attempt,omitempty"` // Счетчик попыток запуска (перезапусков)
-	Event       *string        `json:"event,omitempty"`
-	Status      *string        `json:"status,omitempty"`
-	Conclusion  *string        `json:"conclusion,omitempty"`
-	CreatedAt   *time.Time     `json:"created_at,omitempty"`
-	UpdatedAt   *time.Time     `json:"updated_at,omitempty"`
-	TriggeredBy *User          `json:"triggered_by,omitempty"` // Инициатор запуска или перезапуска
-	Jobs        map[int64]*Job `json:"jobs,omitempty"`         // Джобы внутри запуска
+	RunID        *int64         `json:"run_id,omitempty"`
+	RepositoryID *int64         `json:"repository_id,omitempty"`
+	WorkflowID   *int64         `json:"workflow_id,omitempty"`
+	Name         *string        `json:"name,omitempty"` // Имя воркфлоу на момент запуска
+	RunNumber    *int64         `json:"run_number,omitempty"`
+	Attempt      *int64         `json:"attempt,omitempty"` // Счетчик попыток запуска (перезапусков)
+	Event        *string        `json:"event,omitempty"`
+	HeadBranch   *string        `json:"head_branch,omitempty"`
+	HeadSHA      *string        `json:"head_sha,omitempty"`
+	Status       *string        `json:"status,omitempty"`
+	Conclusion   *string        `json:"conclusion,omitempty"`
+	CreatedAt    *time.Time     `json:"created_at,omitempty"`
+	RunStartedAt *time.Time     `json:"run_started_at,omitempty"` // Начало текущей попытки
+	UpdatedAt    *time.Time     `json:"updated_at,omitempty"`
+	TriggeredBy  *User          `json:"triggered_by,omitempty"` // Инициатор запуска или перезапуска
+	Jobs         map[int64]*Job `json:"jobs,omitempty"`         // Джобы внутри запуска, всех попыток
 }
 
 type Workflow struct {
-	ID        *int64                 `json:"id,omitempty"`
-	Name      *string                `json:"name,omitempty"`
-	Path      *string                `json:"path,omitempty"`
-	State     *string                `json:"state,omitempty"` // "active" или "disabled"
-	CreatedAt *time.Time             `json:"created_at,omitempty"`
-	UpdatedAt *time.Time             `json:"updated_at,omitempty"`
-	URL       *string                `json:"url,omitempty"`
-	HTMLURL   *string                `json:"html_url,omitempty"`
-	BadgeURL  *string                `json:"badge_url,omitempty"`
-	Runs      map[int64]*WorkflowRun `json:"runs,omitempty"` // Запуски воркфлоу
+	ID           *int64                 `json:"id,omitempty"`
+	RepositoryID *int64                 `json:"repository_id,omitempty"`
+	Name         *string                `json:"name,omitempty"`
+	Path         *string                `json:"path,omitempty"`
+	State        *string                `json:"state,omitempty"` // "active" или "disabled"
+	CreatedAt    *time.Time             `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time             `json:"updated_at,omitempty"`
+	URL          *string                `json:"url,omitempty"`
+	HTMLURL      *string                `json:"html_url,omitempty"`
+	BadgeURL     *string                `json:"badge_url,omitempty"`
+	Runs         map[int64]*WorkflowRun `json:"runs,omitempty"` // Запуски воркфлоу
 }
 
 type Repository struct {
 	ID          *int64              `json:"id,omitempty"`
 	Name        *string             `json:"name,omitempty"`
 	FullName    *string             `json:"full_name,omitempty"`
-	Owner       Owner               `json:"owner,omitempty"`
+	Owner       Owner               `json:"-"`                  // Владелец, заполняется хранилищем. Не сериализуется, иначе получится цикл
+	OwnerID     *int64              `json:"owner_id,omitempty"` // ID пользователя или организации-владельца
+	OwnerLogin  *string             `json:"owner_login,omitempty"`
+	OwnerType   *string             `json:"owner_type,omitempty"` // "Organization" или "User"
 	Private     *bool               `json:"private,omitempty"`
 	HTMLURL     *string             `json:"html_url,omitempty"`
 	Description *string             `json:"description,omitempty"`
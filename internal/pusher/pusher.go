@@ -0,0 +1,262 @@
+// internal/pusher/pusher.go
+// pushes finished runs, jobs and steps to VictoriaMetrics
+
+package pusher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+)
+
+const (
+	defMaxAttempts = 5
+	defBackoff     = time.Second
+	defMaxBackoff  = 30 * time.Second
+	defTimeout     = 30 * time.Second
+
+	// jsonImportPath is the VictoriaMetrics endpoint accepting JSON lines,
+	// any other URL gets the Prometheus text format
+	jsonImportPath = "/api/v1/import"
+)
+
+var (
+	pushRequests = metrics.NewCounter("ant_watcher_push_requests_total",
+		"Number of push requests to the metrics storage by result.", "result")
+	pushedRuns = metrics.NewCounter("ant_watcher_pushed_runs_total",
+		"Number of workflow runs confirmed by the metrics storage.")
+)
+
+func init() {
+	metrics.Register(pushRequests, pushedRuns)
+}
+
+// Pusher periodically sends samples of finished runs to Config.PushMetricsUrl
+type Pusher struct {
+	Config      *config.Config
+	Store       store.Backend
+	Client      *http.Client
+	MaxAttempts int           // Attempts per push before giving up until the next interval
+	Backoff     time.Duration // Delay before the first retry, doubled on every next one
+	MaxBackoff  time.Duration
+}
+
+// NewPusher инициализирует пушер метрик
+func NewPusher(cfg *config.Config, s store.Backend) *Pusher {
+	return &Pusher{
+		Config:      cfg,
+		Store:       s,
+		Client:      &http.Client{Timeout: defTimeout},
+		MaxAttempts: defMaxAttempts,
+		Backoff:     defBackoff,
+		MaxBackoff:  defMaxBackoff,
+	}
+}
+
+// Run pushes finished runs every PushInterval until ctx is cancelled.
+// URL and interval are read once on every iteration, so they follow config reloads.
+func (p *Pusher) Run(ctx context.Context) {
+	_, interval := p.Config.PushTarget()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		var target string
+		target, interval = p.Config.PushTarget()
+		if target == "" {
+			continue
+		}
+		if err := p.push(ctx, target); err != nil {
+			logger.Errorf("Failed to push metrics: %v", err)
+		}
+	}
+}
+
+// Push sends all finished and not yet pushed runs and marks them as pushed on success
+func (p *Pusher) Push(ctx context.Context) error {
+	target, _ := p.Config.PushTarget()
+	return p.push(ctx, target)
+}
+
+// push sends all finished and not yet pushed runs to target
+func (p *Pusher) push(ctx context.Context, target string) error {
+	runs := p.Store.UnpushedRuns()
+	if len(runs) == 0 {
+		return nil
+	}
+
+	samples := make([]sample, 0, len(runs))
+	runIDs := make([]int64, 0, len(runs))
+	for _, rs := range runs {
+		samples = append(samples, runSamples(rs)...)
+		runIDs = append(runIDs, rs.Run.GetRunID())
+	}
+
+	body, contentType := encode(target, samples)
+	if err := p.send(ctx, target, body, contentType); err != nil {
+		return err
+	}
+
+	p.Store.MarkPushed(runIDs...)
+	pushedRuns.Add(float64(len(runIDs)))
+	logger.Infof("Pushed %d samples of %d workflow runs to %s", len(samples), len(runIDs), target)
+	return nil
+}
+
+// send posts the body, retrying failed attempts with exponential backoff
+func (p *Pusher) send(ctx context.Context, target string, body []byte, contentType string) error {
+	backoff := p.Backoff
+	var err error
+	for attempt := 1; attempt <= p.MaxAttempts; attempt++ {
+		if err = p.post(ctx, target, body, contentType); err == nil {
+			pushRequests.Inc("success")
+			return nil
+		}
+		pushRequests.Inc("error")
+		logger.Warningf("Push attempt %d/%d failed: %v", attempt, p.MaxAttempts, err)
+
+		if attempt == p.MaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %v", p.MaxAttempts, err)
+}
+
+func (p *Pusher) post(ctx context.Context, target string, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// sample is a single value with the GitHub timestamp it belongs to
+type sample struct {
+	name        string
+	labelNames  []string
+	labelValues []string
+	value       float64
+	timestamp   time.Time
+}
+
+// The labels are the bounded ones of /metrics plus the conclusion and the job and step names.
+// IDs of runs, jobs and steps and runner names are left out, each of them would start a
+// new series in the push target for every run.
+var (
+	runLabelNames  = []string{"repository", "workflow", "branch", "event", "conclusion"}
+	jobLabelNames  = append(append([]string(nil), runLabelNames...), "job")
+	stepLabelNames = append(append([]string(nil), jobLabelNames...), "step")
+)
+
+// runSamples converts a finished run with its jobs and steps into samples. Every sample
+// has the GitHub timestamp it belongs to, so VictoriaMetrics deduplicates samples pushed twice.
+func runSamples(rs store.RunSnapshot) []sample {
+	run := rs.Run
+	runValues := []string{rs.Repository.GetFullName(), run.GetName(), run.GetHeadBranch(), run.GetEvent(), run.GetConclusion()}
+
+	var samples []sample
+	startedAt := run.RunStartedAt
+	if startedAt == nil {
+		startedAt = run.CreatedAt
+	}
+	if d, ok := store.Elapsed(startedAt, run.UpdatedAt); ok {
+		samples = append(samples, sample{"ant_watcher_run_duration_seconds", runLabelNames, runValues, d, *run.UpdatedAt})
+	}
+
+	for _, job := range rs.Jobs {
+		jobValues := append(append([]string(nil), runValues...), job.GetName())
+		jobValues[4] = job.GetConclusion()
+
+		if d, ok := store.Elapsed(job.CreatedAt, job.StartedAt); ok {
+			samples = append(samples, sample{"ant_watcher_job_queue_seconds", jobLabelNames, jobValues, d, *job.StartedAt})
+		}
+		if d, ok := store.Elapsed(job.StartedAt, job.CompletedAt); ok {
+			samples = append(samples, sample{"ant_watcher_job_duration_seconds", jobLabelNames, jobValues, d, *job.CompletedAt})
+		}
+
+		for _, step := range store.SortedSteps(job) {
+			stepValues := append(append([]string(nil), jobValues...), step.GetName())
+			stepValues[4] = step.GetConclusion()
+
+			if d, ok := store.Elapsed(step.StartedAt, step.CompletedAt); ok {
+				samples = append(samples, sample{"ant_watcher_step_duration_seconds", stepLabelNames, stepValues, d, *step.CompletedAt})
+			}
+		}
+	}
+	return samples
+}
+
+// encode chooses the import format by the target URL
+func encode(target string, samples []sample) ([]byte, string) {
+	if u, err := url.Parse(target); err == nil && strings.TrimSuffix(u.Path, "/") == jsonImportPath {
+		return encodeJSONLines(samples), "application/stream+json"
+	}
+	return encodeText(samples), metrics.ContentType
+}
+
+// encodeText formats samples in the Prometheus text format with millisecond timestamps
+func encodeText(samples []sample) []byte {
+	w := metrics.NewWriter()
+	for _, s := range samples {
+		w.SampleAt(s.name, s.labelNames, s.labelValues, s.value, s.timestamp)
+	}
+	return w.Bytes()
+}
+
+// jsonLine is one line of the VictoriaMetrics /api/v1/import format
+type jsonLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+func encodeJSONLines(samples []sample) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range samples {
+		line := jsonLine{
+			Metric:     map[string]string{"__name__": s.name},
+			Values:     []float64{s.value},
+			Timestamps: []int64{s.timestamp.UnixMilli()},
+		}
+		for i, name := range s.labelNames {
+			line.Metric[name] = s.labelValues[i]
+		}
+		enc.Encode(line) // encoding of plain maps and slices can't fail
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,137 @@
+package pusher
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/Melsoft-Games/ant-watcher/internal/store"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func at(d time.Duration) *github.Timestamp { return &github.Timestamp{Time: start.Add(d)} }
+
+// newTestStore returns a store with one finished and one running workflow run
+func newTestStore() *store.Store {
+	s := store.NewStore()
+	repo := &github.Repository{ID: github.Int64(5), FullName: github.String("org/repo")}
+	s.AddOrUpdateRepository(5, models.NewRepository(repo))
+	s.AddOrUpdateWorkflowRun(1, models.NewWorkflowRun(&github.WorkflowRun{
+		ID: github.Int64(1), Name: github.String("CI"), HeadBranch: github.String("main"), Event: github.String("push"),
+		RunAttempt: github.Int(1), Status: github.String("completed"), Conclusion: github.String("success"),
+		CreatedAt: at(0), RunStartedAt: at(0), UpdatedAt: at(10 * time.Minute), Repository: repo,
+	}))
+	s.AddOrUpdateJob(11, models.NewJob(&github.WorkflowJob{
+		ID: github.Int64(11), RunID: github.Int64(1), Name: github.String("build"), RunnerName: github.String("runner-1"),
+		Status: github.String("completed"), Conclusion: github.String("success"),
+		CreatedAt: at(0), StartedAt: at(time.Minute), CompletedAt: at(9 * time.Minute),
+		Steps: []*github.TaskStep{{
+			Name: github.String("checkout"), Number: github.Int64(1), Status: github.String("completed"),
+			Conclusion: github.String("success"), StartedAt: at(time.Minute), CompletedAt: at(2 * time.Minute),
+		}},
+	}, 5))
+	s.AddOrUpdateWorkflowRun(2, models.NewWorkflowRun(&github.WorkflowRun{
+		ID: github.Int64(2), Status: github.String("in_progress"), Repository: repo,
+	}))
+	return s
+}
+
+func newTestPusher(s *store.Store, target string) *Pusher {
+	p := NewPusher(&config.Config{PushMetricsUrl: target}, s)
+	p.Backoff = time.Millisecond
+	p.MaxBackoff = time.Millisecond
+	return p
+}
+
+// TestPushText checks the Prometheus text format with GitHub timestamps
+func TestPushText(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s := newTestStore()
+	p := newTestPusher(s, srv.URL+"/api/v1/import/prometheus")
+	assert.NoError(t, p.Push(context.Background()))
+
+	assert.Contains(t, body,
+		`ant_watcher_run_duration_seconds{repository="org/repo",workflow="CI",branch="main",event="push",conclusion="success"} 600 `+
+			itoa(start.Add(10*time.Minute).UnixMilli()))
+	assert.Contains(t, body, `ant_watcher_job_queue_seconds{`)
+	assert.Contains(t, body, `conclusion="success",job="build"} 480 `+itoa(start.Add(9*time.Minute).UnixMilli()))
+	assert.Contains(t, body, `ant_watcher_step_duration_seconds{`)
+	assert.Contains(t, body, `job="build",step="checkout"} 60 `)
+	for _, label := range []string{"run_id", "run_attempt", "job_id", "runner_name", "step_number"} {
+		assert.NotContains(t, body, label+"=", "per-object labels grow the number of series without bound")
+	}
+
+	assert.True(t, s.IsPushed(1))
+	assert.False(t, s.IsPushed(2))
+
+	// Pushed runs are not sent again
+	body = ""
+	assert.NoError(t, p.Push(context.Background()))
+	assert.Equal(t, "", body)
+}
+
+// TestPushJSONLines checks the /api/v1/import format
+func TestPushJSONLines(t *testing.T) {
+	var body, contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body, contentType = string(data), r.Header.Get("Content-Type")
+	}))
+	defer srv.Close()
+
+	p := newTestPusher(newTestStore(), srv.URL+"/api/v1/import")
+	assert.NoError(t, p.Push(context.Background()))
+
+	assert.Equal(t, "application/stream+json", contentType)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	assert.Len(t, lines, 4)
+	assert.Contains(t, body, `"__name__":"ant_watcher_run_duration_seconds"`)
+	assert.Contains(t, body, `"timestamps":[`+itoa(start.Add(10*time.Minute).UnixMilli())+`]`)
+}
+
+// TestPushRetry checks that failed pushes are retried and nothing is marked until confirmed
+func TestPushRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	s := newTestStore()
+	p := newTestPusher(s, srv.URL)
+	assert.NoError(t, p.Push(context.Background()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.True(t, s.IsPushed(1))
+
+	// Always failing target
+	s = newTestStore()
+	atomic.StoreInt32(&calls, -100)
+	p = newTestPusher(s, srv.URL)
+	p.MaxAttempts = 2
+	assert.Error(t, p.Push(context.Background()))
+	assert.False(t, s.IsPushed(1))
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
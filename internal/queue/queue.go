@@ -0,0 +1,115 @@
+// internal/queue/queue.go
+// bounded in-process queue served by a pool of workers
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrFull is returned by Enqueue when the queue has no free slots
+var ErrFull = errors.New("queue is full")
+
+// ErrClosed is returned by Enqueue after Close was called
+var ErrClosed = errors.New("queue is closed")
+
+// Queue passes items to a fixed pool of workers through a bounded buffer.
+// Enqueue never blocks: when the buffer is full the item is dropped,
+// so the caller can push back instead of piling up goroutines.
+type Queue[T any] struct {
+	items   chan T
+	process func(T)
+	workers int
+
+	mu      sync.RWMutex // guards closed against concurrent Enqueue and Close
+	closed  bool
+	wg      sync.WaitGroup
+	dropped atomic.Uint64
+}
+
+// New creates a queue of the given capacity, call Start to run the workers
+func New[T any](capacity, workers int, process func(T)) *Queue[T] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &Queue[T]{
+		items:   make(chan T, capacity),
+		process: process,
+		workers: workers,
+	}
+}
+
+// Start runs the workers
+func (q *Queue[T]) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for item := range q.items {
+				q.process(item)
+			}
+		}()
+	}
+}
+
+// Enqueue adds an item without blocking
+func (q *Queue[T]) Enqueue(item T) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	select {
+	case q.items <- item:
+		return nil
+	default:
+		q.dropped.Add(1)
+		return ErrFull
+	}
+}
+
+// Len returns the number of items waiting for a worker
+func (q *Queue[T]) Len() int {
+	return len(q.items)
+}
+
+// Cap returns the capacity of the queue
+func (q *Queue[T]) Cap() int {
+	return cap(q.items)
+}
+
+// Dropped returns the number of items rejected because the queue was full
+func (q *Queue[T]) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+// Close stops accepting items and waits until the workers drain the queue
+// or ctx is done
+func (q *Queue[T]) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,67 @@
+package queue_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestQueueProcessesAll checks that Close drains everything that was accepted
+func TestQueueProcessesAll(t *testing.T) {
+	var processed atomic.Int64
+	q := queue.New(100, 4, func(i int) { processed.Add(int64(i)) })
+	q.Start()
+
+	for i := 1; i <= 100; i++ {
+		assert.NoError(t, q.Enqueue(i))
+	}
+	assert.NoError(t, q.Close(context.Background()))
+	assert.Equal(t, int64(5050), processed.Load())
+
+	assert.ErrorIs(t, q.Enqueue(1), queue.ErrClosed)
+}
+
+// TestQueueFull checks that a full queue rejects items and counts them
+func TestQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(1)
+	var once sync.Once
+	q := queue.New(2, 1, func(int) {
+		once.Do(started.Done)
+		<-release
+	})
+	q.Start()
+
+	// The first item is taken by the only worker, two more fill the buffer
+	assert.NoError(t, q.Enqueue(1))
+	started.Wait()
+	assert.NoError(t, q.Enqueue(2))
+	assert.NoError(t, q.Enqueue(3))
+	assert.Equal(t, 2, q.Len())
+
+	assert.ErrorIs(t, q.Enqueue(4), queue.ErrFull)
+	assert.Equal(t, uint64(1), q.Dropped())
+
+	close(release)
+	assert.NoError(t, q.Close(context.Background()))
+	assert.Equal(t, 0, q.Len())
+}
+
+// TestQueueCloseTimeout checks that Close respects the context deadline
+func TestQueueCloseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	q := queue.New(1, 1, func(int) { <-release })
+	q.Start()
+	assert.NoError(t, q.Enqueue(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, q.Close(ctx), context.DeadlineExceeded)
+}
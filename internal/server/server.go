@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync"
 
 	"github.com/Melsoft-Games/ant-watcher/internal/config"
 	"github.com/Melsoft-Games/ant-watcher/internal/handlers"
@@ -10,15 +13,20 @@ import (
 
 // Server представляет HTTP серверы
 type Server struct {
-	Config     *config.Config
-	Store      *store.Store
-	WebhookMux *http.ServeMux
-	AdminMux   *http.ServeMux
-	MetricsMux *http.ServeMux
+	Config         *config.Config
+	Store          store.Backend
+	WebhookMux     *http.ServeMux
+	AdminMux       *http.ServeMux
+	MetricsMux     *http.ServeMux
+	WebhookHandler *handlers.WebhookHandler
+	AdminHandler   *handlers.AdminHandler
+
+	mu          sync.Mutex // servers are started from separate goroutines
+	httpServers []*http.Server
 }
 
 // NewServer initializes a new Server
-func NewServer(cfg *config.Config, s *store.Store) *Server {
+func NewServer(cfg *config.Config, s store.Backend) *Server {
 	// Мультиплексор для вебхуков
 	webhookMux := http.NewServeMux()
 	webhookHandler := handlers.NewWebhookHandler(s, cfg)
@@ -31,35 +39,59 @@ func NewServer(cfg *config.Config, s *store.Store) *Server {
 
 	// Мультиплексор для метрик
 	metricsMux := http.NewServeMux()
-	metricsHandler := handlers.NewMetricsHandler(cfg)
+	metricsHandler := handlers.NewMetricsHandler(cfg, s, webhookHandler)
 	metricsMux.Handle("/metrics", metricsHandler)
 
 	return &Server{
-		Config:     cfg,
-		Store:      s,
-		WebhookMux: webhookMux,
-		AdminMux:   adminMux,
-		MetricsMux: metricsMux,
+		Config:         cfg,
+		Store:          s,
+		WebhookMux:     webhookMux,
+		AdminMux:       adminMux,
+		MetricsMux:     metricsMux,
+		WebhookHandler: webhookHandler,
+		AdminHandler:   adminHandler,
 	}
 }
 
 // StartWebhookServer запускает сервер для вебхуков
 func (srv *Server) StartWebhookServer(addr string) error {
-	return http.ListenAndServe(addr, srv.WebhookMux)
+	return srv.listen(addr, srv.WebhookMux)
 }
 
 // StartAdminServer запускает сервер для административных хендлеров
 func (srv *Server) StartAdminServer(addr string) error {
-	return http.ListenAndServe(addr, srv.AdminMux)
+	return srv.listen(addr, srv.AdminMux)
 }
 
 // StartMetricsServer запускает сервер для метрик
 func (srv *Server) StartMetricsServer(addr string) error {
-	return http.ListenAndServe(addr, srv.MetricsMux)
+	return srv.listen(addr, srv.MetricsMux)
+}
+
+// listen запускает HTTP сервер и запоминает его для graceful shutdown
+func (srv *Server) listen(addr string, handler http.Handler) error {
+	httpServer := &http.Server{Addr: addr, Handler: handler}
+	srv.mu.Lock()
+	srv.httpServers = append(srv.httpServers, httpServer)
+	srv.mu.Unlock()
+	return httpServer.ListenAndServe()
 }
 
-// Shutdown graceful shutdown серверов (если нужно)
-func (srv *Server) Shutdown() error {
-	// Логику graceful shutdown можно добавить, если нужно
-	return nil
+// Shutdown останавливает HTTP серверы, а затем дожидается обработки
+// уже принятых вебхуков, пока не истечёт ctx
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	httpServers := srv.httpServers
+	srv.mu.Unlock()
+
+	var errs []error
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := srv.WebhookHandler.Close(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,176 @@
+// internal/store/backend.go
+// storage backend interface and the logic shared by its implementations
+
+package store
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// Backend keeps the Organization/User -> Repository -> Workflow -> WorkflowRun -> Job -> Step tree.
+// Store keeps it in memory, DiskStore in a file. Both merge out-of-order updates the same way,
+// create stubs for objects whose parent is not known yet and count completions for metrics.
+// Lists are sorted, see the methods of Store.
+type Backend interface {
+	AddOrUpdateUser(userID int64, user *models.User)
+	AddOrUpdateOrganization(orgID int64, org *models.Organization)
+	AddOrUpdateRepository(repoID int64, repo *models.Repository)
+	AddOrUpdateWorkflow(workflowID int64, workflow *models.Workflow)
+	AddOrUpdateWorkflowRun(runID int64, run *models.WorkflowRun)
+	AddOrUpdateJob(jobID int64, job *models.Job)
+
+	GetUser(userID int64) (*models.User, bool)
+	GetOrganization(orgID int64) (*models.Organization, bool)
+	GetRepository(repoID int64) (*models.Repository, bool)
+	GetWorkflow(workflowID int64) (*models.Workflow, bool)
+	GetWorkflowRun(runID int64) (*models.WorkflowRun, bool)
+	GetJob(jobID int64) (*models.Job, bool)
+
+	GetWorkflowRuns(workflowID int64) []*models.WorkflowRun
+	GetRepositoryJobs(repoID int64, status string) []*models.Job
+	GetRunJobs(runID int64) []*models.Job
+	GetJobSteps(jobID int64) []*models.Step
+
+	// FindRuns and FindJobs return the objects matching the filter, see RunFilter and JobFilter
+	FindRuns(f RunFilter) []*models.WorkflowRun
+	FindJobs(f JobFilter) []*models.Job
+
+	GetAllUsers() map[int64]*models.User
+	GetAllOrganizations() map[int64]*models.Organization
+	GetAllRepositories() map[int64]*models.Repository
+	GetAllWorkflows() map[int64]*models.Workflow
+	GetAllWorkflowRuns() map[int64]*models.WorkflowRun
+	GetAllJobs() map[int64]*models.Job
+
+	// DeleteWorkflowRun removes the run with its jobs and steps, reports whether it existed
+	DeleteWorkflowRun(runID int64) bool
+	// ForEachRun calls fn for every run in the order of IDs until fn returns false.
+	// fn must not modify the backend.
+	ForEachRun(fn func(RunSnapshot) bool)
+
+	UnpushedRuns() []RunSnapshot
+	MarkPushed(runIDs ...int64)
+	IsPushed(runID int64) bool
+	EvictExpired(now time.Time, ttl, maxAge time.Duration) int
+
+	// Subscribe registers a subscriber of changes of runs and jobs, see Bus
+	Subscribe(name string, size int) *Subscription
+
+	// Collect writes gauges describing the objects currently kept in the backend
+	Collect(w *metrics.Writer)
+	// MarshalJSON renders the whole tree for the admin endpoint
+	json.Marshaler
+	// Close releases the resources of the backend, it must not be used afterwards
+	Close() error
+}
+
+var (
+	_ Backend    = (*Store)(nil)
+	_ Backend    = (*DiskStore)(nil)
+	_ JSONWriter = (*DiskStore)(nil)
+)
+
+// JSONWriter is implemented by backends writing the admin views of the tree to w one
+// node at a time, so a tree that doesn't fit in memory can be dumped as well. The output
+// is indented the same way as json.MarshalIndent(v, "", "  ") of the value it stands for.
+type JSONWriter interface {
+	// WriteJSON writes the document of MarshalJSON
+	WriteJSON(w io.Writer) error
+	// WriteOrganizationsJSON writes the map of GetAllOrganizations
+	WriteOrganizationsJSON(w io.Writer) error
+	// WriteRepositoriesJSON writes the map of GetAllRepositories
+	WriteRepositoriesJSON(w io.Writer) error
+}
+
+// relation maps a parent ID to the set of its children IDs
+type relation map[int64]map[int64]struct{}
+
+func (r relation) add(parentID, childID int64) {
+	if r[parentID] == nil {
+		r[parentID] = make(map[int64]struct{})
+	}
+	r[parentID][childID] = struct{}{}
+}
+
+func (r relation) remove(parentID, childID int64) {
+	delete(r[parentID], childID)
+	if len(r[parentID]) == 0 {
+		delete(r, parentID)
+	}
+}
+
+// children returns the children of parentID in ascending order
+func (r relation) children(parentID int64) []int64 {
+	ids := make([]int64, 0, len(r[parentID]))
+	for id := range r[parentID] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// expiryReason returns why the run has to be evicted, or an empty string if it is kept.
+// Completed runs are kept for ttl after their last update, or for pushedGrace after the
+// push target confirmed them (pushed is zero until then), unfinished ones for maxAge
+// after they were created. Zero durations turn the corresponding check off.
+func expiryReason(run *models.WorkflowRun, touched Touch, pushed, now time.Time, ttl, maxAge time.Duration) string {
+	if IsCompleted(run.GetStatus()) {
+		if ttl > 0 && now.Sub(touched.Last) > ttl {
+			return evictReasonTTL
+		}
+		if !pushed.IsZero() && now.Sub(pushed) > pushedGrace {
+			return evictReasonPushed
+		}
+		return ""
+	}
+
+	// Runs stuck in progress are kept long after their last update, but not forever
+	born := touched.First
+	if run.CreatedAt != nil && run.CreatedAt.Before(born) {
+		born = *run.CreatedAt
+	}
+	if maxAge > 0 && now.Sub(born) > maxAge {
+		return evictReasonMaxAge
+	}
+	return ""
+}
+
+// pushableJobs returns the jobs of the current attempt of a completed run and
+// whether all of them are completed. jobs must be sorted, see sortJobs.
+func pushableJobs(run *models.WorkflowRun, jobs []*models.Job) ([]*models.Job, bool) {
+	var result []*models.Job
+	for _, job := range jobs {
+		// Джобы прошлых попыток уже были отправлены вместе со своей попыткой
+		if job.Attempt != nil && run.Attempt != nil && job.GetAttempt() != run.GetAttempt() {
+			continue
+		}
+		if !IsCompleted(job.GetStatus()) {
+			return nil, false
+		}
+		result = append(result, job)
+	}
+	return result, true
+}
+
+// stubRun creates a run from the data of its job, until the run event arrives
+func stubRun(job *models.Job) *models.WorkflowRun {
+	return &models.WorkflowRun{
+		RunID:        job.RunID,
+		RepositoryID: job.RepositoryID,
+		Name:         job.WorkflowName,
+		Attempt:      job.Attempt,
+		HeadBranch:   job.HeadBranch,
+		HeadSHA:      job.HeadSHA,
+	}
+}
+
+// stubWorkflow creates the workflow of a run, until the workflow itself is stored
+func stubWorkflow(run *models.WorkflowRun) *models.Workflow {
+	return &models.Workflow{ID: run.WorkflowID, RepositoryID: run.RepositoryID, Name: run.Name}
+}
@@ -0,0 +1,372 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// backends lists every Backend implementation, the conformance tests run against each of them
+var backends = []struct {
+	name string
+	open func(t *testing.T) Backend
+}{
+	{"memory", func(t *testing.T) Backend { return NewStore() }},
+	{"disk", func(t *testing.T) Backend {
+		d, err := OpenDiskStore(filepath.Join(t.TempDir(), "store.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}},
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, name string, b Backend)) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			b := backend.open(t)
+			defer b.Close()
+			test(t, backend.name, b)
+		})
+	}
+}
+
+func conformanceRun(repo string, status string, updatedAt time.Time) *models.WorkflowRun {
+	return models.NewWorkflowRun(&github.WorkflowRun{
+		ID:         github.Int64(100),
+		WorkflowID: github.Int64(10),
+		Name:       github.String("CI"),
+		HeadBranch: github.String("main"),
+		Event:      github.String("push"),
+		RunAttempt: github.Int(1),
+		Status:     github.String(status),
+		Conclusion: github.String("success"),
+		UpdatedAt:  &github.Timestamp{Time: updatedAt},
+		Repository: &github.Repository{ID: github.Int64(1), FullName: github.String(repo)},
+	})
+}
+
+func conformanceJob(jobID int64, status string, steps ...*github.TaskStep) *models.Job {
+	return models.NewJob(&github.WorkflowJob{
+		ID:          github.Int64(jobID),
+		RunID:       github.Int64(100),
+		RunAttempt:  github.Int64(1),
+		Name:        github.String("build"),
+		Status:      github.String(status),
+		Conclusion:  github.String("success"),
+		Steps:       steps,
+		CompletedAt: &github.Timestamp{Time: time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)},
+	}, 1)
+}
+
+// TestBackendTree checks upserts, stubs and lookups through the hierarchy
+func TestBackendTree(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name string, b Backend) {
+		repo := "org/tree-" + name
+		b.AddOrUpdateRepository(1, models.NewRepository(&github.Repository{
+			ID:       github.Int64(1),
+			FullName: github.String(repo),
+			Owner:    &github.User{ID: github.Int64(5), Login: github.String("org"), Type: github.String("Organization")},
+		}))
+		b.AddOrUpdateOrganization(5, &models.Organization{ID: github.Int64(5), Name: github.String("The Org")})
+
+		// The job arrives before its run, the run is created from it but not attached to a workflow yet
+		b.AddOrUpdateJob(2002, conformanceJob(2002, "queued"))
+		run, exists := b.GetWorkflowRun(100)
+		assert.True(t, exists)
+		assert.Equal(t, "", run.GetStatus())
+		assert.Equal(t, int64(1), run.GetRepositoryID())
+		assert.Empty(t, b.GetWorkflowRuns(10))
+
+		started := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+		b.AddOrUpdateWorkflowRun(100, conformanceRun(repo, "in_progress", started))
+		// A stale delivery doesn't move the run back
+		b.AddOrUpdateWorkflowRun(100, conformanceRun(repo, "queued", started.Add(time.Minute)))
+		b.AddOrUpdateJob(2001, conformanceJob(2001, "completed",
+			&github.TaskStep{Number: github.Int64(2), Name: github.String("test"), Status: github.String("completed")},
+			&github.TaskStep{Number: github.Int64(1), Name: github.String("checkout"), Status: github.String("completed")}))
+
+		run, _ = b.GetWorkflowRun(100)
+		assert.Equal(t, "in_progress", run.GetStatus())
+		assert.Len(t, run.Jobs, 2)
+		runs := b.GetWorkflowRuns(10)
+		if assert.Len(t, runs, 1) {
+			assert.Equal(t, int64(100), runs[0].GetRunID())
+		}
+		workflow, exists := b.GetWorkflow(10)
+		assert.True(t, exists)
+		assert.Equal(t, "CI", workflow.GetName())
+
+		jobs := b.GetRunJobs(100)
+		if assert.Len(t, jobs, 2) {
+			assert.Equal(t, int64(2001), jobs[0].GetID())
+			assert.Equal(t, int64(2002), jobs[1].GetID())
+		}
+		completed := b.GetRepositoryJobs(1, "completed")
+		if assert.Len(t, completed, 1) {
+			assert.Equal(t, int64(2001), completed[0].GetID())
+		}
+		assert.Len(t, b.GetRepositoryJobs(1, ""), 2)
+		steps := b.GetJobSteps(2001)
+		if assert.Len(t, steps, 2) {
+			assert.Equal(t, "checkout", steps[0].GetName())
+		}
+
+		// The organization keeps the fields of both updates and owns the repository subtree
+		org, exists := b.GetOrganization(5)
+		assert.True(t, exists)
+		assert.Equal(t, "org", *org.Login)
+		assert.Equal(t, "The Org", *org.Name)
+		assert.Contains(t, org.Repositories, int64(1))
+		all := b.GetAllOrganizations()
+		if assert.Contains(t, all, int64(5)) {
+			assert.Contains(t, all[5].Repositories[1].Workflows[10].Runs[100].Jobs, int64(2001))
+		}
+		assert.Len(t, b.GetAllJobs(), 2)
+
+		data, err := json.Marshal(b)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), `"organizations"`)
+
+		w := metrics.NewWriter()
+		b.Collect(w)
+		assert.Contains(t, string(w.Bytes()), `ant_watcher_workflow_runs{repository="`+repo+`"`)
+	})
+}
+
+// TestBackendLifecycle checks completion counting, push tracking, iteration, eviction and deletion
+func TestBackendLifecycle(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name string, b Backend) {
+		repo := "org/lifecycle-" + name
+		b.AddOrUpdateRepository(1, &models.Repository{ID: github.Int64(1), FullName: github.String(repo)})
+		now := time.Now()
+		b.AddOrUpdateWorkflowRun(100, conformanceRun(repo, "completed", now))
+		b.AddOrUpdateWorkflowRun(100, conformanceRun(repo, "completed", now))
+		b.AddOrUpdateJob(2001, conformanceJob(2001, "in_progress"))
+		assert.Equal(t, float64(1), runsCompleted.Value(repo, "CI", "main", "push", "success"))
+
+		// Not pushed until all jobs complete
+		assert.Empty(t, b.UnpushedRuns())
+		b.AddOrUpdateJob(2001, conformanceJob(2001, "completed"))
+		unpushed := b.UnpushedRuns()
+		if assert.Len(t, unpushed, 1) {
+			assert.Equal(t, repo, unpushed[0].Repository.GetFullName())
+			assert.Len(t, unpushed[0].Jobs, 1)
+		}
+		b.MarkPushed(100, 999)
+		assert.True(t, b.IsPushed(100))
+		assert.False(t, b.IsPushed(999))
+		assert.Empty(t, b.UnpushedRuns())
+
+		// A stub run created by a job of another run
+		b.AddOrUpdateJob(3001, models.NewJob(&github.WorkflowJob{ID: github.Int64(3001), RunID: github.Int64(300), Status: github.String("queued")}, 1))
+		var seen []int64
+		b.ForEachRun(func(snap RunSnapshot) bool {
+			seen = append(seen, snap.Run.GetRunID())
+			return true
+		})
+		assert.Equal(t, []int64{100, 300}, seen)
+		seen = nil
+		b.ForEachRun(func(snap RunSnapshot) bool {
+			seen = append(seen, snap.Run.GetRunID())
+			return false
+		})
+		assert.Equal(t, []int64{100}, seen)
+
+		// The pushed run goes after the grace period, long before the TTL
+		assert.Equal(t, 0, b.EvictExpired(time.Now(), time.Hour, 24*time.Hour))
+		assert.Equal(t, 1, b.EvictExpired(time.Now().Add(2*pushedGrace), time.Hour, 24*time.Hour))
+		_, exists := b.GetWorkflowRun(100)
+		assert.False(t, exists)
+		_, exists = b.GetJob(2001)
+		assert.False(t, exists)
+		assert.False(t, b.IsPushed(100))
+		assert.Empty(t, b.GetWorkflowRuns(10))
+
+		assert.True(t, b.DeleteWorkflowRun(300))
+		assert.False(t, b.DeleteWorkflowRun(300))
+		assert.Empty(t, b.GetAllWorkflowRuns())
+		assert.Empty(t, b.GetAllJobs())
+	})
+}
+
+// TestBackendRunlessJob checks that a job without a run is not stored, nothing would ever evict it,
+// while an update without a run of a stored job still applies
+func TestBackendRunlessJob(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name string, b Backend) {
+		b.AddOrUpdateJob(3001, models.NewJob(&github.WorkflowJob{ID: github.Int64(3001), Status: github.String("queued")}, 1))
+		_, exists := b.GetJob(3001)
+		assert.False(t, exists)
+
+		b.AddOrUpdateWorkflowRun(100, conformanceRun("org/runless-"+name, "completed", time.Now()))
+		b.AddOrUpdateJob(2001, conformanceJob(2001, "in_progress"))
+		b.AddOrUpdateJob(2001, models.NewJob(&github.WorkflowJob{ID: github.Int64(2001), Status: github.String("completed")}, 1))
+		job, exists := b.GetJob(2001)
+		if assert.True(t, exists) {
+			assert.Equal(t, "completed", job.GetStatus())
+			assert.Equal(t, int64(100), job.GetRunID())
+		}
+
+		assert.Equal(t, 1, b.EvictExpired(time.Now().Add(time.Minute), time.Nanosecond, 0))
+		assert.Empty(t, b.GetAllJobs(), "every job leaves with its run")
+	})
+}
+
+// TestRunlessJobsOnLoad checks that jobs without a run saved by older versions are dropped on restore and open
+func TestRunlessJobsOnLoad(t *testing.T) {
+	runless := models.NewJob(&github.WorkflowJob{ID: github.Int64(3001), Status: github.String("queued")}, 1)
+
+	s := NewStore()
+	s.restore(&snapshot{Version: snapshotVersion, Jobs: map[int64]*models.Job{3001: runless}})
+	assert.Empty(t, s.GetAllJobs())
+
+	path := filepath.Join(t.TempDir(), "store.db")
+	d, err := OpenDiskStore(path)
+	assert.NoError(t, err)
+	saveNode(d.db, kindJob, 3001, runless)
+	assert.NoError(t, d.Close())
+	d, err = OpenDiskStore(path)
+	assert.NoError(t, err)
+	defer d.Close()
+	assert.Empty(t, d.GetAllJobs())
+	assert.False(t, d.hasKey(kindJob, 3001))
+}
+
+// TestDiskStoreReopen checks that the disk backend keeps the tree across restarts
+func TestDiskStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	d, err := OpenDiskStore(path)
+	assert.NoError(t, err)
+	d.AddOrUpdateRepository(1, &models.Repository{ID: github.Int64(1), FullName: github.String("org/reopen")})
+	d.AddOrUpdateWorkflowRun(100, conformanceRun("org/reopen", "completed", time.Now()))
+	d.AddOrUpdateJob(2001, conformanceJob(2001, "completed"))
+	d.MarkPushed(100)
+	assert.NoError(t, d.Close())
+
+	d, err = OpenDiskStore(path)
+	assert.NoError(t, err)
+	defer d.Close()
+	assert.Len(t, d.GetWorkflowRuns(10), 1)
+	assert.Len(t, d.GetRepositoryJobs(1, "completed"), 1)
+	assert.True(t, d.IsPushed(100))
+	repo, _ := d.GetRepository(1)
+	assert.Contains(t, repo.Workflows[10].Runs, int64(100))
+
+	// Every update appends to the file, compaction keeps only the current values
+	defer func(size int64) { compactMinGarbage = size }(compactMinGarbage)
+	compactMinGarbage = 0
+	for i := 0; i < 10; i++ {
+		d.AddOrUpdateJob(2001, conformanceJob(2001, "completed"))
+	}
+	d.EvictExpired(time.Now(), 0, 0)
+	total, live := d.db.Size()
+	assert.Equal(t, total, live)
+	assert.Len(t, d.GetRunJobs(100), 1)
+}
+
+// TestDiskStoreWriteJSON checks that the streamed admin views are the same documents the maps are encoded to
+func TestDiskStoreWriteJSON(t *testing.T) {
+	d, err := OpenDiskStore(filepath.Join(t.TempDir(), "store.db"))
+	assert.NoError(t, err)
+	defer d.Close()
+	for _, id := range []int64{9, 10} {
+		d.AddOrUpdateRepository(id, models.NewRepository(&github.Repository{
+			ID:       github.Int64(id),
+			FullName: github.String(fmt.Sprintf("org/stream-%d", id)),
+			Owner:    &github.User{ID: github.Int64(5), Login: github.String("org"), Type: github.String("Organization")},
+		}))
+	}
+	d.AddOrUpdateRepository(11, models.NewRepository(&github.Repository{
+		ID:       github.Int64(11),
+		FullName: github.String("dev/stream"),
+		Owner:    &github.User{ID: github.Int64(6), Login: github.String("dev"), Type: github.String("User")},
+	}))
+	run := conformanceRun("org/stream-9", "completed", time.Now())
+	run.RepositoryID = github.Int64(9)
+	d.AddOrUpdateWorkflowRun(100, run)
+	d.AddOrUpdateJob(2001, conformanceJob(2001, "completed"))
+	d.MarkPushed(100)
+
+	var buf strings.Builder
+	assert.NoError(t, d.WriteOrganizationsJSON(&buf))
+	expected, _ := json.MarshalIndent(d.GetAllOrganizations(), "", "  ")
+	assert.Equal(t, string(expected), buf.String())
+
+	buf.Reset()
+	assert.NoError(t, d.WriteRepositoriesJSON(&buf))
+	expected, _ = json.MarshalIndent(d.GetAllRepositories(), "", "  ")
+	assert.Equal(t, string(expected), buf.String())
+
+	buf.Reset()
+	assert.NoError(t, d.WriteJSON(&buf))
+	expected, _ = json.MarshalIndent(d, "", "  ")
+	assert.Equal(t, string(expected), buf.String(), "indented like json.MarshalIndent")
+	var doc storeJSON
+	assert.NoError(t, json.Unmarshal([]byte(buf.String()), &doc))
+	assert.Contains(t, doc.Users[6].Repositories, int64(11))
+	assert.Contains(t, doc.Organizations[5].Repositories[9].Workflows[10].Runs[100].Jobs, int64(2001))
+	assert.Contains(t, doc.Pushed, int64(100))
+	assert.Contains(t, doc.Touched, int64(100))
+}
+
+// TestBackendFind checks the queries by indexed fields
+func TestBackendFind(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name string, b Backend) {
+		started := time.Now()
+		b.AddOrUpdateWorkflowRun(100, conformanceRun("org/find-"+name, "in_progress", started))
+		queued := conformanceJob(2001, "queued")
+		queued.Labels = []string{"ubuntu-latest"}
+		b.AddOrUpdateJob(2001, queued)
+		b.AddOrUpdateJob(2002, conformanceJob(2002, "completed"))
+
+		jobs := b.FindJobs(JobFilter{WorkflowID: 10, Status: "queued", RunnerLabel: "ubuntu-latest"})
+		if assert.Len(t, jobs, 1) {
+			assert.Equal(t, int64(2001), jobs[0].GetID())
+		}
+		assert.Empty(t, b.FindJobs(JobFilter{WorkflowID: 11}))
+		runs := b.FindRuns(RunFilter{RepositoryID: 1, Status: "in_progress", Since: started.Add(-time.Hour)})
+		if assert.Len(t, runs, 1) {
+			assert.Len(t, runs[0].Jobs, 2)
+		}
+		assert.Empty(t, b.FindRuns(RunFilter{HeadBranch: "dev"}))
+		assert.Empty(t, b.FindRuns(RunFilter{Since: started.Add(time.Hour)}))
+	})
+}
+
+// TestBackendChanges checks the changes published to subscribers
+func TestBackendChanges(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, name string, b Backend) {
+		sub := b.Subscribe("test", 16)
+		defer sub.Close()
+
+		b.AddOrUpdateJob(2001, conformanceJob(2001, "queued"))
+		b.AddOrUpdateJob(2001, conformanceJob(2001, "queued"))
+		b.AddOrUpdateWorkflowRun(100, conformanceRun("org/changes-"+name, "in_progress", time.Now()))
+		b.AddOrUpdateJob(2001, conformanceJob(2001, "completed"))
+		assert.True(t, b.DeleteWorkflowRun(100))
+
+		var got []string
+		for len(sub.Changes()) > 0 {
+			c := <-sub.Changes()
+			got = append(got, strings.TrimSpace(fmt.Sprintf("%s %s %s->%s %s", c.Object, c.Kind, c.PrevStatus, c.Status(), c.Reason)))
+			if c.Kind == ChangeEvicted {
+				assert.Contains(t, c.Run.Jobs, int64(2001))
+			}
+		}
+		assert.Equal(t, []string{
+			"run created ->",
+			"job created ->queued",
+			"run transitioned ->in_progress",
+			"job transitioned queued->completed",
+			"run evicted ->in_progress deleted",
+		}, got)
+	})
+}
@@ -0,0 +1,152 @@
+// internal/store/clone.go
+// copies of tree nodes handed out by the getters, so callers never share maps with writers
+
+package store
+
+import "github.com/Melsoft-Games/ant-watcher/internal/models"
+
+// Upserts replace jobs and steps instead of modifying them, so copies share them.
+// Everything above a job has children maps that grow under the locks and is copied.
+
+// cloneRun copies the run with its jobs map. Caller holds the lock of the run's shard.
+func cloneRun(run *models.WorkflowRun) *models.WorkflowRun {
+	if run == nil {
+		return nil
+	}
+	node := *run
+	node.Jobs = make(map[int64]*models.Job, len(run.Jobs))
+	for jobID, job := range run.Jobs {
+		node.Jobs[jobID] = job
+	}
+	return &node
+}
+
+// treeCopy copies owners, repositories and workflows under s.Mu. The runs of the
+// copied workflows live in the shards and are added by fill after s.Mu is released.
+type treeCopy struct {
+	s       *Store
+	pending map[*models.Workflow][]int64 // Copied workflow -> runs to add
+}
+
+func (s *Store) newTreeCopy() *treeCopy {
+	return &treeCopy{s: s, pending: make(map[*models.Workflow][]int64)}
+}
+
+// workflow copies the workflow, its runs are added by fill. Caller holds s.Mu.
+func (tc *treeCopy) workflow(workflow *models.Workflow) *models.Workflow {
+	if workflow == nil {
+		return nil
+	}
+	node := *workflow
+	node.Runs = nil
+	if runIDs := tc.s.workflowRuns.children(workflow.GetID()); len(runIDs) > 0 {
+		tc.pending[&node] = runIDs
+	}
+	return &node
+}
+
+// repository copies the repository with its workflows. The owner is
+// replaced with a copy without repositories. Caller holds s.Mu.
+func (tc *treeCopy) repository(repo *models.Repository) *models.Repository {
+	if repo == nil {
+		return nil
+	}
+	node := tc.repositoryTree(repo)
+	switch owner := repo.Owner.(type) {
+	case *models.User:
+		user := *owner
+		user.Repositories = nil
+		node.Owner = &user
+	case *models.Organization:
+		org := *owner
+		org.Repositories = nil
+		node.Owner = &org
+	}
+	return node
+}
+
+// repositoryTree copies the repository with its workflows, leaving the owner unset. Caller holds s.Mu.
+func (tc *treeCopy) repositoryTree(repo *models.Repository) *models.Repository {
+	node := *repo
+	node.Owner = nil
+	if repo.Workflows != nil {
+		node.Workflows = make(map[int64]*models.Workflow, len(repo.Workflows))
+		for workflowID, workflow := range repo.Workflows {
+			node.Workflows[workflowID] = tc.workflow(workflow)
+		}
+	}
+	return &node
+}
+
+// user copies the user with its repositories, which point to the copy. Caller holds s.Mu.
+func (tc *treeCopy) user(user *models.User) *models.User {
+	if user == nil {
+		return nil
+	}
+	node := *user
+	node.Repositories = tc.ownedRepositories(user.Repositories, &node)
+	return &node
+}
+
+// organization copies the organization with its repositories, which point to the copy. Caller holds s.Mu.
+func (tc *treeCopy) organization(org *models.Organization) *models.Organization {
+	if org == nil {
+		return nil
+	}
+	node := *org
+	node.Repositories = tc.ownedRepositories(org.Repositories, &node)
+	return &node
+}
+
+func (tc *treeCopy) ownedRepositories(repos map[int64]*models.Repository, owner models.Owner) map[int64]*models.Repository {
+	if repos == nil {
+		return nil
+	}
+	result := make(map[int64]*models.Repository, len(repos))
+	for repoID, repo := range repos {
+		node := tc.repositoryTree(repo)
+		node.Owner = owner
+		result[repoID] = node
+	}
+	return result
+}
+
+// fill adds copies of the runs to the copied workflows, locking every shard once.
+// Runs evicted since the workflows were copied are skipped. Caller holds no locks.
+func (tc *treeCopy) fill() {
+	byShard := make(map[*shard][]int64)
+	for _, runIDs := range tc.pending {
+		for _, runID := range runIDs {
+			sh := tc.s.shardOf(runID)
+			byShard[sh] = append(byShard[sh], runID)
+		}
+	}
+	runs := make(map[int64]*models.WorkflowRun)
+	for sh, runIDs := range byShard {
+		sh.mu.RLock()
+		for _, runID := range runIDs {
+			if run, exists := sh.runs[runID]; exists {
+				runs[runID] = cloneRun(run)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	for workflow, runIDs := range tc.pending {
+		workflow.Runs = make(map[int64]*models.WorkflowRun, len(runIDs))
+		for _, runID := range runIDs {
+			if run, exists := runs[runID]; exists {
+				workflow.Runs[runID] = run
+			}
+		}
+	}
+}
+
+// cloneMap copies the map with every value passed through clone
+func cloneMap[T any](nodes map[int64]*T, clone func(*T) *T) map[int64]*T {
+	result := make(map[int64]*T, len(nodes))
+	for id, node := range nodes {
+		result[id] = clone(node)
+	}
+	return result
+}
@@ -0,0 +1,959 @@
+// internal/store/disk.go
+// storage backend keeping the tree in an embedded key-value file
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/kv"
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// Key prefixes of the nodes, the key of a node is "<kind>/<ID>"
+const (
+	kindUser         = "user"
+	kindOrganization = "org"
+	kindRepository   = "repo"
+	kindWorkflow     = "workflow"
+	kindRun          = "run"
+	kindJob          = "job"
+	kindPushed       = "pushed" // Time the run was confirmed by the push target
+)
+
+// compactMinGarbage is the size of overwritten and deleted values below which
+// the file is not compacted, whatever their share is
+var compactMinGarbage int64 = 16 << 20
+
+// DiskStore keeps every node in its own record of a key-value file, without
+// children, so the tree doesn't have to fit in memory and survives restarts
+// without snapshots. Relations between nodes, the times runs were updated, the
+// secondary indexes and the fields the gauges are labelled with are kept in
+// memory and rebuilt from the file on open.
+type DiskStore struct {
+	mu sync.RWMutex // Serializes read-modify-write of nodes and guards the fields below
+	db *kv.Store
+
+	ownerRepos    relation        // Owner ID -> repositories
+	repoWorkflows relation        // Repository ID -> workflows
+	workflowRuns  relation        // Workflow ID -> runs attached to it
+	runJobs       relation        // Run ID -> jobs
+	touched       map[int64]Touch // Reset to the open time for runs found in the file
+	runIndex      *index          // Secondary indexes of the runs, see index.go
+	jobIndex      *index          // Secondary indexes of the jobs
+	gauged        metricNodes     // What Collect needs of the nodes, so a scrape doesn't read the file
+	changes       Bus             // Subscribers of changes, see events.go. Has its own lock
+}
+
+// OpenDiskStore opens the store in the file at path, creating it if needed
+func OpenDiskStore(path string) (*DiskStore, error) {
+	db, err := kv.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &DiskStore{
+		db:            db,
+		ownerRepos:    make(relation),
+		repoWorkflows: make(relation),
+		workflowRuns:  make(relation),
+		runJobs:       make(relation),
+		touched:       make(map[int64]Touch),
+		runIndex:      newIndex(),
+		jobIndex:      newIndex(),
+		gauged:        newMetricNodes(),
+	}
+	if err := d.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not load store %s: %v", path, err)
+	}
+	return d, nil
+}
+
+// load rebuilds the relations and the indexes from the file
+func (d *DiskStore) load() error {
+	repos, err := scanKind[models.Repository](d.db, kindRepository)
+	if err != nil {
+		return err
+	}
+	for repoID, repo := range repos {
+		if ownerID := repo.GetOwnerID(); ownerID != 0 {
+			d.ownerRepos.add(ownerID, repoID)
+		}
+		d.gauged.setRepository(repoID, repo)
+	}
+	workflows, err := scanKind[models.Workflow](d.db, kindWorkflow)
+	if err != nil {
+		return err
+	}
+	for workflowID, workflow := range workflows {
+		if repoID := workflow.GetRepositoryID(); repoID != 0 {
+			d.repoWorkflows.add(repoID, workflowID)
+		}
+	}
+	runs, err := scanKind[models.WorkflowRun](d.db, kindRun)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for runID, run := range runs {
+		if run.GetRepositoryID() != 0 && run.GetWorkflowID() != 0 {
+			d.workflowRuns.add(run.GetWorkflowID(), runID)
+		}
+		d.touched[runID] = Touch{First: now, Last: now}
+		d.runIndex.set(runID, runIndexKeys(run))
+		d.gauged.setRun(runID, run)
+	}
+	jobs, err := scanKind[models.Job](d.db, kindJob)
+	if err != nil {
+		return err
+	}
+	for jobID, job := range jobs {
+		runID := job.GetRunID()
+		if runID == 0 {
+			// Written by an older version, nothing would ever evict it
+			d.deleteKey(kindJob, jobID)
+			delete(jobs, jobID)
+			continue
+		}
+		d.runJobs.add(runID, jobID)
+		d.jobIndex.set(jobID, jobIndexKeys(job))
+		d.gauged.setJob(jobID, job)
+	}
+	logger.Infof("Opened disk store with %d workflow runs and %d jobs", len(runs), len(jobs))
+	return nil
+}
+
+// AddOrUpdateUser добавляет или обновляет пользователя
+func (d *DiskStore) AddOrUpdateUser(userID int64, user *models.User) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	merged := *mergeNode(loadNode[models.User](d.db, kindUser, userID), user)
+	merged.Repositories = nil
+	saveNode(d.db, kindUser, userID, &merged)
+	logger.Infof("User with ID: %d added/updated", userID)
+}
+
+// AddOrUpdateOrganization добавляет или обновляет организацию
+func (d *DiskStore) AddOrUpdateOrganization(orgID int64, org *models.Organization) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	merged := *mergeNode(loadNode[models.Organization](d.db, kindOrganization, orgID), org)
+	merged.Repositories = nil
+	saveNode(d.db, kindOrganization, orgID, &merged)
+	logger.Infof("Organization with ID: %d added/updated", orgID)
+}
+
+// AddOrUpdateRepository добавляет или обновляет репозиторий и привязывает его к владельцу
+func (d *DiskStore) AddOrUpdateRepository(repoID int64, repo *models.Repository) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	merged := *mergeNode(loadNode[models.Repository](d.db, kindRepository, repoID), repo)
+	merged.Owner, merged.Workflows = nil, nil
+	saveNode(d.db, kindRepository, repoID, &merged)
+	d.gauged.setRepository(repoID, &merged)
+	if ownerID := merged.GetOwnerID(); ownerID != 0 {
+		d.ensureOwner(&merged)
+		d.ownerRepos.add(ownerID, repoID)
+	}
+	logger.Infof("Repository with ID: %d added/updated", repoID)
+}
+
+// AddOrUpdateWorkflow добавляет или обновляет воркфлоу и привязывает его к репозиторию
+func (d *DiskStore) AddOrUpdateWorkflow(workflowID int64, workflow *models.Workflow) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	merged := *mergeNode(loadNode[models.Workflow](d.db, kindWorkflow, workflowID), workflow)
+	merged.Runs = nil
+	saveNode(d.db, kindWorkflow, workflowID, &merged)
+	if repoID := merged.GetRepositoryID(); repoID != 0 {
+		d.ensureRepository(repoID)
+		d.repoWorkflows.add(repoID, workflowID)
+	}
+	logger.Infof("Workflow with ID: %d added/updated", workflowID)
+}
+
+// AddOrUpdateWorkflowRun добавляет или обновляет запуск воркфлоу и привязывает его к воркфлоу
+func (d *DiskStore) AddOrUpdateWorkflowRun(runID int64, run *models.WorkflowRun) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prev := loadNode[models.WorkflowRun](d.db, kindRun, runID)
+	merged, applied := mergeRun(prev, run)
+	if !applied {
+		logger.Debugf("Stale update of WorkflowRun %d (%s), stored state %s is newer", runID, run.GetStatus(), prev.GetStatus())
+	}
+	countRunCompletion(d, prev, merged)
+	node := *merged
+	node.Jobs = nil
+	saveNode(d.db, kindRun, runID, &node)
+	d.runIndex.set(runID, runIndexKeys(&node))
+	d.gauged.setRun(runID, &node)
+	d.attachRun(runID, &node)
+	d.touch(runID)
+	if !IsCompleted(merged.GetStatus()) {
+		// A re-run attempt has to be pushed again once it completes
+		d.deleteKey(kindPushed, runID)
+	}
+	d.changes.publishRun(prev, &node)
+	logger.Infof("WorkflowRun with ID: %d added/updated", runID)
+}
+
+// AddOrUpdateJob добавляет или обновляет джоб и привязывает его к запуску.
+// Если запуск ещё неизвестен, создаётся его заготовка из данных джоба.
+// Джоб без запуска не сохраняется, см. Store.AddOrUpdateJob.
+func (d *DiskStore) AddOrUpdateJob(jobID int64, job *models.Job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prev := loadNode[models.Job](d.db, kindJob, jobID)
+	if prev.GetRunID() == 0 && job.GetRunID() == 0 {
+		logger.Warningf("Job %d has no workflow run, skipping", jobID)
+		return
+	}
+	merged, applied := mergeJob(prev, job)
+	if !applied {
+		logger.Debugf("Stale update of Job %d (%s), stored state %s is newer", jobID, job.GetStatus(), prev.GetStatus())
+	}
+	countJobCompletion(d, prev, merged)
+	saveNode(d.db, kindJob, jobID, merged)
+	d.jobIndex.set(jobID, jobIndexKeys(merged))
+	d.gauged.setJob(jobID, merged)
+	runID := merged.GetRunID()
+	if !d.hasKey(kindRun, runID) {
+		stub := stubRun(merged)
+		saveNode(d.db, kindRun, runID, stub)
+		d.runIndex.set(runID, runIndexKeys(stub))
+		d.gauged.setRun(runID, stub)
+		d.changes.publishRun(nil, stub)
+	}
+	d.runJobs.add(runID, jobID)
+	d.touch(runID)
+	d.changes.publishJob(prev, merged)
+	logger.Infof("Job with ID: %d added/updated", jobID)
+}
+
+// GetUser возвращает пользователя по его ID вместе с его репозиториями
+func (d *DiskStore) GetUser(userID int64) (*models.User, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	user := loadNode[models.User](d.db, kindUser, userID)
+	if user == nil {
+		return nil, false
+	}
+	user.Repositories = d.ownerRepositories(userID)
+	return user, true
+}
+
+// GetOrganization возвращает организацию по её ID вместе с её репозиториями
+func (d *DiskStore) GetOrganization(orgID int64) (*models.Organization, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	org := loadNode[models.Organization](d.db, kindOrganization, orgID)
+	if org == nil {
+		return nil, false
+	}
+	org.Repositories = d.ownerRepositories(orgID)
+	return org, true
+}
+
+// GetRepository возвращает репозиторий по его ID вместе с поддеревом
+func (d *DiskStore) GetRepository(repoID int64) (*models.Repository, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	repo := d.loadRepository(repoID)
+	return repo, repo != nil
+}
+
+// GetWorkflow возвращает воркфлоу по его ID вместе с запусками
+func (d *DiskStore) GetWorkflow(workflowID int64) (*models.Workflow, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	workflow := d.loadWorkflow(workflowID)
+	return workflow, workflow != nil
+}
+
+// GetWorkflowRun возвращает запуск воркфлоу по его ID вместе с джобами
+func (d *DiskStore) GetWorkflowRun(runID int64) (*models.WorkflowRun, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	run := d.loadRun(runID)
+	return run, run != nil
+}
+
+// GetJob возвращает джоб по его ID
+func (d *DiskStore) GetJob(jobID int64) (*models.Job, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	job := loadNode[models.Job](d.db, kindJob, jobID)
+	return job, job != nil
+}
+
+// GetWorkflowRuns возвращает все запуски воркфлоу, отсортированные по ID
+func (d *DiskStore) GetWorkflowRuns(workflowID int64) []*models.WorkflowRun {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var runs []*models.WorkflowRun
+	for _, runID := range d.workflowRuns.children(workflowID) {
+		if run := d.loadRun(runID); run != nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// GetRepositoryJobs возвращает джобы запусков репозитория с указанным статусом,
+// пустой статус означает все джобы
+func (d *DiskStore) GetRepositoryJobs(repoID int64, status string) []*models.Job {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var jobs []*models.Job
+	for _, workflowID := range d.repoWorkflows.children(repoID) {
+		for _, runID := range d.workflowRuns.children(workflowID) {
+			for _, job := range d.jobsOf(runID) {
+				if status == "" || job.GetStatus() == status {
+					jobs = append(jobs, job)
+				}
+			}
+		}
+	}
+	sortJobs(jobs)
+	return jobs
+}
+
+// FindRuns возвращает запуски, подходящие под фильтр, отсортированные по ID.
+// Кандидаты берутся из индексов в памяти, с диска читаются только они.
+func (d *DiskStore) FindRuns(f RunFilter) []*models.WorkflowRun {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	set, indexed := runCandidates(d.runIndex, f)
+	var result []*models.WorkflowRun
+	for _, runID := range d.candidates(kindRun, set, indexed) {
+		if run := d.workflowRun(runID); run != nil && matchRun(f, run) {
+			run.Jobs = make(map[int64]*models.Job)
+			for _, job := range d.jobsOf(runID) {
+				run.Jobs[job.GetID()] = job
+			}
+			result = append(result, run)
+		}
+	}
+	return result
+}
+
+// FindJobs возвращает джобы, подходящие под фильтр, отсортированные по попытке и ID.
+// Кандидаты берутся из индексов, см. FindRuns.
+func (d *DiskStore) FindJobs(f JobFilter) []*models.Job {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	set, indexed := jobCandidates(d.jobIndex, d.runIndex, f, d.runJobs.children)
+	var result []*models.Job
+	for _, jobID := range d.candidates(kindJob, set, indexed) {
+		job := loadNode[models.Job](d.db, kindJob, jobID)
+		if job == nil {
+			continue
+		}
+		var run *models.WorkflowRun
+		if f.WorkflowID != 0 {
+			run = d.workflowRun(job.GetRunID())
+		}
+		if matchJob(f, job, run) {
+			result = append(result, job)
+		}
+	}
+	sortJobs(result)
+	return result
+}
+
+// candidates returns the IDs of the index set in ascending order, or of every node of
+// the kind when the filter has no indexed fields. Caller holds d.mu.
+func (d *DiskStore) candidates(kind string, set map[int64]struct{}, indexed bool) []int64 {
+	if !indexed {
+		return d.ids(kind)
+	}
+	ids := make([]int64, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// GetRunJobs возвращает все джобы запуска, отсортированные по попытке и ID
+func (d *DiskStore) GetRunJobs(runID int64) []*models.Job {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.jobsOf(runID)
+}
+
+// GetJobSteps возвращает шаги джоба, отсортированные по номеру
+func (d *DiskStore) GetJobSteps(jobID int64) []*models.Step {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return SortedSteps(loadNode[models.Job](d.db, kindJob, jobID))
+}
+
+// GetAllUsers возвращает всех пользователей с их поддеревьями.
+// Результат целиком в памяти, админка пишет дерево по частям, см. WriteJSON.
+func (d *DiskStore) GetAllUsers() map[int64]*models.User {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	users := make(map[int64]*models.User)
+	for _, userID := range d.ids(kindUser) {
+		if user, ok := d.loadUser(userID); ok {
+			users[userID] = user.(*models.User)
+		}
+	}
+	return users
+}
+
+// GetAllOrganizations возвращает все организации с их поддеревьями
+func (d *DiskStore) GetAllOrganizations() map[int64]*models.Organization {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	orgs := make(map[int64]*models.Organization)
+	for _, orgID := range d.ids(kindOrganization) {
+		if org, ok := d.loadOrganization(orgID); ok {
+			orgs[orgID] = org.(*models.Organization)
+		}
+	}
+	return orgs
+}
+
+// GetAllRepositories возвращает все репозитории с их поддеревьями
+func (d *DiskStore) GetAllRepositories() map[int64]*models.Repository {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	repos := make(map[int64]*models.Repository)
+	for _, repoID := range d.ids(kindRepository) {
+		if repo := d.loadRepository(repoID); repo != nil {
+			repos[repoID] = repo
+		}
+	}
+	return repos
+}
+
+// GetAllWorkflows возвращает все воркфлоу с их запусками
+func (d *DiskStore) GetAllWorkflows() map[int64]*models.Workflow {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	workflows := make(map[int64]*models.Workflow)
+	for _, workflowID := range d.ids(kindWorkflow) {
+		if workflow := d.loadWorkflow(workflowID); workflow != nil {
+			workflows[workflowID] = workflow
+		}
+	}
+	return workflows
+}
+
+// GetAllWorkflowRuns возвращает все запуски воркфлоу с их джобами
+func (d *DiskStore) GetAllWorkflowRuns() map[int64]*models.WorkflowRun {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	runs := make(map[int64]*models.WorkflowRun)
+	for _, runID := range d.ids(kindRun) {
+		if run := d.loadRun(runID); run != nil {
+			runs[runID] = run
+		}
+	}
+	return runs
+}
+
+// GetAllJobs возвращает все джобы
+func (d *DiskStore) GetAllJobs() map[int64]*models.Job {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	jobs, err := scanKind[models.Job](d.db, kindJob)
+	if err != nil {
+		logger.Errorf("Failed to read jobs: %v", err)
+	}
+	return jobs
+}
+
+// DeleteWorkflowRun удаляет запуск вместе с его джобами и шагами
+func (d *DiskStore) DeleteWorkflowRun(runID int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, deleted := d.deleteRun(runID, reasonDeleted)
+	return deleted
+}
+
+// ForEachRun вызывает fn для каждого запуска в порядке ID, пока fn не вернёт false.
+// fn вызывается под блокировкой на чтение и не должен изменять хранилище.
+func (d *DiskStore) ForEachRun(fn func(RunSnapshot) bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, runID := range d.ids(kindRun) {
+		run := d.workflowRun(runID)
+		if run == nil {
+			continue
+		}
+		if !fn(RunSnapshot{Run: run, Repository: d.repository(run.GetRepositoryID()), Jobs: d.jobsOf(runID)}) {
+			return
+		}
+	}
+}
+
+// UnpushedRuns возвращает завершённые запуски со всеми завершёнными джобами,
+// которые ещё не были отправлены в систему хранения метрик
+func (d *DiskStore) UnpushedRuns() []RunSnapshot {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var result []RunSnapshot
+	for _, runID := range d.ids(kindRun) {
+		run := loadNode[models.WorkflowRun](d.db, kindRun, runID)
+		if run == nil || !IsCompleted(run.GetStatus()) || d.hasKey(kindPushed, runID) {
+			continue
+		}
+		if jobs, finished := pushableJobs(run, d.jobsOf(runID)); finished {
+			result = append(result, RunSnapshot{Run: run, Repository: d.repository(run.GetRepositoryID()), Jobs: jobs})
+		}
+	}
+	return result
+}
+
+// MarkPushed отмечает запуски как подтверждённые системой хранения метрик,
+// чтобы их можно было удалить раньше TTL
+func (d *DiskStore) MarkPushed(runIDs ...int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for _, runID := range runIDs {
+		if d.hasKey(kindRun, runID) {
+			saveNode(d.db, kindPushed, runID, &now)
+		}
+	}
+	logger.Debugf("Marked %d workflow runs as pushed", len(runIDs))
+}
+
+// IsPushed сообщает, был ли запуск подтверждён системой хранения метрик
+func (d *DiskStore) IsPushed(runID int64) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.hasKey(kindPushed, runID)
+}
+
+// EvictExpired removes expired runs, see Store.EvictExpired, and compacts the file
+// when most of it is taken by removed and overwritten values
+func (d *DiskStore) EvictExpired(now time.Time, ttl, maxAge time.Duration) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	evicted := 0
+	for _, runID := range d.ids(kindRun) {
+		run := loadNode[models.WorkflowRun](d.db, kindRun, runID)
+		if run == nil {
+			continue
+		}
+		var pushed time.Time
+		if at := loadNode[time.Time](d.db, kindPushed, runID); at != nil {
+			pushed = *at
+		}
+		if reason := expiryReason(run, d.touched[runID], pushed, now, ttl, maxAge); reason != "" {
+			if jobs, deleted := d.deleteRun(runID, reason); deleted {
+				countEviction(runID, jobs, reason)
+				evicted++
+			}
+		}
+	}
+
+	if evicted > 0 {
+		logger.Infof("Evicted %d expired workflow runs, %d left on disk", evicted, len(d.touched))
+	}
+	if total, live := d.db.Size(); total-live > compactMinGarbage && total > 2*live {
+		if err := d.db.Compact(); err != nil {
+			logger.Errorf("Failed to compact disk store: %v", err)
+		}
+	}
+	return evicted
+}
+
+// Collect writes gauges describing the objects currently kept in the store.
+// The gauges are counted from memory, the file is not read.
+func (d *DiskStore) Collect(w *metrics.Writer) {
+	gauges := newObjectGauges()
+	d.mu.RLock()
+	gauges.count(d.gauged, d.gauged.runs, d.gauged.jobs)
+	gauges.countRunnerLabelIndex(d.jobIndex)
+	d.mu.RUnlock()
+
+	gauges.collect(w)
+	total, live := d.db.Size()
+	metrics.NewGaugeFunc("ant_watcher_store_disk_bytes",
+		"Size of the disk store file, including overwritten values not compacted yet.",
+		func() float64 { return float64(total) }).Collect(w)
+	metrics.NewGaugeFunc("ant_watcher_store_disk_live_bytes",
+		"Size of the current values in the disk store file.",
+		func() float64 { return float64(live) }).Collect(w)
+}
+
+// MarshalJSON сериализует всё дерево в памяти, админка пишет его по частям через WriteJSON
+func (d *DiskStore) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := d.WriteJSON(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Subscribe подписывает на изменения запусков и джобов, см. Bus.Subscribe
+func (d *DiskStore) Subscribe(name string, size int) *Subscription {
+	return d.changes.Subscribe(name, size)
+}
+
+// Close закрывает файл хранилища
+func (d *DiskStore) Close() error {
+	return d.db.Close()
+}
+
+// repository returns the repository without its subtree. Caller holds d.mu.
+func (d *DiskStore) repository(repoID int64) *models.Repository {
+	if repoID == 0 {
+		return nil
+	}
+	return loadNode[models.Repository](d.db, kindRepository, repoID)
+}
+
+// workflowRun returns the run without its jobs. Caller holds d.mu.
+func (d *DiskStore) workflowRun(runID int64) *models.WorkflowRun {
+	if runID == 0 {
+		return nil
+	}
+	return loadNode[models.WorkflowRun](d.db, kindRun, runID)
+}
+
+// loadRepository returns the repository with its owner and subtree. Caller holds d.mu.
+func (d *DiskStore) loadRepository(repoID int64) *models.Repository {
+	repo := d.repository(repoID)
+	if repo == nil {
+		return nil
+	}
+	if ownerID := repo.GetOwnerID(); ownerID != 0 {
+		if repo.GetOwnerType() == "User" {
+			if user := loadNode[models.User](d.db, kindUser, ownerID); user != nil {
+				repo.Owner = user
+			}
+		} else if org := loadNode[models.Organization](d.db, kindOrganization, ownerID); org != nil {
+			repo.Owner = org
+		}
+	}
+	for _, workflowID := range d.repoWorkflows.children(repoID) {
+		if workflow := d.loadWorkflow(workflowID); workflow != nil {
+			if repo.Workflows == nil {
+				repo.Workflows = make(map[int64]*models.Workflow)
+			}
+			repo.Workflows[workflowID] = workflow
+		}
+	}
+	return repo
+}
+
+// loadWorkflow returns the workflow with its runs. Caller holds d.mu.
+func (d *DiskStore) loadWorkflow(workflowID int64) *models.Workflow {
+	workflow := loadNode[models.Workflow](d.db, kindWorkflow, workflowID)
+	if workflow == nil {
+		return nil
+	}
+	for _, runID := range d.workflowRuns.children(workflowID) {
+		if run := d.loadRun(runID); run != nil {
+			if workflow.Runs == nil {
+				workflow.Runs = make(map[int64]*models.WorkflowRun)
+			}
+			workflow.Runs[runID] = run
+		}
+	}
+	return workflow
+}
+
+// loadRun returns the run with its jobs. Caller holds d.mu.
+func (d *DiskStore) loadRun(runID int64) *models.WorkflowRun {
+	run := d.workflowRun(runID)
+	if run == nil {
+		return nil
+	}
+	run.Jobs = make(map[int64]*models.Job)
+	for _, job := range d.jobsOf(runID) {
+		run.Jobs[job.GetID()] = job
+	}
+	return run
+}
+
+// jobsOf returns the jobs of the run sorted by attempt and ID. Caller holds d.mu.
+func (d *DiskStore) jobsOf(runID int64) []*models.Job {
+	jobs := make([]*models.Job, 0, len(d.runJobs[runID]))
+	for _, jobID := range d.runJobs.children(runID) {
+		if job := loadNode[models.Job](d.db, kindJob, jobID); job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	sortJobs(jobs)
+	return jobs
+}
+
+// ownerRepositories returns the repositories of the owner with their subtrees,
+// nil if there are none. Caller holds d.mu.
+func (d *DiskStore) ownerRepositories(ownerID int64) map[int64]*models.Repository {
+	var repos map[int64]*models.Repository
+	for _, repoID := range d.ownerRepos.children(ownerID) {
+		if repo := d.loadRepository(repoID); repo != nil {
+			if repos == nil {
+				repos = make(map[int64]*models.Repository)
+			}
+			repos[repoID] = repo
+		}
+	}
+	return repos
+}
+
+// ensureOwner stores a stub of the repository owner if it is not known yet. Caller holds d.mu.
+func (d *DiskStore) ensureOwner(repo *models.Repository) {
+	ownerID := repo.GetOwnerID()
+	if repo.GetOwnerType() == "User" {
+		if !d.hasKey(kindUser, ownerID) {
+			saveNode(d.db, kindUser, ownerID, &models.User{ID: repo.OwnerID, Login: repo.OwnerLogin})
+		}
+		return
+	}
+	if !d.hasKey(kindOrganization, ownerID) {
+		saveNode(d.db, kindOrganization, ownerID, &models.Organization{ID: repo.OwnerID, Login: repo.OwnerLogin})
+	}
+}
+
+// ensureRepository stores a stub of the repository if it is not known yet. Caller holds d.mu.
+func (d *DiskStore) ensureRepository(repoID int64) {
+	if !d.hasKey(kindRepository, repoID) {
+		stub := &models.Repository{ID: &repoID}
+		saveNode(d.db, kindRepository, repoID, stub)
+		d.gauged.setRepository(repoID, stub)
+	}
+}
+
+// attachRun links the run to its workflow if repository and workflow are known. Caller holds d.mu.
+func (d *DiskStore) attachRun(runID int64, run *models.WorkflowRun) {
+	repoID, workflowID := run.GetRepositoryID(), run.GetWorkflowID()
+	if repoID == 0 || workflowID == 0 {
+		return
+	}
+	if !d.hasKey(kindWorkflow, workflowID) {
+		saveNode(d.db, kindWorkflow, workflowID, stubWorkflow(run))
+		d.ensureRepository(repoID)
+		d.repoWorkflows.add(repoID, workflowID)
+	}
+	d.workflowRuns.add(workflowID, runID)
+}
+
+// deleteRun removes the run and its jobs, publishes the eviction and returns the number
+// of removed jobs. Caller holds d.mu.
+func (d *DiskStore) deleteRun(runID int64, reason string) (int, bool) {
+	run := d.workflowRun(runID)
+	if run == nil {
+		return 0, false
+	}
+	if d.changes.active() {
+		d.changes.publishEviction(d.loadRun(runID), reason)
+	}
+
+	jobIDs := d.runJobs.children(runID)
+	for _, jobID := range jobIDs {
+		d.deleteKey(kindJob, jobID)
+		d.jobIndex.remove(jobID)
+		delete(d.gauged.jobs, jobID)
+	}
+	delete(d.runJobs, runID)
+	d.runIndex.remove(runID)
+	delete(d.gauged.runs, runID)
+	d.workflowRuns.remove(run.GetWorkflowID(), runID)
+	d.deleteKey(kindRun, runID)
+	d.deleteKey(kindPushed, runID)
+	delete(d.touched, runID)
+	return len(jobIDs), true
+}
+
+// touch запоминает время обновления запуска. Caller holds d.mu.
+func (d *DiskStore) touch(runID int64) {
+	now := time.Now()
+	t, exists := d.touched[runID]
+	if !exists {
+		t.First = now
+	}
+	t.Last = now
+	d.touched[runID] = t
+}
+
+// ids returns the IDs of all nodes of kind in ascending order
+func (d *DiskStore) ids(kind string) []int64 {
+	keys := d.db.Keys(kind + "/")
+	ids := make([]int64, 0, len(keys))
+	for _, key := range keys {
+		if id, err := strconv.ParseInt(strings.TrimPrefix(key, kind+"/"), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (d *DiskStore) hasKey(kind string, id int64) bool {
+	_, exists, err := d.db.Get(nodeKey(kind, id))
+	if err != nil {
+		logger.Errorf("Failed to read %s: %v", nodeKey(kind, id), err)
+	}
+	return exists
+}
+
+func (d *DiskStore) deleteKey(kind string, id int64) {
+	if err := d.db.Delete(nodeKey(kind, id)); err != nil {
+		logger.Errorf("Failed to delete %s: %v", nodeKey(kind, id), err)
+	}
+}
+
+func nodeKey(kind string, id int64) string {
+	return kind + "/" + strconv.FormatInt(id, 10)
+}
+
+// loadNode reads and decodes the node, nil if it is missing or can't be read
+func loadNode[T any](db *kv.Store, kind string, id int64) *T {
+	data, exists, err := db.Get(nodeKey(kind, id))
+	if err != nil {
+		logger.Errorf("Failed to read %s: %v", nodeKey(kind, id), err)
+		return nil
+	}
+	if !exists {
+		return nil
+	}
+	node := new(T)
+	if err := json.Unmarshal(data, node); err != nil {
+		logger.Errorf("Failed to decode %s: %v", nodeKey(kind, id), err)
+		return nil
+	}
+	return node
+}
+
+// saveNode encodes and writes the node. A failed write is logged, the update is lost.
+func saveNode(db *kv.Store, kind string, id int64, node any) {
+	data, err := json.Marshal(node)
+	if err == nil {
+		err = db.Put(nodeKey(kind, id), data)
+	}
+	if err != nil {
+		logger.Errorf("Failed to write %s: %v", nodeKey(kind, id), err)
+	}
+}
+
+// scanKind reads and decodes all nodes of kind
+func scanKind[T any](db *kv.Store, kind string) (map[int64]*T, error) {
+	nodes := make(map[int64]*T)
+	var decodeErr error
+	err := db.Scan(kind+"/", func(key string, value []byte) bool {
+		id, err := strconv.ParseInt(strings.TrimPrefix(key, kind+"/"), 10, 64)
+		if err != nil {
+			return true
+		}
+		node := new(T)
+		if err := json.Unmarshal(value, node); err != nil {
+			decodeErr = fmt.Errorf("could not decode %s: %v", key, err)
+			return false
+		}
+		nodes[id] = node
+		return true
+	})
+	if err != nil {
+		return nodes, err
+	}
+	return nodes, decodeErr
+}
+
+// labelMaps is a labelSource over nodes read in advance
+type labelMaps struct {
+	repositories map[int64]*models.Repository
+	runs         map[int64]*models.WorkflowRun
+}
+
+func (m labelMaps) repository(repoID int64) *models.Repository  { return m.repositories[repoID] }
+func (m labelMaps) workflowRun(runID int64) *models.WorkflowRun { return m.runs[runID] }
+
+// metricNodes keeps only the fields of the repositories, runs and jobs the gauges are
+// labelled and counted by: names, statuses and conclusions, the steps without names
+type metricNodes struct {
+	labelMaps
+	jobs map[int64]*models.Job
+}
+
+func newMetricNodes() metricNodes {
+	return metricNodes{
+		labelMaps: labelMaps{
+			repositories: make(map[int64]*models.Repository),
+			runs:         make(map[int64]*models.WorkflowRun),
+		},
+		jobs: make(map[int64]*models.Job),
+	}
+}
+
+func (m metricNodes) setRepository(repoID int64, repo *models.Repository) {
+	m.repositories[repoID] = &models.Repository{ID: repo.ID, FullName: repo.FullName}
+}
+
+func (m metricNodes) setRun(runID int64, run *models.WorkflowRun) {
+	m.runs[runID] = &models.WorkflowRun{
+		RunID:        run.RunID,
+		RepositoryID: run.RepositoryID,
+		Name:         run.Name,
+		Event:        run.Event,
+		HeadBranch:   run.HeadBranch,
+		Status:       run.Status,
+		Conclusion:   run.Conclusion,
+	}
+}
+
+func (m metricNodes) setJob(jobID int64, job *models.Job) {
+	node := &models.Job{
+		ID:           job.ID,
+		RunID:        job.RunID,
+		RepositoryID: job.RepositoryID,
+		WorkflowName: job.WorkflowName,
+		HeadBranch:   job.HeadBranch,
+		Status:       job.Status,
+		Conclusion:   job.Conclusion,
+	}
+	if len(job.Steps) > 0 {
+		node.Steps = make(map[int64]*models.Step, len(job.Steps))
+		for number, step := range job.Steps {
+			node.Steps[number] = &models.Step{Status: step.Status, Conclusion: step.Conclusion}
+		}
+	}
+	m.jobs[jobID] = node
+}
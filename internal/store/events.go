@@ -0,0 +1,185 @@
+// internal/store/events.go
+// change events published by the backends, so features react to state transitions without polling
+
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// ChangeKind is what happened to the object
+type ChangeKind string
+
+const (
+	ChangeCreated      ChangeKind = "created"      // The object is stored for the first time, runs also as stubs created by their jobs
+	ChangeTransitioned ChangeKind = "transitioned" // The status or the conclusion changed
+	ChangeEvicted      ChangeKind = "evicted"      // The run was removed with its jobs, see Change.Reason
+)
+
+// ObjectKind is the type of the changed object
+type ObjectKind string
+
+const (
+	ObjectRun ObjectKind = "run"
+	ObjectJob ObjectKind = "job"
+)
+
+// reasonDeleted is the Reason of runs removed by DeleteWorkflowRun
+const reasonDeleted = "deleted"
+
+// Change describes a change of a run or a job. Changes of one run and its jobs are
+// published in the order they are applied, changes of different runs are not ordered.
+type Change struct {
+	Kind   ChangeKind
+	Object ObjectKind
+	// Run is a copy of the run without jobs, or with its jobs when it is evicted.
+	// For job changes it is nil.
+	Run *models.WorkflowRun
+	// Job is the stored job, it must not be modified. For run changes it is nil.
+	Job *models.Job
+
+	PrevStatus     string // Status before the transition, empty for other changes
+	PrevConclusion string // Conclusion before the transition
+	Reason         string // Why the run was evicted: ttl, max_age, memory or deleted
+	At             time.Time
+}
+
+// Status returns the status of the changed object
+func (c Change) Status() string {
+	if c.Job != nil {
+		return c.Job.GetStatus()
+	}
+	return c.Run.GetStatus()
+}
+
+// Conclusion returns the conclusion of the changed object
+func (c Change) Conclusion() string {
+	if c.Job != nil {
+		return c.Job.GetConclusion()
+	}
+	return c.Run.GetConclusion()
+}
+
+var (
+	changesPublished = metrics.NewCounter("ant_watcher_store_changes_total",
+		"Number of store changes published to subscribers.", "kind", "object")
+	changesDropped = metrics.NewCounter("ant_watcher_store_changes_dropped_total",
+		"Number of store changes dropped because the buffer of the subscriber was full.", "subscriber")
+)
+
+func init() {
+	metrics.Register(changesPublished, changesDropped)
+}
+
+// Bus delivers changes to subscribers. Every subscriber has a bounded buffer, a change
+// that doesn't fit is dropped for that subscriber and counted, so a slow subscriber
+// never blocks the store. The zero value is ready to use.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscription receives changes until it is closed
+type Subscription struct {
+	name string
+	ch   chan Change
+	bus  *Bus
+	once sync.Once
+}
+
+// Subscribe registers a subscriber with a buffer for size changes. name identifies
+// the subscriber in the metrics of dropped changes.
+func (b *Bus) Subscribe(name string, size int) *Subscription {
+	sub := &Subscription{name: name, ch: make(chan Change, size), bus: b}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	logger.Debugf("Store subscriber %s registered with a buffer of %d changes", name, size)
+	return sub
+}
+
+// Changes returns the channel of changes, it is closed by Close
+func (s *Subscription) Changes() <-chan Change {
+	return s.ch
+}
+
+// Close unsubscribes and closes the channel of changes. Buffered changes can still be read.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		defer s.bus.mu.Unlock()
+		delete(s.bus.subs, s)
+		close(s.ch)
+	})
+}
+
+// active reports whether anybody listens, so changes aren't built for nothing
+func (b *Bus) active() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs) > 0
+}
+
+// publish delivers the change to every subscriber without waiting
+func (b *Bus) publish(c Change) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.subs) == 0 {
+		return
+	}
+
+	changesPublished.Inc(string(c.Kind), string(c.Object))
+	for sub := range b.subs {
+		select {
+		case sub.ch <- c:
+		default:
+			changesDropped.Inc(sub.name)
+		}
+	}
+}
+
+// publishRun publishes the creation or the transition of the run, if there was one
+func (b *Bus) publishRun(prev, run *models.WorkflowRun) {
+	kind, changed := changeKind(prev == nil, prev.GetStatus(), prev.GetConclusion(), run.GetStatus(), run.GetConclusion())
+	if !changed || !b.active() {
+		return
+	}
+	node := *run
+	node.Jobs = nil
+	b.publish(Change{Kind: kind, Object: ObjectRun, Run: &node,
+		PrevStatus: prev.GetStatus(), PrevConclusion: prev.GetConclusion(), At: time.Now()})
+}
+
+// publishJob publishes the creation or the transition of the job, if there was one
+func (b *Bus) publishJob(prev, job *models.Job) {
+	kind, changed := changeKind(prev == nil, prev.GetStatus(), prev.GetConclusion(), job.GetStatus(), job.GetConclusion())
+	if !changed {
+		return
+	}
+	b.publish(Change{Kind: kind, Object: ObjectJob, Job: job,
+		PrevStatus: prev.GetStatus(), PrevConclusion: prev.GetConclusion(), At: time.Now()})
+}
+
+// publishEviction publishes the removal of the run, which is passed with its jobs
+func (b *Bus) publishEviction(run *models.WorkflowRun, reason string) {
+	b.publish(Change{Kind: ChangeEvicted, Object: ObjectRun, Run: run, Reason: reason, At: time.Now()})
+}
+
+// changeKind returns the kind of the change between two states, false if nothing changed
+func changeKind(created bool, prevStatus, prevConclusion, status, conclusion string) (ChangeKind, bool) {
+	switch {
+	case created:
+		return ChangeCreated, true
+	case status != prevStatus || conclusion != prevConclusion:
+		return ChangeTransitioned, true
+	}
+	return "", false
+}
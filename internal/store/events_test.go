@@ -0,0 +1,54 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSubscriptionBuffer checks that a full subscriber loses changes without blocking the store or other subscribers
+func TestSubscriptionBuffer(t *testing.T) {
+	s := NewStore()
+	slow := s.Subscribe("slow", 1)
+	fast := s.Subscribe("fast", 10)
+
+	before := changesDropped.Value("slow")
+	for runID := int64(1); runID <= 3; runID++ {
+		s.AddOrUpdateWorkflowRun(runID, &models.WorkflowRun{RunID: github.Int64(runID), Status: github.String("queued")})
+	}
+	assert.Len(t, slow.Changes(), 1)
+	assert.Len(t, fast.Changes(), 3)
+	assert.Equal(t, before+2, changesDropped.Value("slow"))
+
+	// Eviction passes the run with its jobs
+	s.AddOrUpdateJob(11, models.NewJob(&github.WorkflowJob{ID: github.Int64(11), RunID: github.Int64(1), Status: github.String("queued")}, 1))
+	assert.Equal(t, 3, s.EvictExpired(time.Now().Add(time.Hour), 0, time.Minute))
+	var evicted []Change
+	for len(fast.Changes()) > 0 {
+		if c := <-fast.Changes(); c.Kind == ChangeEvicted {
+			evicted = append(evicted, c)
+		}
+	}
+	if assert.Len(t, evicted, 3) {
+		for _, c := range evicted {
+			assert.Equal(t, evictReasonMaxAge, c.Reason)
+			if c.Run.GetRunID() == 1 {
+				assert.Contains(t, c.Run.Jobs, int64(11))
+			}
+		}
+	}
+
+	// A closed subscription keeps its buffered changes and gets no more
+	slow.Close()
+	slow.Close()
+	s.AddOrUpdateWorkflowRun(4, &models.WorkflowRun{RunID: github.Int64(4), Status: github.String("queued")})
+	_, open := <-slow.Changes()
+	assert.True(t, open)
+	_, open = <-slow.Changes()
+	assert.False(t, open)
+	fast.Close()
+	assert.False(t, s.changes.active())
+}
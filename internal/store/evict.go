@@ -0,0 +1,130 @@
+// internal/store/evict.go
+// eviction of old runs, so a long-running instance doesn't grow without limit
+
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+)
+
+// Reasons of eviction, used as the metric label
+const (
+	evictReasonTTL    = "ttl"     // Completed run not updated for MemoryTTL
+	evictReasonMaxAge = "max_age" // Unfinished run older than MaxRunAge
+	evictReasonMemory = "memory"  // Oldest completed run evicted while over MemoryLimit
+	evictReasonPushed = "pushed"  // Completed run confirmed by the push target
+)
+
+// pushedGrace is how long a run confirmed by the push target stays after the push,
+// so a /metrics scrape in between still sees it
+const pushedGrace = time.Minute
+
+var (
+	evictedRuns = metrics.NewCounter("ant_watcher_store_evicted_runs_total",
+		"Number of workflow runs evicted from memory together with their jobs and steps.", "reason")
+	evictedJobs = metrics.NewCounter("ant_watcher_store_evicted_jobs_total",
+		"Number of workflow jobs evicted from memory with their runs.", "reason")
+)
+
+func init() {
+	metrics.Register(evictedRuns, evictedJobs)
+}
+
+// janitorInterval is how often RunJanitor looks for expired runs
+var janitorInterval = 30 * time.Second
+
+// memoryLimiter is implemented by backends keeping runs in memory
+type memoryLimiter interface {
+	EnforceMemoryLimit(limit uint64) int
+}
+
+// RunJanitor periodically evicts expired runs from b and, for backends keeping runs
+// in memory, enforces the memory limit until ctx is cancelled. The TTLs and the limit
+// are read from cfg.Eviction on every pass, so a reload applies without restart.
+func RunJanitor(ctx context.Context, b Backend, cfg *config.Config) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ttl, maxAge, limit := cfg.Eviction()
+			b.EvictExpired(now, ttl, maxAge)
+			if limiter, ok := b.(memoryLimiter); ok {
+				limiter.EnforceMemoryLimit(limit)
+			}
+		}
+	}
+}
+
+// EvictExpired removes completed runs not updated for ttl or pushed more than pushedGrace
+// ago and unfinished runs older than maxAge, with their jobs and steps. Zero durations turn the
+// corresponding check off. Shards are locked one at a time. Returns the number of evicted runs.
+func (s *Store) EvictExpired(now time.Time, ttl, maxAge time.Duration) int {
+	evicted := 0
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for runID, run := range sh.runs {
+			if reason := expiryReason(run, sh.touched[runID], sh.pushed[runID], now, ttl, maxAge); reason != "" {
+				s.evictRun(sh, runID, reason)
+				evicted++
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	if evicted > 0 {
+		logger.Infof("Evicted %d expired workflow runs, %d left in memory", evicted, s.runCount())
+	}
+	return evicted
+}
+
+// evictRun removes the run and its jobs and counts the eviction. Caller holds sh.mu.
+func (s *Store) evictRun(sh *shard, runID int64, reason string) {
+	if jobs, deleted := s.deleteRun(sh, runID, reason); deleted {
+		countEviction(runID, jobs, reason)
+	}
+}
+
+// deleteRun removes the run and its jobs from the shard and the run from its workflow,
+// publishes the eviction and returns the number of removed jobs. Caller holds sh.mu, takes s.Mu.
+func (s *Store) deleteRun(sh *shard, runID int64, reason string) (int, bool) {
+	run, exists := sh.runs[runID]
+	if !exists {
+		return 0, false
+	}
+	if s.changes.active() {
+		s.changes.publishEviction(cloneRun(run), reason)
+	}
+
+	for jobID := range run.Jobs {
+		delete(sh.jobs, jobID)
+		sh.jobIndex.remove(jobID)
+		s.jobRuns.Delete(jobID)
+	}
+	if workflowID := run.GetWorkflowID(); workflowID != 0 {
+		s.Mu.Lock()
+		s.workflowRuns.remove(workflowID, runID)
+		s.Mu.Unlock()
+	}
+	delete(sh.runs, runID)
+	sh.runIndex.remove(runID)
+	delete(sh.pushed, runID)
+	delete(sh.touched, runID)
+	sh.untrack(runID)
+	return len(run.Jobs), true
+}
+
+// countEviction updates the eviction counters
+func countEviction(runID int64, jobs int, reason string) {
+	evictedRuns.Inc(reason)
+	evictedJobs.Add(float64(jobs), reason)
+	logger.Debugf("WorkflowRun with ID: %d evicted (%s)", runID, reason)
+}
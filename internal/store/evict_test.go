@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEvictExpired checks that completed runs expire after the TTL and unfinished ones after the max age
+func TestEvictExpired(t *testing.T) {
+	s := NewStore()
+	run := func(id, workflowID int64, status string) {
+		s.AddOrUpdateWorkflowRun(id, models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(id), WorkflowID: github.Int64(workflowID),
+			Status: github.String(status), Repository: &github.Repository{ID: github.Int64(1)}}))
+		s.AddOrUpdateJob(id*10, models.NewJob(&github.WorkflowJob{ID: github.Int64(id * 10), RunID: github.Int64(id), Status: github.String(status)}, 1))
+	}
+	run(1, 5, "completed")
+	run(2, 5, "in_progress")
+	run(3, 5, "completed")
+	s.MarkPushed(1)
+
+	ttlBefore, maxAgeBefore := evictedRuns.Value(evictReasonTTL), evictedRuns.Value(evictReasonMaxAge)
+	pushedBefore := evictedRuns.Value(evictReasonPushed)
+	now := time.Now()
+
+	// The pushed run goes once the grace period is over, long before the TTL
+	assert.Equal(t, 0, s.EvictExpired(now.Add(pushedGrace/2), 15*time.Minute, time.Hour))
+	assert.Equal(t, 1, s.EvictExpired(now.Add(2*pushedGrace), 15*time.Minute, time.Hour))
+	_, exists := s.GetWorkflowRun(1)
+	assert.False(t, exists)
+	_, exists = s.GetJob(10)
+	assert.False(t, exists)
+	assert.False(t, s.IsPushed(1))
+	assert.Equal(t, pushedBefore+1, evictedRuns.Value(evictReasonPushed))
+
+	// The run that wasn't pushed stays for the TTL
+	assert.Equal(t, 0, s.EvictExpired(now.Add(10*time.Minute), 15*time.Minute, time.Hour))
+	assert.Equal(t, 1, s.EvictExpired(now.Add(20*time.Minute), 15*time.Minute, time.Hour))
+	_, exists = s.GetWorkflowRun(3)
+	assert.False(t, exists)
+	assert.Len(t, s.GetWorkflowRuns(5), 1)
+	assert.Equal(t, ttlBefore+1, evictedRuns.Value(evictReasonTTL))
+
+	// An update keeps the unfinished run alive past the TTL, but not past the max age
+	s.AddOrUpdateJob(20, models.NewJob(&github.WorkflowJob{ID: github.Int64(20), RunID: github.Int64(2), Status: github.String("in_progress")}, 1))
+	assert.Equal(t, 0, s.EvictExpired(now.Add(50*time.Minute), 15*time.Minute, time.Hour))
+	assert.Equal(t, 1, s.EvictExpired(now.Add(61*time.Minute), 15*time.Minute, time.Hour))
+	assert.Empty(t, s.GetAllJobs())
+	assert.Empty(t, s.GetWorkflowRuns(5))
+	assert.Equal(t, maxAgeBefore+1, evictedRuns.Value(evictReasonMaxAge))
+}
+
+// TestRunJanitor checks that the janitor evicts runs in the background until stopped
+func TestRunJanitor(t *testing.T) {
+	defer func(interval time.Duration) { janitorInterval = interval }(janitorInterval)
+	janitorInterval = time.Millisecond
+
+	s := NewStore()
+	s.AddOrUpdateWorkflowRun(1, &models.WorkflowRun{RunID: github.Int64(1), Status: github.String("completed")})
+
+	cfg := &config.Config{MemoryTTLTime: time.Nanosecond, MaxRunAgeTime: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunJanitor(ctx, s, cfg)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { _, exists := s.GetWorkflowRun(1); return !exists }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
@@ -0,0 +1,354 @@
+// internal/store/index.go
+// secondary indexes of runs and jobs, so queries by field don't scan every object
+
+package store
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// indexBucket is the width of the time buckets runs and jobs are indexed by
+const indexBucket = time.Hour
+
+// indexField is a field of runs or jobs with an index
+type indexField uint8
+
+const (
+	fieldRepository indexField = iota
+	fieldWorkflow              // Runs only, jobs are found through their runs
+	fieldStatus
+	fieldConclusion
+	fieldBranch
+	fieldRunner // Jobs only
+	fieldLabel  // Jobs only, a job is indexed under every label of its runner
+	fieldBucket // Start of the time bucket of the last update, Unix seconds
+)
+
+// indexKey is a value of an indexed field
+type indexKey struct {
+	field indexField
+	value string
+}
+
+// index maps the values of the fields to the IDs of the objects having them.
+// keys keeps what every object is indexed under, so an object is removed exactly
+// even when it has changed since.
+type index struct {
+	ids  map[indexField]map[string]map[int64]struct{}
+	keys map[int64][]indexKey
+}
+
+func newIndex() *index {
+	return &index{
+		ids:  make(map[indexField]map[string]map[int64]struct{}),
+		keys: make(map[int64][]indexKey),
+	}
+}
+
+// set indexes the object under keys instead of its previous ones
+func (x *index) set(id int64, keys []indexKey) {
+	x.remove(id)
+	for _, key := range keys {
+		values, exists := x.ids[key.field]
+		if !exists {
+			values = make(map[string]map[int64]struct{})
+			x.ids[key.field] = values
+		}
+		if values[key.value] == nil {
+			values[key.value] = make(map[int64]struct{})
+		}
+		values[key.value][id] = struct{}{}
+	}
+	x.keys[id] = keys
+}
+
+// remove drops the object from the index
+func (x *index) remove(id int64) {
+	for _, key := range x.keys[id] {
+		values := x.ids[key.field]
+		delete(values[key.value], id)
+		if len(values[key.value]) == 0 {
+			delete(values, key.value)
+		}
+	}
+	delete(x.keys, id)
+}
+
+// lookup returns the objects with the value of the field, the set must not be modified
+func (x *index) lookup(field indexField, value string) map[int64]struct{} {
+	return x.ids[field][value]
+}
+
+// between returns the objects updated in the buckets overlapping [since, until),
+// a zero until means no upper bound
+func (x *index) between(since, until time.Time) map[int64]struct{} {
+	result := make(map[int64]struct{})
+	for value, ids := range x.ids[fieldBucket] {
+		start, _ := strconv.ParseInt(value, 10, 64)
+		bucket := time.Unix(start, 0)
+		if bucket.Add(indexBucket).After(since) && (until.IsZero() || bucket.Before(until)) {
+			for id := range ids {
+				result[id] = struct{}{}
+			}
+		}
+	}
+	return result
+}
+
+// RunFilter selects workflow runs by indexed fields. Zero fields match any value.
+type RunFilter struct {
+	RepositoryID int64
+	WorkflowID   int64
+	Status       string
+	Conclusion   string
+	HeadBranch   string
+	Since        time.Time // Last update at or after Since
+	Until        time.Time // Last update before Until
+}
+
+// JobFilter selects jobs by indexed fields. Zero fields match any value.
+type JobFilter struct {
+	RepositoryID int64
+	WorkflowID   int64 // Workflow of the run of the job
+	Status       string
+	Conclusion   string
+	HeadBranch   string
+	RunnerName   string
+	RunnerLabel  string    // One of the labels of the runner
+	Since        time.Time // Last update at or after Since
+	Until        time.Time // Last update before Until
+}
+
+// runIndexKeys returns the keys the run is indexed under
+func runIndexKeys(run *models.WorkflowRun) []indexKey {
+	keys := make([]indexKey, 0, 6)
+	keys = appendKey(keys, fieldRepository, formatID(run.GetRepositoryID()))
+	keys = appendKey(keys, fieldWorkflow, formatID(run.GetWorkflowID()))
+	keys = appendKey(keys, fieldStatus, run.GetStatus())
+	keys = appendKey(keys, fieldConclusion, run.GetConclusion())
+	keys = appendKey(keys, fieldBranch, run.GetHeadBranch())
+	return appendKey(keys, fieldBucket, formatBucket(runUpdatedAt(run)))
+}
+
+// jobIndexKeys returns the keys the job is indexed under
+func jobIndexKeys(job *models.Job) []indexKey {
+	keys := make([]indexKey, 0, 6+len(job.Labels))
+	keys = appendKey(keys, fieldRepository, formatID(job.GetRepositoryID()))
+	keys = appendKey(keys, fieldStatus, job.GetStatus())
+	keys = appendKey(keys, fieldConclusion, job.GetConclusion())
+	keys = appendKey(keys, fieldBranch, job.GetHeadBranch())
+	keys = appendKey(keys, fieldRunner, job.GetRunnerName())
+	for _, label := range job.Labels {
+		keys = appendKey(keys, fieldLabel, label)
+	}
+	return appendKey(keys, fieldBucket, formatBucket(jobUpdatedAt(job)))
+}
+
+// appendKey adds the key unless the value is unknown
+func appendKey(keys []indexKey, field indexField, value string) []indexKey {
+	if value == "" {
+		return keys
+	}
+	return append(keys, indexKey{field, value})
+}
+
+func formatID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+func formatBucket(at *time.Time) string {
+	if at == nil || at.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(at.Truncate(indexBucket).Unix(), 10)
+}
+
+// runUpdatedAt returns the time of the last known update of the run
+func runUpdatedAt(run *models.WorkflowRun) *time.Time {
+	return firstSet(run.UpdatedAt, run.RunStartedAt, run.CreatedAt)
+}
+
+// matchRun reports whether the run matches every field of the filter
+func matchRun(f RunFilter, run *models.WorkflowRun) bool {
+	return matchID(f.RepositoryID, run.GetRepositoryID()) &&
+		matchID(f.WorkflowID, run.GetWorkflowID()) &&
+		matchValue(f.Status, run.GetStatus()) &&
+		matchValue(f.Conclusion, run.GetConclusion()) &&
+		matchValue(f.HeadBranch, run.GetHeadBranch()) &&
+		matchTime(f.Since, f.Until, runUpdatedAt(run))
+}
+
+// matchJob reports whether the job of run matches every field of the filter, run may be nil
+func matchJob(f JobFilter, job *models.Job, run *models.WorkflowRun) bool {
+	if f.RunnerLabel != "" && !hasLabel(job, f.RunnerLabel) {
+		return false
+	}
+	return matchID(f.RepositoryID, job.GetRepositoryID()) &&
+		matchID(f.WorkflowID, run.GetWorkflowID()) &&
+		matchValue(f.Status, job.GetStatus()) &&
+		matchValue(f.Conclusion, job.GetConclusion()) &&
+		matchValue(f.HeadBranch, job.GetHeadBranch()) &&
+		matchValue(f.RunnerName, job.GetRunnerName()) &&
+		matchTime(f.Since, f.Until, jobUpdatedAt(job))
+}
+
+func matchID(want, id int64) bool {
+	return want == 0 || want == id
+}
+
+func matchValue(want, value string) bool {
+	return want == "" || want == value
+}
+
+// matchTime reports whether at is within [since, until), unknown times only match an open range
+func matchTime(since, until time.Time, at *time.Time) bool {
+	if since.IsZero() && until.IsZero() {
+		return true
+	}
+	if at == nil {
+		return false
+	}
+	return !at.Before(since) && (until.IsZero() || at.Before(until))
+}
+
+func hasLabel(job *models.Job, label string) bool {
+	for _, l := range job.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// smallest returns the smallest of the candidate sets, false if there are none
+func smallest(sets []map[int64]struct{}) (map[int64]struct{}, bool) {
+	if len(sets) == 0 {
+		return nil, false
+	}
+	best := sets[0]
+	for _, set := range sets[1:] {
+		if len(set) < len(best) {
+			best = set
+		}
+	}
+	return best, true
+}
+
+// runCandidates returns the runs that may match the filter, taken from the smallest
+// index set of the filter's fields, false if the filter has no indexed fields and
+// every run has to be checked
+func runCandidates(runs *index, f RunFilter) (map[int64]struct{}, bool) {
+	var sets []map[int64]struct{}
+	for _, key := range []indexKey{
+		{fieldRepository, formatID(f.RepositoryID)},
+		{fieldWorkflow, formatID(f.WorkflowID)},
+		{fieldStatus, f.Status},
+		{fieldConclusion, f.Conclusion},
+		{fieldBranch, f.HeadBranch},
+	} {
+		if key.value != "" {
+			sets = append(sets, runs.lookup(key.field, key.value))
+		}
+	}
+	if !f.Since.IsZero() {
+		sets = append(sets, runs.between(f.Since, f.Until))
+	}
+	return smallest(sets)
+}
+
+// jobCandidates returns the jobs that may match the filter, see runCandidates.
+// Jobs don't know their workflow, it's taken from the runs: runJobs returns the jobs of a run.
+func jobCandidates(jobs, runs *index, f JobFilter, runJobs func(runID int64) []int64) (map[int64]struct{}, bool) {
+	var sets []map[int64]struct{}
+	for _, key := range []indexKey{
+		{fieldRepository, formatID(f.RepositoryID)},
+		{fieldStatus, f.Status},
+		{fieldConclusion, f.Conclusion},
+		{fieldBranch, f.HeadBranch},
+		{fieldRunner, f.RunnerName},
+		{fieldLabel, f.RunnerLabel},
+	} {
+		if key.value != "" {
+			sets = append(sets, jobs.lookup(key.field, key.value))
+		}
+	}
+	if f.WorkflowID != 0 {
+		workflowJobs := make(map[int64]struct{})
+		for runID := range runs.lookup(fieldWorkflow, formatID(f.WorkflowID)) {
+			for _, jobID := range runJobs(runID) {
+				workflowJobs[jobID] = struct{}{}
+			}
+		}
+		sets = append(sets, workflowJobs)
+	}
+	if !f.Since.IsZero() {
+		sets = append(sets, jobs.between(f.Since, f.Until))
+	}
+	return smallest(sets)
+}
+
+// runJobIDs returns the IDs of the jobs of the run in the shard. Caller holds sh.mu.
+func (sh *shard) runJobIDs(runID int64) []int64 {
+	jobIDs := make([]int64, 0, len(sh.runs[runID].GetJobs()))
+	for jobID := range sh.runs[runID].GetJobs() {
+		jobIDs = append(jobIDs, jobID)
+	}
+	return jobIDs
+}
+
+// FindRuns возвращает запуски, подходящие под фильтр, отсортированные по ID.
+// Кандидаты берутся из индексов, поэтому запрос не обходит все запуски.
+func (s *Store) FindRuns(f RunFilter) []*models.WorkflowRun {
+	var runs []*models.WorkflowRun
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		if candidates, indexed := runCandidates(sh.runIndex, f); indexed {
+			for runID := range candidates {
+				if run := sh.runs[runID]; matchRun(f, run) {
+					runs = append(runs, cloneRun(run))
+				}
+			}
+		} else {
+			for _, run := range sh.runs {
+				if matchRun(f, run) {
+					runs = append(runs, cloneRun(run))
+				}
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].GetRunID() < runs[j].GetRunID() })
+	return runs
+}
+
+// FindJobs возвращает джобы, подходящие под фильтр, отсортированные по попытке и ID.
+// Кандидаты берутся из индексов, см. FindRuns.
+func (s *Store) FindJobs(f JobFilter) []*models.Job {
+	var jobs []*models.Job
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		if candidates, indexed := jobCandidates(sh.jobIndex, sh.runIndex, f, sh.runJobIDs); indexed {
+			for jobID := range candidates {
+				if job := sh.jobs[jobID]; matchJob(f, job, sh.runs[job.GetRunID()]) {
+					jobs = append(jobs, job)
+				}
+			}
+		} else {
+			for _, job := range sh.jobs {
+				if matchJob(f, job, sh.runs[job.GetRunID()]) {
+					jobs = append(jobs, job)
+				}
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	sortJobs(jobs)
+	return jobs
+}
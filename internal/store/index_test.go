@@ -0,0 +1,137 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func indexedJob(jobID, runID int64, status, runner string, at time.Time, labels ...string) *models.Job {
+	job := &github.WorkflowJob{
+		ID:         github.Int64(jobID),
+		RunID:      github.Int64(runID),
+		Status:     github.String(status),
+		HeadBranch: github.String("main"),
+		Labels:     labels,
+		CreatedAt:  &github.Timestamp{Time: at},
+	}
+	if runner != "" {
+		job.RunnerName = github.String(runner)
+		job.StartedAt = &github.Timestamp{Time: at}
+	}
+	return models.NewJob(job, 1)
+}
+
+func jobIDs(jobs []*models.Job) []int64 {
+	ids := []int64{}
+	for _, job := range jobs {
+		ids = append(ids, job.GetID())
+	}
+	return ids
+}
+
+// TestIndexes checks that the indexes follow upserts, restarts and evictions
+func TestIndexes(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		s := NewStore()
+		testIndexes(t, s, func() Backend {
+			restored := NewStore()
+			restored.restore(s.snapshot())
+			return restored
+		})
+	})
+	t.Run("disk", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "store.db")
+		d, err := OpenDiskStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testIndexes(t, d, func() Backend {
+			assert.NoError(t, d.Close())
+			d, err = OpenDiskStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return d
+		})
+		d.Close()
+	})
+}
+
+// testIndexes runs the index queries against s. restart returns the store as it is
+// after a restart, the rest of the test runs against it.
+func testIndexes(t *testing.T, s Backend, restart func() Backend) {
+	now := time.Now()
+	s.AddOrUpdateWorkflowRun(1, models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(1), WorkflowID: github.Int64(10),
+		HeadBranch: github.String("main"), Status: github.String("in_progress"), UpdatedAt: &github.Timestamp{Time: now},
+		Repository: &github.Repository{ID: github.Int64(1)}}))
+	s.AddOrUpdateWorkflowRun(2, models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(2), WorkflowID: github.Int64(20),
+		HeadBranch: github.String("dev"), Status: github.String("completed"), Conclusion: github.String("failure"),
+		UpdatedAt: &github.Timestamp{Time: now.Add(-3 * time.Hour)}, Repository: &github.Repository{ID: github.Int64(1)}}))
+	s.AddOrUpdateJob(11, indexedJob(11, 1, "queued", "", now, "linux", "gpu"))
+	s.AddOrUpdateJob(12, indexedJob(12, 1, "queued", "", now, "linux"))
+	s.AddOrUpdateJob(21, indexedJob(21, 2, "completed", "runner-1", now.Add(-3*time.Hour), "linux"))
+
+	assert.Equal(t, []int64{11, 12}, jobIDs(s.FindJobs(JobFilter{Status: "queued", RunnerLabel: "linux"})))
+	assert.Equal(t, []int64{11}, jobIDs(s.FindJobs(JobFilter{RunnerLabel: "gpu"})))
+	assert.Equal(t, []int64{11, 12}, jobIDs(s.FindJobs(JobFilter{WorkflowID: 10})))
+	assert.Equal(t, []int64{21}, jobIDs(s.FindJobs(JobFilter{RunnerName: "runner-1"})))
+	assert.Equal(t, []int64{11, 12, 21}, jobIDs(s.FindJobs(JobFilter{RepositoryID: 1})))
+	assert.Len(t, s.FindRuns(RunFilter{RepositoryID: 1, Since: now.Add(-time.Hour)}), 1)
+	assert.Len(t, s.FindRuns(RunFilter{Until: now.Add(-time.Hour)}), 1)
+	runs := s.FindRuns(RunFilter{Conclusion: "failure", HeadBranch: "dev"})
+	if assert.Len(t, runs, 1) {
+		assert.Equal(t, int64(2), runs[0].GetRunID())
+		assert.Contains(t, runs[0].Jobs, int64(21))
+	}
+
+	// The job moves from the queued index to the in_progress one
+	s.AddOrUpdateJob(11, indexedJob(11, 1, "in_progress", "runner-2", now, "linux", "gpu"))
+	assert.Equal(t, []int64{12}, jobIDs(s.FindJobs(JobFilter{Status: "queued", RunnerLabel: "linux"})))
+	assert.Equal(t, []int64{11}, jobIDs(s.FindJobs(JobFilter{Status: "in_progress", RunnerName: "runner-2"})))
+
+	// A job without a known run is indexed with its stub run
+	s.AddOrUpdateJob(31, indexedJob(31, 3, "queued", "", now, "macos"))
+	assert.Equal(t, []int64{31}, jobIDs(s.FindJobs(JobFilter{RunnerLabel: "macos"})))
+	assert.Len(t, s.FindRuns(RunFilter{HeadBranch: "main"}), 2)
+
+	w := metrics.NewWriter()
+	s.Collect(w)
+	assert.Contains(t, string(w.Bytes()), `ant_watcher_workflow_jobs_by_runner_label{label="linux",status="queued"} 1`)
+	assert.Contains(t, string(w.Bytes()), `ant_watcher_workflow_jobs_by_runner_label{label="gpu",status="in_progress"} 1`)
+	assert.NotContains(t, string(w.Bytes()), `ant_watcher_workflow_jobs_by_runner_label{label="linux",status="completed"}`)
+	assert.Contains(t, string(w.Bytes()), `ant_watcher_workflow_jobs{repository="",workflow="",branch="dev",event="",status="completed",conclusion=""} 1`)
+
+	// A restarted store is indexed the same way
+	s = restart()
+	assert.Equal(t, []int64{12, 31}, jobIDs(s.FindJobs(JobFilter{Status: "queued"})))
+	assert.Equal(t, []int64{11}, jobIDs(s.FindJobs(JobFilter{RunnerLabel: "gpu"})))
+
+	// Evicted runs leave no index entries behind
+	assert.Equal(t, 1, s.EvictExpired(now.Add(time.Minute), time.Nanosecond, 0))
+	assert.Empty(t, s.FindJobs(JobFilter{RunnerName: "runner-1"}))
+	assert.Empty(t, s.FindRuns(RunFilter{WorkflowID: 20}))
+	assert.True(t, s.DeleteWorkflowRun(1))
+	assert.True(t, s.DeleteWorkflowRun(3))
+	var indexes []*index
+	switch s := s.(type) {
+	case *Store:
+		for _, sh := range s.shards {
+			indexes = append(indexes, sh.runIndex, sh.jobIndex)
+		}
+	case *DiskStore:
+		indexes = append(indexes, s.runIndex, s.jobIndex)
+		assert.Empty(t, s.gauged.runs)
+		assert.Empty(t, s.gauged.jobs)
+	}
+	for _, x := range indexes {
+		assert.Empty(t, x.keys)
+		assert.Empty(t, x.ids[fieldStatus])
+		assert.Empty(t, x.ids[fieldLabel])
+	}
+}
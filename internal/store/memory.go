@@ -0,0 +1,285 @@
+// internal/store/memory.go
+// enforcement of MemoryLimit: completed runs are evicted oldest first while the memory is over the limit
+
+package store
+
+import (
+	"container/heap"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// Rough per-object overhead of a node with its pointer fields and map entries, in bytes.
+// Strings are added by their length.
+const (
+	runOverhead  = 512
+	jobOverhead  = 640
+	stepOverhead = 192
+)
+
+// cgroupMemory names the files the memory usage of the cgroup is read from: the usage,
+// and the memory.stat key of the inactive page cache counted in it. The kernel reclaims
+// that cache before the cgroup hits its limit, so it isn't memory of the process.
+type cgroupMemory struct {
+	usage, stat, inactiveKey string
+}
+
+// Files with the memory usage of the cgroup of the process, v2 and v1
+var cgroupMemoryFiles = []cgroupMemory{
+	{"/sys/fs/cgroup/memory.current", "/sys/fs/cgroup/memory.stat", "inactive_file"},
+	{"/sys/fs/cgroup/memory/memory.usage_in_bytes", "/sys/fs/cgroup/memory/memory.stat", "total_inactive_file"},
+}
+
+// readMemoryUsage returns the current memory usage in bytes, replaced in tests
+var readMemoryUsage = memoryUsage
+
+// memoryUsage returns the larger of the memory obtained by the Go runtime and the usage
+// of the cgroup the process runs in, so the limit also covers the rest of the container
+func memoryUsage() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	usage := stats.Sys - stats.HeapReleased
+
+	if value, ok := cgroupUsage(); ok && value > usage {
+		usage = value
+	}
+	return usage
+}
+
+// cgroupUsage returns the memory usage of the cgroup without the inactive page cache,
+// the same working set the OOM killer and the container runtimes look at
+func cgroupUsage() (uint64, bool) {
+	for _, files := range cgroupMemoryFiles {
+		data, err := os.ReadFile(files.usage)
+		if err != nil {
+			continue
+		}
+		usage, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			continue
+		}
+		if inactive, ok := memoryStat(files.stat, files.inactiveKey); ok {
+			if inactive > usage {
+				inactive = usage
+			}
+			usage -= inactive
+		}
+		return usage, true
+	}
+	return 0, false
+}
+
+// memoryStat returns the value of key from a memory.stat file of "key value" lines
+func memoryStat(path, key string) (uint64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, found := strings.Cut(line, " ")
+		if !found || name != key {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// runAge is an entry of the eviction queue
+type runAge struct {
+	runID  int64
+	at     time.Time // Last update of the run
+	pushed bool      // Confirmed by the push target, nothing is lost when it goes
+	index  int       // Position in the heap, maintained by runAges
+}
+
+// evictsBefore reports whether a is evicted for memory before b: pushed runs go first, then the oldest
+func (a *runAge) evictsBefore(b *runAge) bool {
+	if a.pushed != b.pushed {
+		return a.pushed
+	}
+	return a.at.Before(b.at)
+}
+
+// runAges is a min-heap of completed runs, pushed ones first, by the time of their last update
+type runAges []*runAge
+
+func (h runAges) Len() int           { return len(h) }
+func (h runAges) Less(i, j int) bool { return h[i].evictsBefore(h[j]) }
+func (h runAges) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *runAges) Push(x any) {
+	entry := x.(*runAge)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+func (h *runAges) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// track updates the approximate size of the run subtree and its place in the eviction queue.
+// Only completed runs are queued, unfinished ones are never evicted for memory. Caller holds sh.mu.
+func (sh *shard) track(runID int64) {
+	run, exists := sh.runs[runID]
+	if !exists {
+		return
+	}
+	size := runSize(run)
+	sh.approxBytes += size - sh.sizes[runID]
+	sh.sizes[runID] = size
+
+	entry, queued := sh.ageIndex[runID]
+	if !IsCompleted(run.GetStatus()) {
+		if queued {
+			heap.Remove(&sh.ages, entry.index)
+			delete(sh.ageIndex, runID)
+		}
+		return
+	}
+	at := sh.touched[runID].Last
+	_, pushed := sh.pushed[runID]
+	if queued {
+		entry.at, entry.pushed = at, pushed
+		heap.Fix(&sh.ages, entry.index)
+		return
+	}
+	entry = &runAge{runID: runID, at: at, pushed: pushed}
+	heap.Push(&sh.ages, entry)
+	sh.ageIndex[runID] = entry
+}
+
+// untrack forgets the size and the queue entry of an evicted run. Caller holds sh.mu.
+func (sh *shard) untrack(runID int64) {
+	sh.approxBytes -= sh.sizes[runID]
+	delete(sh.sizes, runID)
+	if entry, queued := sh.ageIndex[runID]; queued {
+		heap.Remove(&sh.ages, entry.index)
+		delete(sh.ageIndex, runID)
+	}
+}
+
+// EnforceMemoryLimit evicts completed runs while the memory usage is over limit,
+// the ones confirmed by the push target first, then the oldest.
+// The usage is not re-read after every eviction: the approximate sizes of the evicted
+// runs are subtracted instead. A zero limit turns the check off. Returns the number of evicted runs.
+func (s *Store) EnforceMemoryLimit(limit uint64) int {
+	if limit == 0 {
+		return 0
+	}
+	usage := readMemoryUsage()
+	if usage <= limit {
+		return 0
+	}
+
+	excess := int64(usage - limit)
+	evicted := 0
+	for excess > 0 {
+		sh := s.oldestShard()
+		if sh == nil {
+			break
+		}
+		// The shard is locked again, its oldest run may have changed in between
+		sh.mu.Lock()
+		if sh.ages.Len() > 0 {
+			runID := sh.ages[0].runID
+			excess -= sh.sizes[runID]
+			logger.Warningf("WorkflowRun with ID: %d evicted to free memory, usage %d bytes is over the limit of %d bytes", runID, usage, limit)
+			s.evictRun(sh, runID, evictReasonMemory)
+			evicted++
+		}
+		sh.mu.Unlock()
+	}
+
+	if excess > 0 {
+		logger.Errorf("Memory usage %d bytes is over the limit of %d bytes, but no completed runs are left to evict (%d unfinished runs in memory)",
+			usage, limit, s.runCount())
+	}
+	if evicted > 0 {
+		// Return the freed memory now, otherwise the next check sees the old usage and evicts again
+		debug.FreeOSMemory()
+	}
+	return evicted
+}
+
+// oldestShard returns the shard whose completed run is to be evicted next, nil if there are none
+func (s *Store) oldestShard() *shard {
+	var (
+		oldest *shard
+		next   runAge
+	)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		if sh.ages.Len() > 0 && (oldest == nil || sh.ages[0].evictsBefore(&next)) {
+			oldest, next = sh, *sh.ages[0]
+		}
+		sh.mu.RUnlock()
+	}
+	return oldest
+}
+
+// ApproxBytes returns the approximate size of the runs in memory
+func (s *Store) ApproxBytes() int64 {
+	var total int64
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		total += sh.approxBytes
+		sh.mu.RUnlock()
+	}
+	return total
+}
+
+// runCount returns the number of runs in memory
+func (s *Store) runCount() int {
+	count := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		count += len(sh.runs)
+		sh.mu.RUnlock()
+	}
+	return count
+}
+
+// runSize estimates the memory taken by the run with its jobs and steps
+func runSize(run *models.WorkflowRun) int64 {
+	size := int64(runOverhead) + strLen(run.Name, run.Event, run.HeadBranch, run.HeadSHA, run.Status, run.Conclusion)
+	if user := run.TriggeredBy; user != nil {
+		size += strLen(user.Login, user.Name, user.Email)
+	}
+	for _, job := range run.Jobs {
+		size += jobOverhead + strLen(job.Name, job.WorkflowName, job.HeadBranch, job.HeadSHA, job.Status,
+			job.Conclusion, job.RunnerName, job.RunnerOS, job.RunnerGroupName)
+		for _, label := range job.Labels {
+			size += int64(len(label))
+		}
+		for _, step := range job.Steps {
+			size += stepOverhead + strLen(step.Name, step.Status, step.Conclusion)
+		}
+	}
+	return size
+}
+
+// strLen returns the total length of the set strings
+func strLen(values ...*string) int64 {
+	var n int64
+	for _, v := range values {
+		if v != nil {
+			n += int64(len(*v))
+		}
+	}
+	return n
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEnforceMemoryLimit checks that the oldest completed runs are evicted first and unfinished ones are kept
+func TestEnforceMemoryLimit(t *testing.T) {
+	defer func(read func() uint64) { readMemoryUsage = read }(readMemoryUsage)
+
+	s := NewStore()
+	base := time.Now()
+	// Run 1 is the newest, run 4 is the oldest but still in progress
+	for id, age := range map[int64]time.Duration{1: 0, 2: 2 * time.Minute, 3: time.Minute, 4: time.Hour} {
+		status := "completed"
+		if id == 4 {
+			status = "in_progress"
+		}
+		s.AddOrUpdateWorkflowRun(id, &models.WorkflowRun{RunID: github.Int64(id), Status: github.String(status)})
+		s.AddOrUpdateJob(id*10, models.NewJob(&github.WorkflowJob{ID: github.Int64(id * 10), RunID: github.Int64(id),
+			Status: github.String(status), Steps: []*github.TaskStep{{Number: github.Int64(1), Name: github.String("checkout")}}}, 1))
+
+		sh := s.shardOf(id)
+		sh.mu.Lock()
+		sh.touched[id] = Touch{First: base.Add(-age), Last: base.Add(-age)}
+		sh.track(id)
+		sh.mu.Unlock()
+	}
+	runSize := s.shardOf(1).sizes[1]
+	assert.Greater(t, runSize, int64(runOverhead+jobOverhead+stepOverhead))
+	unfinishedSize := s.shardOf(4).sizes[4]
+	assert.Equal(t, 3*runSize+unfinishedSize, s.ApproxBytes())
+
+	// Under the limit or without the limit nothing happens
+	readMemoryUsage = func() uint64 { return 1000 * uint64(runSize) }
+	assert.Equal(t, 0, s.EnforceMemoryLimit(0))
+	assert.Equal(t, 0, s.EnforceMemoryLimit(1000*uint64(runSize)))
+
+	before := evictedRuns.Value(evictReasonMemory)
+	readMemoryUsage = func() uint64 { return 1000*uint64(runSize) + 1 }
+	assert.Equal(t, 1, s.EnforceMemoryLimit(1000*uint64(runSize)))
+	_, exists := s.GetWorkflowRun(2)
+	assert.False(t, exists)
+	_, exists = s.GetJob(20)
+	assert.False(t, exists)
+	assert.Equal(t, before+1, evictedRuns.Value(evictReasonMemory))
+	assert.Equal(t, 2*runSize+unfinishedSize, s.ApproxBytes())
+
+	// A pushed run goes before older ones that weren't pushed
+	s.MarkPushed(1)
+	readMemoryUsage = func() uint64 { return 1000*uint64(runSize) + 1 }
+	assert.Equal(t, 1, s.EnforceMemoryLimit(1000*uint64(runSize)))
+	_, exists = s.GetWorkflowRun(1)
+	assert.False(t, exists)
+	_, exists = s.GetWorkflowRun(3)
+	assert.True(t, exists)
+
+	// Far over the limit all completed runs go, the unfinished one stays
+	readMemoryUsage = func() uint64 { return 2000 * uint64(runSize) }
+	assert.Equal(t, 1, s.EnforceMemoryLimit(1000*uint64(runSize)))
+	_, exists = s.GetWorkflowRun(4)
+	assert.True(t, exists)
+	assert.Equal(t, unfinishedSize, s.ApproxBytes())
+}
+
+// TestCgroupUsage checks that the inactive page cache isn't counted as memory of the process
+func TestCgroupUsage(t *testing.T) {
+	defer func(files []cgroupMemory) { cgroupMemoryFiles = files }(cgroupMemoryFiles)
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	v2 := cgroupMemory{filepath.Join(dir, "memory.current"), filepath.Join(dir, "memory.stat"), "inactive_file"}
+	v1 := cgroupMemory{write("memory.usage_in_bytes", "900\n"), write("v1.stat", "cache 700\ntotal_inactive_file 600\n"), "total_inactive_file"}
+	cgroupMemoryFiles = []cgroupMemory{v2, v1}
+
+	// Without v2 files the v1 ones are read
+	usage, ok := cgroupUsage()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(300), usage)
+
+	write("memory.current", "1000\n")
+	write("memory.stat", "anon 200\nfile 800\nactive_file 100\ninactive_file 700\n")
+	usage, ok = cgroupUsage()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(300), usage, "1000 bytes used, 700 of them reclaimable page cache")
+
+	// Without memory.stat the whole usage counts
+	assert.NoError(t, os.Remove(v2.stat))
+	usage, _ = cgroupUsage()
+	assert.Equal(t, uint64(1000), usage)
+
+	cgroupMemoryFiles = nil
+	_, ok = cgroupUsage()
+	assert.False(t, ok)
+}
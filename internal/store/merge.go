@@ -0,0 +1,221 @@
+// internal/store/merge.go
+// merging of out-of-order updates of runs, jobs and steps
+
+package store
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// GitHub doesn't guarantee the order of deliveries, and the API backfill
+// may return an older state than the last webhook. Instead of replacing
+// stored objects, updates are merged: the more advanced lifecycle state wins,
+// the last update wins within the same state, and fields missing in the
+// winner are taken from the other side.
+
+// statusRank orders lifecycle statuses: requested/queued -> in_progress -> completed
+func statusRank(status string) int {
+	switch status {
+	case "requested", "waiting", "pending", "queued":
+		return 1
+	case "in_progress":
+		return 2
+	case "completed":
+		return 3
+	}
+	return 0
+}
+
+// supersedes reports whether the state next is not older than the state prev
+func supersedes(nextStatus string, nextAt *time.Time, prevStatus string, prevAt *time.Time) bool {
+	if nextRank, prevRank := statusRank(nextStatus), statusRank(prevStatus); nextRank != prevRank {
+		return nextRank > prevRank
+	}
+	if nextAt == nil || prevAt == nil {
+		return true
+	}
+	return !nextAt.Before(*prevAt)
+}
+
+// mergeRun merges an update of a workflow run into the stored one.
+// It returns the object to store and whether the update was newer than the stored state.
+// Neither argument is modified, the jobs of the stored run are kept.
+func mergeRun(prev, next *models.WorkflowRun) (*models.WorkflowRun, bool) {
+	if prev == nil {
+		return next, true
+	}
+
+	// A re-run starts a new attempt, the state of the previous one is not carried over
+	prevAttempt, nextAttempt := prev.GetAttempt(), next.GetAttempt()
+	if prevAttempt != 0 && nextAttempt != 0 && prevAttempt != nextAttempt {
+		winner, loser, applied := next, prev, nextAttempt > prevAttempt
+		if !applied {
+			winner, loser = prev, next
+		}
+		merged := *winner
+		fillRunIdentity(&merged, loser)
+		merged.Jobs = prev.Jobs
+		return &merged, applied
+	}
+
+	winner, loser := next, prev
+	applied := supersedes(next.GetStatus(), next.UpdatedAt, prev.GetStatus(), prev.UpdatedAt)
+	if !applied {
+		winner, loser = prev, next
+	}
+	merged := *winner
+	fillRunIdentity(&merged, loser)
+	fill(&merged.Attempt, loser.Attempt)
+	fill(&merged.RunStartedAt, loser.RunStartedAt)
+	fill(&merged.UpdatedAt, loser.UpdatedAt)
+	if IsCompleted(merged.GetStatus()) {
+		fill(&merged.Conclusion, loser.Conclusion)
+	}
+	merged.Jobs = prev.Jobs
+	return &merged, applied
+}
+
+// fillRunIdentity copies fields that don't change during the run's life
+func fillRunIdentity(dst, src *models.WorkflowRun) {
+	fill(&dst.RepositoryID, src.RepositoryID)
+	fill(&dst.WorkflowID, src.WorkflowID)
+	fill(&dst.Name, src.Name)
+	fill(&dst.RunNumber, src.RunNumber)
+	fill(&dst.Event, src.Event)
+	fill(&dst.HeadBranch, src.HeadBranch)
+	fill(&dst.HeadSHA, src.HeadSHA)
+	fill(&dst.CreatedAt, src.CreatedAt)
+	fill(&dst.TriggeredBy, src.TriggeredBy)
+}
+
+// mergeJob merges an update of a job into the stored one, see mergeRun.
+// Re-runs create new jobs, so there are no attempts to care about.
+func mergeJob(prev, next *models.Job) (*models.Job, bool) {
+	if prev == nil {
+		return next, true
+	}
+
+	winner, loser := next, prev
+	applied := supersedes(next.GetStatus(), jobUpdatedAt(next), prev.GetStatus(), jobUpdatedAt(prev))
+	if !applied {
+		winner, loser = prev, next
+	}
+	merged := *winner
+	fill(&merged.RunID, loser.RunID)
+	fill(&merged.RepositoryID, loser.RepositoryID)
+	fill(&merged.Attempt, loser.Attempt)
+	fill(&merged.Name, loser.Name)
+	fill(&merged.WorkflowName, loser.WorkflowName)
+	fill(&merged.HeadBranch, loser.HeadBranch)
+	fill(&merged.HeadSHA, loser.HeadSHA)
+	fill(&merged.CreatedAt, loser.CreatedAt)
+	if len(merged.Labels) == 0 {
+		merged.Labels = loser.Labels
+	}
+	if isStarted(merged.GetStatus()) {
+		fill(&merged.StartedAt, loser.StartedAt)
+		fill(&merged.RunnerID, loser.RunnerID)
+		fill(&merged.RunnerName, loser.RunnerName)
+		fill(&merged.RunnerOS, loser.RunnerOS)
+		fill(&merged.RunnerGroupID, loser.RunnerGroupID)
+		fill(&merged.RunnerGroupName, loser.RunnerGroupName)
+	}
+	if IsCompleted(merged.GetStatus()) {
+		fill(&merged.CompletedAt, loser.CompletedAt)
+		fill(&merged.Conclusion, loser.Conclusion)
+	}
+	merged.Steps = mergeSteps(prev.Steps, next.Steps)
+	return &merged, applied
+}
+
+// mergeSteps merges two step maps by step number, each step is merged separately
+func mergeSteps(prev, next map[int64]*models.Step) map[int64]*models.Step {
+	if len(prev) == 0 {
+		return next
+	}
+	if len(next) == 0 {
+		return prev
+	}
+
+	merged := make(map[int64]*models.Step, len(prev))
+	for number, step := range prev {
+		merged[number] = step
+	}
+	for number, step := range next {
+		if old, ok := merged[number]; ok {
+			step = mergeStep(old, step)
+		}
+		merged[number] = step
+	}
+	return merged
+}
+
+// mergeStep merges two states of the same step
+func mergeStep(prev, next *models.Step) *models.Step {
+	winner, loser := next, prev
+	if !supersedes(next.GetStatus(), stepUpdatedAt(next), prev.GetStatus(), stepUpdatedAt(prev)) {
+		winner, loser = prev, next
+	}
+	merged := *winner
+	fill(&merged.Name, loser.Name)
+	if isStarted(merged.GetStatus()) {
+		fill(&merged.StartedAt, loser.StartedAt)
+	}
+	if IsCompleted(merged.GetStatus()) {
+		fill(&merged.CompletedAt, loser.CompletedAt)
+		fill(&merged.Conclusion, loser.Conclusion)
+	}
+	return &merged
+}
+
+// jobUpdatedAt returns the latest known timestamp of the job, jobs have no updated_at
+func jobUpdatedAt(job *models.Job) *time.Time {
+	return firstSet(job.CompletedAt, job.StartedAt, job.CreatedAt)
+}
+
+// stepUpdatedAt returns the latest known timestamp of the step
+func stepUpdatedAt(step *models.Step) *time.Time {
+	return firstSet(step.CompletedAt, step.StartedAt)
+}
+
+// firstSet returns the first non-nil timestamp
+func firstSet(timestamps ...*time.Time) *time.Time {
+	for _, ts := range timestamps {
+		if ts != nil {
+			return ts
+		}
+	}
+	return nil
+}
+
+// fill sets *dst to src if the field is not set yet
+func fill[T any](dst **T, src *T) {
+	if *dst == nil {
+		*dst = src
+	}
+}
+
+// mergeNode merges an update of an object without lifecycle, like a repository or
+// a workflow: fields set in next win, the rest, including children, is kept from prev.
+func mergeNode[T any](prev, next *T) *T {
+	if prev == nil {
+		return next
+	}
+	if next == nil {
+		return prev
+	}
+	merged := *next
+	dst, src := reflect.ValueOf(&merged).Elem(), reflect.ValueOf(prev).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		switch field := dst.Field(i); field.Kind() {
+		case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+			if field.IsNil() {
+				field.Set(src.Field(i))
+			}
+		}
+	}
+	return &merged
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func ts(minute int) *time.Time {
+	t := time.Date(2024, 10, 1, 12, minute, 0, 0, time.UTC)
+	return &t
+}
+
+// TestMergeRun checks that the most advanced state of a run is kept whatever the delivery order
+func TestMergeRun(t *testing.T) {
+	queued := &models.WorkflowRun{RunID: github.Int64(1), Name: github.String("CI"), Attempt: github.Int64(1),
+		Status: github.String("queued"), CreatedAt: ts(0), UpdatedAt: ts(0)}
+	inProgress := &models.WorkflowRun{RunID: github.Int64(1), Attempt: github.Int64(1),
+		Status: github.String("in_progress"), RunStartedAt: ts(1), UpdatedAt: ts(1)}
+	completed := &models.WorkflowRun{RunID: github.Int64(1), Attempt: github.Int64(1),
+		Status: github.String("completed"), Conclusion: github.String("success"), UpdatedAt: ts(5)}
+
+	orders := [][]*models.WorkflowRun{
+		{queued, inProgress, completed},
+		{completed, inProgress, queued},
+		{inProgress, completed, queued},
+		{completed, queued, inProgress},
+	}
+	for _, order := range orders {
+		var stored *models.WorkflowRun
+		for _, update := range order {
+			stored, _ = mergeRun(stored, update)
+		}
+		assert.Equal(t, "completed", stored.GetStatus())
+		assert.Equal(t, "success", stored.GetConclusion())
+		assert.Equal(t, "CI", stored.GetName())
+		assert.Equal(t, ts(0), stored.CreatedAt)
+		assert.Equal(t, ts(1), stored.RunStartedAt)
+		assert.Equal(t, ts(5), stored.UpdatedAt)
+	}
+
+	// Inputs are never modified
+	assert.Nil(t, completed.Name)
+
+	// Within the same status the later update wins
+	cancelled := &models.WorkflowRun{RunID: github.Int64(1), Attempt: github.Int64(1),
+		Status: github.String("completed"), Conclusion: github.String("cancelled"), UpdatedAt: ts(4)}
+	stored, applied := mergeRun(completed, cancelled)
+	assert.False(t, applied)
+	assert.Equal(t, "success", stored.GetConclusion())
+
+	// A new attempt resets the state but keeps the identity
+	rerun := &models.WorkflowRun{RunID: github.Int64(1), Attempt: github.Int64(2), Status: github.String("queued"), UpdatedAt: ts(10)}
+	stored, applied = mergeRun(completed, rerun)
+	assert.True(t, applied)
+	assert.Equal(t, "queued", stored.GetStatus())
+	assert.Equal(t, "", stored.GetConclusion())
+	stored, applied = mergeRun(stored, completed)
+	assert.False(t, applied)
+	assert.Equal(t, int64(2), stored.GetAttempt())
+}
+
+// TestMergeJob checks that late job events don't lose the conclusion or step progress
+func TestMergeJob(t *testing.T) {
+	step := func(number int64, status string) *models.Step {
+		return &models.Step{Number: github.Int64(number), Name: github.String("step"), Status: github.String(status)}
+	}
+	queued := &models.Job{ID: github.Int64(7), Name: github.String("build"), Status: github.String("queued"),
+		CreatedAt: ts(0), Labels: []string{"ubuntu-latest"}}
+	inProgress := &models.Job{ID: github.Int64(7), Status: github.String("in_progress"), StartedAt: ts(1),
+		RunnerName: github.String("runner-1"), Steps: map[int64]*models.Step{1: step(1, "completed"), 2: step(2, "in_progress")}}
+	completed := &models.Job{ID: github.Int64(7), Status: github.String("completed"), Conclusion: github.String("failure"),
+		StartedAt: ts(1), CompletedAt: ts(3), Steps: map[int64]*models.Step{1: step(1, "completed"), 2: step(2, "queued"), 3: step(3, "completed")}}
+
+	var stored *models.Job
+	for _, update := range []*models.Job{completed, queued, inProgress} {
+		stored, _ = mergeJob(stored, update)
+	}
+	assert.Equal(t, "completed", stored.GetStatus())
+	assert.Equal(t, "failure", stored.GetConclusion())
+	assert.Equal(t, "build", stored.GetName())
+	assert.Equal(t, "runner-1", stored.GetRunnerName())
+	assert.Equal(t, []string{"ubuntu-latest"}, stored.Labels)
+	assert.Equal(t, ts(0), stored.CreatedAt)
+
+	if assert.Len(t, stored.Steps, 3) {
+		assert.Equal(t, "completed", stored.Steps[1].GetStatus())
+		assert.Equal(t, "in_progress", stored.Steps[2].GetStatus())
+		assert.Equal(t, "completed", stored.Steps[3].GetStatus())
+	}
+}
+
+// TestMergeNode checks that metadata updates keep unknown fields and children
+func TestMergeNode(t *testing.T) {
+	prev := &models.Repository{ID: github.Int64(1), FullName: github.String("org/repo"),
+		Workflows: map[int64]*models.Workflow{2: {ID: github.Int64(2)}}}
+	next := &models.Repository{ID: github.Int64(1), Name: github.String("repo")}
+
+	merged := mergeNode(prev, next)
+	assert.Equal(t, "repo", merged.GetName())
+	assert.Equal(t, "org/repo", merged.GetFullName())
+	assert.Len(t, merged.Workflows, 1)
+	assert.Nil(t, next.FullName)
+}
@@ -0,0 +1,230 @@
+// internal/store/metrics.go
+// metrics rendered from the store contents
+
+package store
+
+import (
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// Labels common for all run, job and step metrics
+var objectLabels = []string{"repository", "workflow", "branch", "event"}
+
+// Counters survive objects being replaced or removed from the store
+var (
+	runsCompleted = metrics.NewCounter("ant_watcher_workflow_runs_completed_total",
+		"Number of workflow runs observed transitioning to completed.",
+		append(objectLabels, "conclusion")...)
+	jobsCompleted = metrics.NewCounter("ant_watcher_workflow_jobs_completed_total",
+		"Number of workflow jobs observed transitioning to completed.",
+		append(objectLabels, "conclusion")...)
+	stepsCompleted = metrics.NewCounter("ant_watcher_workflow_steps_completed_total",
+		"Number of job steps observed transitioning to completed.",
+		append(objectLabels, "conclusion")...)
+)
+
+// Histograms are observed once, when the object reaches the corresponding state.
+// Their bucket layouts come from the configuration, see ConfigureHistograms.
+var (
+	runDuration = metrics.NewHistogram("ant_watcher_workflow_run_duration_seconds",
+		"Duration of completed workflow runs, from run start to the last update.", nil,
+		append(objectLabels, "conclusion")...)
+	jobQueueTime = metrics.NewHistogram("ant_watcher_workflow_job_queue_seconds",
+		"Time workflow jobs spent queued before a runner picked them up.", nil,
+		objectLabels...)
+	jobDuration = metrics.NewHistogram("ant_watcher_workflow_job_duration_seconds",
+		"Execution time of completed workflow jobs.", nil,
+		append(objectLabels, "conclusion")...)
+	stepDuration = metrics.NewHistogram("ant_watcher_workflow_step_duration_seconds",
+		"Execution time of completed job steps.", nil,
+		append(objectLabels, "conclusion")...)
+)
+
+func init() {
+	metrics.Register(runsCompleted, jobsCompleted, stepsCompleted)
+	metrics.Register(runDuration, jobQueueTime, jobDuration, stepDuration)
+}
+
+// ConfigureHistograms applies the bucket layouts from the configuration.
+// Must be called on startup and after every configuration reload.
+func ConfigureHistograms(cfg *config.Config) {
+	runDuration.SetBuckets(cfg.RunDurationBucketsSeconds)
+	jobQueueTime.SetBuckets(cfg.JobQueueBucketsSeconds)
+	jobDuration.SetBuckets(cfg.JobDurationBucketsSeconds)
+	stepDuration.SetBuckets(cfg.StepDurationBucketsSeconds)
+}
+
+// Collect writes gauges describing the objects currently kept in the store
+func (s *Store) Collect(w *metrics.Writer) {
+	gauges := newObjectGauges()
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		gauges.count(shardLabels{s, sh}, sh.runs, sh.jobs)
+		gauges.countRunnerLabelIndex(sh.jobIndex)
+		sh.mu.RUnlock()
+	}
+
+	gauges.collect(w)
+	metrics.NewGaugeFunc("ant_watcher_store_approx_bytes",
+		"Approximate size of the workflow runs in memory with their jobs and steps, used for MemoryLimit.",
+		func() float64 { return float64(s.ApproxBytes()) }).Collect(w)
+}
+
+// labelSource resolves the repository and the run the labels of an object are taken from.
+// Both methods return nil for unknown objects.
+type labelSource interface {
+	repository(repoID int64) *models.Repository
+	workflowRun(runID int64) *models.WorkflowRun
+}
+
+// objectGauges are the gauges of runs, jobs and steps by status and conclusion,
+// built anew for every scrape
+type objectGauges struct {
+	runs, jobs, steps *metrics.Family
+	runnerLabels      *metrics.Family // Unfinished jobs by runner label and status
+}
+
+func newObjectGauges() *objectGauges {
+	statusLabels := append(objectLabels, "status", "conclusion")
+	return &objectGauges{
+		runs: metrics.NewGauge("ant_watcher_workflow_runs",
+			"Number of workflow runs in memory by status and conclusion.", statusLabels...),
+		jobs: metrics.NewGauge("ant_watcher_workflow_jobs",
+			"Number of workflow jobs in memory by status and conclusion.", statusLabels...),
+		steps: metrics.NewGauge("ant_watcher_workflow_steps",
+			"Number of job steps in memory by status and conclusion.", statusLabels...),
+		runnerLabels: metrics.NewGauge("ant_watcher_workflow_jobs_by_runner_label",
+			"Number of unfinished workflow jobs in memory by runner label and status.", "label", "status"),
+	}
+}
+
+// count adds the runs and the jobs with their steps to the gauges
+func (g *objectGauges) count(l labelSource, runs map[int64]*models.WorkflowRun, jobs map[int64]*models.Job) {
+	for _, run := range runs {
+		if run.Status == nil {
+			// Заготовка, созданная по джобу: событие самого запуска ещё не пришло
+			continue
+		}
+		g.runs.Inc(append(runLabels(l, run), run.GetStatus(), run.GetConclusion())...)
+	}
+	for _, job := range jobs {
+		labels := jobLabels(l, job)
+		g.jobs.Inc(append(labels, job.GetStatus(), job.GetConclusion())...)
+		for _, step := range job.Steps {
+			g.steps.Inc(append(labels, step.GetStatus(), step.GetConclusion())...)
+		}
+	}
+}
+
+// countRunnerLabelIndex adds the unfinished jobs to the gauge of runner labels, the
+// jobs of every label and status are counted on the smaller of the two index sets
+func (g *objectGauges) countRunnerLabelIndex(x *index) {
+	for label, labelled := range x.ids[fieldLabel] {
+		for status, withStatus := range x.ids[fieldStatus] {
+			if IsCompleted(status) {
+				continue
+			}
+			small, large := labelled, withStatus
+			if len(large) < len(small) {
+				small, large = large, small
+			}
+			n := 0
+			for id := range small {
+				if _, ok := large[id]; ok {
+					n++
+				}
+			}
+			if n > 0 {
+				g.runnerLabels.Add(float64(n), label, status)
+			}
+		}
+	}
+}
+
+func (g *objectGauges) collect(w *metrics.Writer) {
+	g.runs.Collect(w)
+	g.jobs.Collect(w)
+	g.steps.Collect(w)
+	g.runnerLabels.Collect(w)
+}
+
+// countRunCompletion increments the completion counter if run has just completed
+func countRunCompletion(l labelSource, prev, run *models.WorkflowRun) {
+	if IsCompleted(run.GetStatus()) && (prev == nil || !IsCompleted(prev.GetStatus())) {
+		labels := append(runLabels(l, run), run.GetConclusion())
+		runsCompleted.Inc(labels...)
+
+		startedAt := run.RunStartedAt
+		if startedAt == nil {
+			startedAt = run.CreatedAt
+		}
+		if d, ok := Elapsed(startedAt, run.UpdatedAt); ok {
+			runDuration.Observe(d, labels...)
+		}
+	}
+}
+
+// countJobCompletion increments the job and step completion counters
+func countJobCompletion(l labelSource, prev, job *models.Job) {
+	labels := jobLabels(l, job)
+	if isStarted(job.GetStatus()) && (prev == nil || !isStarted(prev.GetStatus())) {
+		if d, ok := Elapsed(job.CreatedAt, job.StartedAt); ok {
+			jobQueueTime.Observe(d, labels...)
+		}
+	}
+	if IsCompleted(job.GetStatus()) && (prev == nil || !IsCompleted(prev.GetStatus())) {
+		jobsCompleted.Inc(append(labels, job.GetConclusion())...)
+		if d, ok := Elapsed(job.StartedAt, job.CompletedAt); ok {
+			jobDuration.Observe(d, append(labels, job.GetConclusion())...)
+		}
+	}
+
+	for number, step := range job.Steps {
+		old, ok := prev.GetSteps()[number]
+		if IsCompleted(step.GetStatus()) && (!ok || !IsCompleted(old.GetStatus())) {
+			stepsCompleted.Inc(append(labels, step.GetConclusion())...)
+			if d, ok := Elapsed(step.StartedAt, step.CompletedAt); ok {
+				stepDuration.Observe(d, append(labels, step.GetConclusion())...)
+			}
+		}
+	}
+}
+
+// jobLabels returns the labels of the job, taken from its run when the run is known
+func jobLabels(l labelSource, job *models.Job) []string {
+	if run := l.workflowRun(job.GetRunID()); run != nil {
+		return runLabels(l, run)
+	}
+	return []string{l.repository(job.GetRepositoryID()).GetFullName(), job.GetWorkflowName(), job.GetHeadBranch(), ""}
+}
+
+// runLabels returns repository, workflow, branch and event of the run
+func runLabels(l labelSource, run *models.WorkflowRun) []string {
+	return []string{l.repository(run.GetRepositoryID()).GetFullName(), run.GetName(), run.GetHeadBranch(), run.GetEvent()}
+}
+
+// Elapsed returns the seconds between two timestamps, if both are known and ordered
+func Elapsed(from, to *time.Time) (float64, bool) {
+	if from == nil || to == nil || from.IsZero() || to.IsZero() {
+		return 0, false
+	}
+	d := to.Sub(*from)
+	if d < 0 {
+		return 0, false
+	}
+	return d.Seconds(), true
+}
+
+// IsCompleted reports whether the run, job or step has finished
+func IsCompleted(status string) bool {
+	return status == "completed"
+}
+
+// isStarted reports whether a runner has picked the job up
+func isStarted(status string) bool {
+	return status == "in_progress" || status == "completed"
+}
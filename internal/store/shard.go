@@ -0,0 +1,120 @@
+// internal/store/shard.go
+// runs and jobs split into shards by run ID, so deliveries of different runs are stored in parallel
+
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// shardCount is the number of shards of a store created by NewStore
+const shardCount = 64
+
+// Locking: a shard lock may be held while s.Mu is taken, never the other way round,
+// and only one shard is locked at a time. restore is the exception: it locks all
+// shards in order before s.Mu.
+
+// shard keeps the runs whose IDs fall into it together with their jobs and eviction state
+type shard struct {
+	mu      sync.RWMutex
+	runs    map[int64]*models.WorkflowRun // Run ID -> node, the jobs are linked in run.Jobs
+	jobs    map[int64]*models.Job         // Job ID -> node, for the jobs of the runs above
+	pushed  map[int64]time.Time           // Runs confirmed by the push target, candidates for early eviction
+	touched map[int64]Touch               // Local times of the first and last update of each run, used for eviction
+
+	runIndex *index // Secondary indexes of the runs, see index.go
+	jobIndex *index // Secondary indexes of the jobs
+
+	sizes       map[int64]int64   // Approximate size of each run subtree, see memory.go
+	approxBytes int64             // Sum of sizes
+	ages        runAges           // Completed runs, oldest first, evicted when over MemoryLimit
+	ageIndex    map[int64]*runAge // Run ID -> entry of ages
+}
+
+func newShard() *shard {
+	sh := &shard{}
+	sh.reset()
+	return sh
+}
+
+// reset empties the shard. Caller holds sh.mu or owns the shard.
+func (sh *shard) reset() {
+	sh.runs = make(map[int64]*models.WorkflowRun)
+	sh.jobs = make(map[int64]*models.Job)
+	sh.pushed = make(map[int64]time.Time)
+	sh.touched = make(map[int64]Touch)
+	sh.runIndex = newIndex()
+	sh.jobIndex = newIndex()
+	sh.sizes = make(map[int64]int64)
+	sh.approxBytes = 0
+	sh.ages = nil
+	sh.ageIndex = make(map[int64]*runAge)
+}
+
+// shardOf returns the shard keeping the run
+func (s *Store) shardOf(runID int64) *shard {
+	return s.shards[uint64(runID)%uint64(len(s.shards))]
+}
+
+// jobShard returns the shard keeping the job, false if the job is unknown
+func (s *Store) jobShard(jobID int64) (*shard, bool) {
+	runID, exists := s.jobRuns.Load(jobID)
+	if !exists {
+		return nil, false
+	}
+	return s.shardOf(runID.(int64)), true
+}
+
+// touch запоминает время обновления запуска. Caller holds sh.mu.
+func (sh *shard) touch(runID int64) {
+	now := time.Now()
+	t, exists := sh.touched[runID]
+	if !exists {
+		t.First = now
+	}
+	t.Last = now
+	sh.touched[runID] = t
+	sh.track(runID)
+}
+
+// ensureRun возвращает запуск джоба, создавая заготовку из данных джоба, и сообщает,
+// была ли она создана. Caller holds sh.mu.
+func (sh *shard) ensureRun(job *models.Job) (*models.WorkflowRun, bool) {
+	runID := job.GetRunID()
+	run, exists := sh.runs[runID]
+	if !exists {
+		run = stubRun(job)
+		run.Jobs = make(map[int64]*models.Job)
+		sh.runs[runID] = run
+		sh.runIndex.set(runID, runIndexKeys(run))
+	}
+	return run, !exists
+}
+
+// runJobs возвращает джобы запуска. Caller holds sh.mu.
+func (sh *shard) runJobs(runID int64) []*models.Job {
+	jobs := make([]*models.Job, 0, len(sh.runs[runID].GetJobs()))
+	for _, job := range sh.runs[runID].GetJobs() {
+		jobs = append(jobs, job)
+	}
+	sortJobs(jobs)
+	return jobs
+}
+
+// shardLabels resolves the labels of the objects of a shard while its lock is held:
+// runs are read from the shard, repositories under s.Mu
+type shardLabels struct {
+	s  *Store
+	sh *shard
+}
+
+func (l shardLabels) repository(repoID int64) *models.Repository {
+	return l.s.repository(repoID)
+}
+
+func (l shardLabels) workflowRun(runID int64) *models.WorkflowRun {
+	return l.sh.runs[runID]
+}
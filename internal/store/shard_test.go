@@ -0,0 +1,130 @@
+package store
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestShardLocks checks that a locked shard only delays the runs it keeps
+func TestShardLocks(t *testing.T) {
+	s := NewStore()
+	s.AddOrUpdateRepository(1, &models.Repository{ID: github.Int64(1), FullName: github.String("org/app")})
+	s.AddOrUpdateWorkflowRun(1, &models.WorkflowRun{RunID: github.Int64(1), RepositoryID: github.Int64(1),
+		WorkflowID: github.Int64(10), Status: github.String("queued")})
+
+	blocked := s.shardOf(1)
+	assert.NotSame(t, blocked, s.shardOf(2))
+	blocked.mu.Lock()
+
+	// Writes and reads of other runs don't wait for the shard
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.AddOrUpdateWorkflowRun(2, &models.WorkflowRun{RunID: github.Int64(2), RepositoryID: github.Int64(1),
+			WorkflowID: github.Int64(10), Status: github.String("queued")})
+		s.AddOrUpdateJob(21, models.NewJob(&github.WorkflowJob{ID: github.Int64(21), RunID: github.Int64(2), Status: github.String("queued")}, 1))
+		s.GetRunJobs(2)
+		s.IsPushed(2)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("updates of run 2 waited for the shard of run 1")
+	}
+
+	// A job of the locked run waits until the shard is released
+	stored := make(chan struct{})
+	go func() {
+		defer close(stored)
+		s.AddOrUpdateJob(11, models.NewJob(&github.WorkflowJob{ID: github.Int64(11), RunID: github.Int64(1), Status: github.String("queued")}, 1))
+	}()
+	select {
+	case <-stored:
+		t.Fatal("the job of run 1 was stored while its shard was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	blocked.mu.Unlock()
+	<-stored
+
+	assert.Len(t, s.GetWorkflowRuns(10), 2)
+	assert.Len(t, s.GetRepositoryJobs(1, "queued"), 2)
+}
+
+// BenchmarkStoreUpserts compares parallel webhook upserts in a store with a single
+// shard, where every run is behind one lock like before sharding, and with the
+// default number of shards. The get-store variants render the whole store in the
+// background all the time, like a dashboard polling /admin/get-store.
+func BenchmarkStoreUpserts(b *testing.B) {
+	logger.ChangeLogLevel("ERROR")
+	defer logger.ChangeLogLevel("DEBUG")
+
+	for _, shards := range []int{1, shardCount} {
+		for _, reads := range []bool{false, true} {
+			name := fmt.Sprintf("shards=%d", shards)
+			if reads {
+				name += "/get-store"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkUpserts(b, newStore(shards), reads)
+			})
+		}
+	}
+}
+
+func benchmarkUpserts(b *testing.B, s *Store, reads bool) {
+	// A monorepo: one repository and workflow, many runs with jobs and steps
+	const runs, jobsPerRun = 500, 8
+	repo := &github.Repository{ID: github.Int64(1), FullName: github.String("org/monorepo"),
+		Owner: &github.User{ID: github.Int64(5), Login: github.String("org"), Type: github.String("Organization")}}
+	s.AddOrUpdateRepository(1, models.NewRepository(repo))
+
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for reads {
+			select {
+			case <-stop:
+				return
+			default:
+				if _, err := s.MarshalJSON(); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	var seq atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := seq.Add(1)
+			runID := i%runs + 1
+			if i%jobsPerRun == 0 {
+				s.AddOrUpdateOrganization(5, &models.Organization{ID: github.Int64(5), Login: github.String("org")})
+				s.AddOrUpdateWorkflowRun(runID, models.NewWorkflowRun(&github.WorkflowRun{
+					ID: github.Int64(runID), WorkflowID: github.Int64(10), Name: github.String("CI"),
+					Status: github.String("in_progress"), Repository: repo,
+				}))
+				continue
+			}
+			jobID := runID*jobsPerRun + i%jobsPerRun
+			s.AddOrUpdateJob(jobID, models.NewJob(&github.WorkflowJob{
+				ID: github.Int64(jobID), RunID: github.Int64(runID), Name: github.String("build"),
+				Status: github.String("in_progress"),
+				Steps:  []*github.TaskStep{{Number: github.Int64(1), Name: github.String("checkout"), Status: github.String("completed")}},
+			}, 1))
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-readerDone
+}
@@ -0,0 +1,290 @@
+// internal/store/snapshot.go
+// persistent snapshots of the store, so in-flight runs survive restarts
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/Melsoft-Games/ant-watcher/internal/wal"
+)
+
+// snapshotVersion is increased on every incompatible change of the snapshot layout
+const snapshotVersion = 1
+
+// snapshot is the on-disk layout. Nodes are saved flat, without children,
+// and the tree is rebuilt on restore, so objects whose parent is not known
+// yet are kept as well.
+type snapshot struct {
+	Version       int                            `json:"version"`
+	SavedAt       time.Time                      `json:"saved_at"`
+	WALSeq        uint64                         `json:"wal_seq"` // Last record of the write-ahead log applied before the snapshot
+	Users         map[int64]*models.User         `json:"users"`
+	Organizations map[int64]*models.Organization `json:"organizations"`
+	Repositories  map[int64]*models.Repository   `json:"repositories"`
+	Workflows     map[int64]*models.Workflow     `json:"workflows"`
+	WorkflowRuns  map[int64]*models.WorkflowRun  `json:"workflow_runs"`
+	Jobs          map[int64]*models.Job          `json:"jobs"`
+	Pushed        map[int64]time.Time            `json:"pushed"`
+	Touched       map[int64]Touch                `json:"touched"`
+}
+
+// RunSnapshots periodically saves the store to cfg.SnapshotPath until ctx is cancelled,
+// see Checkpoint. log may be nil. The final snapshot on shutdown is written by the caller,
+// after the webhook queue is drained.
+func (s *Store) RunSnapshots(ctx context.Context, cfg *config.Config, log *wal.Log) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.SnapshotPeriod()):
+		}
+
+		if err := s.Checkpoint(cfg.SnapshotPath, log); err != nil {
+			logger.Errorf("Failed to save snapshot: %v", err)
+		}
+	}
+}
+
+// Checkpoint saves the store to path and removes the part of the write-ahead log
+// the snapshot covers. log may be nil when the write-ahead log is off.
+func (s *Store) Checkpoint(path string, log *wal.Log) error {
+	var walSeq uint64
+	if log != nil {
+		// Taken before the copy: everything applied up to walSeq is in the snapshot,
+		// records applied later are replayed once more, which merging makes harmless
+		walSeq = log.Applied()
+	}
+	if err := s.SaveSnapshot(path, walSeq); err != nil {
+		return err
+	}
+	if log != nil {
+		return log.Compact(walSeq)
+	}
+	return nil
+}
+
+// SaveSnapshot atomically writes the store to path: the data goes to a temporary
+// file in the same directory, which then replaces path, so a crash never leaves
+// a partially written snapshot behind. The snapshot is durable when it returns. walSeq is the last record of the write-ahead
+// log applied to the store, it is returned by RestoreSnapshot.
+func (s *Store) SaveSnapshot(path string, walSeq uint64) error {
+	snap := s.snapshot()
+	snap.WALSeq = walSeq
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("could not encode snapshot: %v", err)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("could not create snapshot file: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync snapshot: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close snapshot: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not replace snapshot: %v", err)
+	}
+	// Until the directory is synced, a power loss can undo the rename, while
+	// Checkpoint already removed the part of the write-ahead log it covers
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	logger.Debugf("Snapshot saved to %s (%d bytes)", path, len(data))
+	return nil
+}
+
+// syncDir makes the renames in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open snapshot directory: %v", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync snapshot directory: %v", err)
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces the content of the store with the snapshot at path and
+// returns the last record of the write-ahead log the snapshot covers.
+// A missing file is reported as an error wrapping fs.ErrNotExist.
+func (s *Store) RestoreSnapshot(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("could not decode snapshot %s: %v", path, err)
+	}
+	if snap.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d in %s, expected %d", snap.Version, path, snapshotVersion)
+	}
+
+	s.restore(&snap)
+	logger.Infof("Restored %d workflow runs and %d jobs from the snapshot saved at %s",
+		len(snap.WorkflowRuns), len(snap.Jobs), snap.SavedAt.Format(time.RFC3339))
+	return snap.WALSeq, nil
+}
+
+// snapshot copies the nodes without their children. The shards are copied one
+// at a time after the owners, repositories and workflows, see Checkpoint for why
+// a snapshot that is not atomic across them is enough.
+func (s *Store) snapshot() *snapshot {
+	s.Mu.RLock()
+	snap := &snapshot{
+		Version:       snapshotVersion,
+		SavedAt:       time.Now(),
+		Users:         make(map[int64]*models.User, len(s.Users)),
+		Organizations: make(map[int64]*models.Organization, len(s.Organizations)),
+		Repositories:  make(map[int64]*models.Repository, len(s.Repositories)),
+		Workflows:     make(map[int64]*models.Workflow, len(s.Workflows)),
+		WorkflowRuns:  make(map[int64]*models.WorkflowRun),
+		Jobs:          make(map[int64]*models.Job),
+		Pushed:        make(map[int64]time.Time),
+		Touched:       make(map[int64]Touch),
+	}
+	for userID, user := range s.Users {
+		node := *user
+		node.Repositories = nil
+		snap.Users[userID] = &node
+	}
+	for orgID, org := range s.Organizations {
+		node := *org
+		node.Repositories = nil
+		snap.Organizations[orgID] = &node
+	}
+	for repoID, repo := range s.Repositories {
+		node := *repo
+		node.Workflows = nil
+		snap.Repositories[repoID] = &node
+	}
+	for workflowID, workflow := range s.Workflows {
+		node := *workflow
+		snap.Workflows[workflowID] = &node
+	}
+	s.Mu.RUnlock()
+
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for runID, run := range sh.runs {
+			node := *run
+			node.Jobs = nil
+			snap.WorkflowRuns[runID] = &node
+		}
+		for jobID, job := range sh.jobs {
+			// Jobs are replaced, not modified, on update, so they can be shared
+			snap.Jobs[jobID] = job
+		}
+		// The maps are read by json.Marshal after the lock is released, copy them too
+		for runID, at := range sh.pushed {
+			snap.Pushed[runID] = at
+		}
+		for runID, t := range sh.touched {
+			snap.Touched[runID] = t
+		}
+		sh.mu.RUnlock()
+	}
+	return snap
+}
+
+// restore rebuilds the store from the snapshot. Completion counters are not
+// incremented: the runs were already counted before the restart.
+func (s *Store) restore(snap *snapshot) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+	}
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	s.Users, s.Organizations = make(map[int64]*models.User), make(map[int64]*models.Organization)
+	s.Repositories, s.Workflows = make(map[int64]*models.Repository), make(map[int64]*models.Workflow)
+	s.workflowRuns = make(relation)
+	for _, sh := range s.shards {
+		sh.reset()
+	}
+	s.jobRuns.Range(func(jobID, _ any) bool {
+		s.jobRuns.Delete(jobID)
+		return true
+	})
+
+	for userID, user := range snap.Users {
+		s.Users[userID] = user
+	}
+	for orgID, org := range snap.Organizations {
+		s.Organizations[orgID] = org
+	}
+	for repoID, repo := range snap.Repositories {
+		s.Repositories[repoID] = repo
+		if owner := s.ensureOwner(repo); owner != nil {
+			repo.Owner = owner
+			owner.GetRepositories()[repoID] = repo
+		}
+	}
+	for workflowID, workflow := range snap.Workflows {
+		s.Workflows[workflowID] = workflow
+		if repoID := workflow.GetRepositoryID(); repoID != 0 {
+			s.ensureRepository(repoID).Workflows[workflowID] = workflow
+		}
+	}
+	for runID, run := range snap.WorkflowRuns {
+		run.Jobs = make(map[int64]*models.Job)
+		sh := s.shardOf(runID)
+		sh.runs[runID] = run
+		sh.runIndex.set(runID, runIndexKeys(run))
+		s.linkRun(runID, run)
+	}
+	for jobID, job := range snap.Jobs {
+		runID := job.GetRunID()
+		if runID == 0 {
+			// Saved by an older version, nothing would ever evict it
+			continue
+		}
+		sh := s.shardOf(runID)
+		sh.jobs[jobID] = job
+		sh.jobIndex.set(jobID, jobIndexKeys(job))
+		s.jobRuns.Store(jobID, runID)
+		run, _ := sh.ensureRun(job)
+		run.Jobs[jobID] = job
+	}
+	for runID, at := range snap.Pushed {
+		s.shardOf(runID).pushed[runID] = at
+	}
+	for runID, t := range snap.Touched {
+		s.shardOf(runID).touched[runID] = t
+	}
+
+	now := time.Now()
+	for _, sh := range s.shards {
+		for runID := range sh.runs {
+			if _, ok := sh.touched[runID]; !ok {
+				sh.touched[runID] = Touch{First: now, Last: now}
+			}
+			sh.track(runID)
+		}
+	}
+}
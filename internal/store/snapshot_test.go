@@ -0,0 +1,89 @@
+package store
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSnapshot checks that the store survives a save and restore with its tree, indexes and eviction state
+func TestSnapshot(t *testing.T) {
+	s := NewStore()
+	org := &github.User{ID: github.Int64(100), Login: github.String("org"), Type: github.String("Organization")}
+	s.AddOrUpdateRepository(1, models.NewRepository(&github.Repository{ID: github.Int64(1), FullName: github.String("org/app"), Owner: org}))
+	s.AddOrUpdateWorkflowRun(1, models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(1), WorkflowID: github.Int64(10),
+		Status: github.String("completed"), Repository: &github.Repository{ID: github.Int64(1)}}))
+	s.AddOrUpdateWorkflowRun(2, models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(2), WorkflowID: github.Int64(10),
+		Status: github.String("in_progress"), Repository: &github.Repository{ID: github.Int64(1)}}))
+	s.AddOrUpdateJob(21, models.NewJob(&github.WorkflowJob{ID: github.Int64(21), RunID: github.Int64(2), Status: github.String("in_progress"),
+		Steps: []*github.TaskStep{{Number: github.Int64(1), Name: github.String("checkout"), Status: github.String("completed")}}}, 1))
+	// A job of a run which is not known yet
+	s.AddOrUpdateJob(31, models.NewJob(&github.WorkflowJob{ID: github.Int64(31), RunID: github.Int64(3), Status: github.String("queued")}, 1))
+	s.MarkPushed(1)
+
+	path := filepath.Join(t.TempDir(), "store.json")
+	assert.NoError(t, s.SaveSnapshot(path, 41))
+	// Saving again replaces the file
+	assert.NoError(t, s.SaveSnapshot(path, 42))
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, entries, 1, "temporary files must not be left behind")
+
+	restored := NewStore()
+	walSeq, err := restored.RestoreSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), walSeq)
+
+	orgNode, _ := restored.GetOrganization(100)
+	if assert.Contains(t, orgNode.Repositories, int64(1)) {
+		assert.Same(t, orgNode, orgNode.Repositories[1].Owner)
+	}
+	assert.Len(t, restored.GetWorkflowRuns(10), 2)
+	assert.Len(t, restored.GetRepositoryJobs(1, ""), 1)
+	run, exists := restored.GetWorkflowRun(3)
+	if assert.True(t, exists, "the stub run of an orphan job must be kept") {
+		assert.Contains(t, run.Jobs, int64(31))
+	}
+	steps := restored.GetJobSteps(21)
+	if assert.Len(t, steps, 1) {
+		assert.Equal(t, "checkout", steps[0].GetName())
+	}
+	assert.True(t, restored.IsPushed(1))
+	restoredTouched := restored.snapshot().Touched
+	for runID, touched := range s.snapshot().Touched {
+		assert.True(t, touched.Last.Equal(restoredTouched[runID].Last))
+	}
+	assert.Equal(t, s.ApproxBytes(), restored.ApproxBytes())
+
+	// Updates keep merging into the restored state
+	restored.AddOrUpdateJob(21, models.NewJob(&github.WorkflowJob{ID: github.Int64(21), RunID: github.Int64(2), Status: github.String("queued")}, 1))
+	job, _ := restored.GetJob(21)
+	assert.Equal(t, "in_progress", job.GetStatus())
+	assert.Len(t, job.Steps, 1)
+}
+
+// TestRestoreSnapshotErrors checks that a missing or foreign snapshot is reported and leaves the store untouched
+func TestRestoreSnapshotErrors(t *testing.T) {
+	s := NewStore()
+	s.AddOrUpdateWorkflowRun(1, &models.WorkflowRun{RunID: github.Int64(1), Status: github.String("queued")})
+	dir := t.TempDir()
+
+	_, err := s.RestoreSnapshot(filepath.Join(dir, "missing.json"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	path := filepath.Join(dir, "future.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version": 999}`), 0o600))
+	_, err = s.RestoreSnapshot(path)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version": 1, "jobs": [`), 0o600))
+	_, err = s.RestoreSnapshot(path)
+	assert.Error(t, err)
+
+	_, exists := s.GetWorkflowRun(1)
+	assert.True(t, exists)
+}
@@ -3,186 +3,630 @@
 package store
 
 import (
+	"encoding/json"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Melsoft-Games/ant-watcher/internal/logger"
-	"github.com/google/go-github/v66/github"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
 )
 
+// Store хранит дерево Organization/User -> Repository -> Workflow -> WorkflowRun -> Job -> Step.
+// Владельцы, репозитории и воркфлоу лежат в плоских мапах под Mu, запуски и джобы
+// разбиты на шарды по ID запуска, у каждого шарда своя блокировка: вебхуки разных
+// запусков сохраняются параллельно. Воркфлоу ссылаются на свои запуски по ID, поддерево
+// собирается при чтении. Объекты, родитель которых ещё неизвестен (например, джоб пришёл
+// раньше своего запуска), есть только в плоских мапах и попадают в дерево, когда приходит родитель.
+// Геттеры возвращают копии узлов с поддеревьями, вызывающий код может читать
+// их без блокировки, пока вебхуки меняют хранилище.
 type Store struct {
-	Mu            sync.RWMutex                   `json:"-"`
-	Users         map[int64]*github.User         `json:"users"`
-	Organizations map[int64]*github.Organization `json:"organizations"`
-	Repositories  map[int64]*github.Repository   `json:"repositories"`
-	Workflows     map[int64]*github.Workflow     `json:"workflows"`
-	WorkflowRuns  map[int64]*github.WorkflowRun  `json:"workflow_runs"`
-	Jobs          map[int64]*github.WorkflowJob  `json:"jobs"`
+	Mu            sync.RWMutex                   // Guards the maps below and workflowRuns, see shard.go for the lock order
+	Users         map[int64]*models.User         // Владельцы личных репозиториев
+	Organizations map[int64]*models.Organization // Корни дерева
+	Repositories  map[int64]*models.Repository   // Index: repository ID -> node
+	Workflows     map[int64]*models.Workflow     // Index: workflow ID -> node
+
+	workflowRuns relation // Workflow ID -> runs attached to it
+	shards       []*shard // Runs and jobs by run ID, see shardOf
+	jobRuns      sync.Map // Job ID -> run ID, for finding the shard of a job
+	changes      Bus      // Subscribers of changes, see events.go
+}
+
+// Touch keeps when the run or any of its jobs was first and last updated
+type Touch struct {
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// RunSnapshot is a workflow run together with its repository and jobs.
+// Run and Repository are copies without children, the jobs are listed in Jobs.
+type RunSnapshot struct {
+	Run        *models.WorkflowRun
+	Repository *models.Repository // nil if the repository is unknown
+	Jobs       []*models.Job
 }
 
 // NewStore инициализирует хранилище
 func NewStore() *Store {
-	return &Store{
-		Users:         make(map[int64]*github.User),
-		Organizations: make(map[int64]*github.Organization),
-		Repositories:  make(map[int64]*github.Repository),
-		Workflows:     make(map[int64]*github.Workflow),
-		WorkflowRuns:  make(map[int64]*github.WorkflowRun),
-		Jobs:          make(map[int64]*github.WorkflowJob),
+	return newStore(shardCount)
+}
+
+// newStore creates a store with the given number of shards
+func newStore(shards int) *Store {
+	s := &Store{
+		Users:         make(map[int64]*models.User),
+		Organizations: make(map[int64]*models.Organization),
+		Repositories:  make(map[int64]*models.Repository),
+		Workflows:     make(map[int64]*models.Workflow),
+		workflowRuns:  make(relation),
+		shards:        make([]*shard, shards),
 	}
+	for i := range s.shards {
+		s.shards[i] = newShard()
+	}
+	return s
 }
 
 // AddOrUpdateUser добавляет или обновляет пользователя
-func (s *Store) AddOrUpdateUser(userID int64, user *github.User) {
+func (s *Store) AddOrUpdateUser(userID int64, user *models.User) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
-	s.Users[userID] = user
+	merged := mergeNode(s.Users[userID], user)
+	s.Users[userID] = merged
+	for _, repo := range merged.Repositories {
+		repo.Owner = merged
+	}
 	logger.Infof("User with ID: %d added/updated", userID)
 }
 
 // AddOrUpdateOrganization добавляет или обновляет организацию
-func (s *Store) AddOrUpdateOrganization(orgID int64, org *github.Organization) {
+func (s *Store) AddOrUpdateOrganization(orgID int64, org *models.Organization) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
-	s.Organizations[orgID] = org
+	merged := mergeNode(s.Organizations[orgID], org)
+	s.Organizations[orgID] = merged
+	// Репозитории ссылаются на владельца, ссылку нужно обновить на новый узел
+	for _, repo := range merged.Repositories {
+		repo.Owner = merged
+	}
 	logger.Infof("Organization with ID: %d added/updated", orgID)
 }
 
-// AddOrUpdateRepository добавляет или обновляет репозиторий
-func (s *Store) AddOrUpdateRepository(repoID int64, repo *github.Repository) {
+// AddOrUpdateRepository добавляет или обновляет репозиторий и привязывает его к владельцу
+func (s *Store) AddOrUpdateRepository(repoID int64, repo *models.Repository) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
-	s.Repositories[repoID] = repo
+	merged := mergeNode(s.Repositories[repoID], repo)
+	s.Repositories[repoID] = merged
+	if owner := s.ensureOwner(merged); owner != nil {
+		merged.Owner = owner
+		owner.GetRepositories()[repoID] = merged
+	}
 	logger.Infof("Repository with ID: %d added/updated", repoID)
 }
 
-// AddOrUpdateWorkflow добавляет или обновляет воркфлоу
-func (s *Store) AddOrUpdateWorkflow(workflowID int64, workflow *github.Workflow) {
+// AddOrUpdateWorkflow добавляет или обновляет воркфлоу и привязывает его к репозиторию
+func (s *Store) AddOrUpdateWorkflow(workflowID int64, workflow *models.Workflow) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
-	s.Workflows[workflowID] = workflow
+	merged := mergeNode(s.Workflows[workflowID], workflow)
+	s.Workflows[workflowID] = merged
+	if repoID := merged.GetRepositoryID(); repoID != 0 {
+		s.ensureRepository(repoID).Workflows[workflowID] = merged
+	}
 	logger.Infof("Workflow with ID: %d added/updated", workflowID)
 }
 
-// AddOrUpdateWorkflowRun добавляет или обновляет запуск воркфлоу
-func (s *Store) AddOrUpdateWorkflowRun(runID int64, run *github.WorkflowRun) {
-	s.Mu.Lock()
-	defer s.Mu.Unlock()
+// AddOrUpdateWorkflowRun добавляет или обновляет запуск воркфлоу и привязывает его к воркфлоу
+func (s *Store) AddOrUpdateWorkflowRun(runID int64, run *models.WorkflowRun) {
+	sh := s.shardOf(runID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	s.WorkflowRuns[runID] = run
+	prev := sh.runs[runID]
+	merged, applied := mergeRun(prev, run)
+	if !applied {
+		logger.Debugf("Stale update of WorkflowRun %d (%s), stored state %s is newer", runID, run.GetStatus(), prev.GetStatus())
+	}
+	if merged.Jobs == nil {
+		merged.Jobs = make(map[int64]*models.Job)
+	}
+	countRunCompletion(shardLabels{s, sh}, prev, merged)
+	sh.runs[runID] = merged
+	sh.runIndex.set(runID, runIndexKeys(merged))
+	s.attachRun(runID, merged)
+	sh.touch(runID)
+	if !IsCompleted(merged.GetStatus()) {
+		// A re-run attempt has to be pushed again once it completes
+		delete(sh.pushed, runID)
+	}
+	s.changes.publishRun(prev, merged)
 	logger.Infof("WorkflowRun with ID: %d added/updated", runID)
 }
 
-// AddOrUpdateJob добавляет или обновляет джоб
-func (s *Store) AddOrUpdateJob(jobID int64, job *github.WorkflowJob) {
-	s.Mu.Lock()
-	defer s.Mu.Unlock()
-
-	s.Jobs[jobID] = job
+// AddOrUpdateJob добавляет или обновляет джоб и привязывает его к запуску.
+// Если запуск ещё неизвестен, создаётся его заготовка из данных джоба.
+// Джоб без запуска не сохраняется: его не удалил бы ни TTL, ни лимит памяти.
+func (s *Store) AddOrUpdateJob(jobID int64, job *models.Job) {
+	runID := job.GetRunID()
+	if known, exists := s.jobRuns.Load(jobID); exists && runID == 0 {
+		// Обновление без RunID сливается с джобом там, где он уже лежит
+		runID = known.(int64)
+	}
+	if runID == 0 {
+		logger.Warningf("Job %d has no workflow run, skipping", jobID)
+		return
+	}
+	sh := s.shardOf(runID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	prev := sh.jobs[jobID]
+	merged, applied := mergeJob(prev, job)
+	if !applied {
+		logger.Debugf("Stale update of Job %d (%s), stored state %s is newer", jobID, job.GetStatus(), prev.GetStatus())
+	}
+	countJobCompletion(shardLabels{s, sh}, prev, merged)
+	sh.jobs[jobID] = merged
+	sh.jobIndex.set(jobID, jobIndexKeys(merged))
+	s.jobRuns.Store(jobID, runID)
+	run, created := sh.ensureRun(merged)
+	if created {
+		s.changes.publishRun(nil, run)
+	}
+	run.Jobs[jobID] = merged
+	sh.touch(runID)
+	s.changes.publishJob(prev, merged)
 	logger.Infof("Job with ID: %d added/updated", jobID)
 }
 
 // GetUser возвращает пользователя по его ID
-func (s *Store) GetUser(userID int64) (*github.User, bool) {
+func (s *Store) GetUser(userID int64) (*models.User, bool) {
+	tc := s.newTreeCopy()
 	s.Mu.RLock()
-	defer s.Mu.RUnlock()
-
 	user, exists := s.Users[userID]
-	return user, exists
+	node := tc.user(user)
+	s.Mu.RUnlock()
+
+	tc.fill()
+	return node, exists
 }
 
 // GetOrganization возвращает организацию по её ID
-func (s *Store) GetOrganization(orgID int64) (*github.Organization, bool) {
+func (s *Store) GetOrganization(orgID int64) (*models.Organization, bool) {
+	tc := s.newTreeCopy()
 	s.Mu.RLock()
-	defer s.Mu.RUnlock()
-
 	org, exists := s.Organizations[orgID]
-	return org, exists
+	node := tc.organization(org)
+	s.Mu.RUnlock()
+
+	tc.fill()
+	return node, exists
 }
 
 // GetRepository возвращает репозиторий по его ID
-func (s *Store) GetRepository(repoID int64) (*github.Repository, bool) {
+func (s *Store) GetRepository(repoID int64) (*models.Repository, bool) {
+	tc := s.newTreeCopy()
 	s.Mu.RLock()
-	defer s.Mu.RUnlock()
-
 	repo, exists := s.Repositories[repoID]
-	return repo, exists
+	node := tc.repository(repo)
+	s.Mu.RUnlock()
+
+	tc.fill()
+	return node, exists
 }
 
 // GetWorkflow возвращает воркфлоу по его ID
-func (s *Store) GetWorkflow(workflowID int64) (*github.Workflow, bool) {
+func (s *Store) GetWorkflow(workflowID int64) (*models.Workflow, bool) {
+	tc := s.newTreeCopy()
 	s.Mu.RLock()
-	defer s.Mu.RUnlock()
-
 	workflow, exists := s.Workflows[workflowID]
-	return workflow, exists
+	node := tc.workflow(workflow)
+	s.Mu.RUnlock()
+
+	tc.fill()
+	return node, exists
 }
 
 // GetWorkflowRun возвращает запуск воркфлоу по его ID
-func (s *Store) GetWorkflowRun(runID int64) (*github.WorkflowRun, bool) {
-	s.Mu.RLock()
-	defer s.Mu.RUnlock()
+func (s *Store) GetWorkflowRun(runID int64) (*models.WorkflowRun, bool) {
+	sh := s.shardOf(runID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	run, exists := s.WorkflowRuns[runID]
-	return run, exists
+	run, exists := sh.runs[runID]
+	return cloneRun(run), exists
 }
 
 // GetJob возвращает джоб по его ID
-func (s *Store) GetJob(jobID int64) (*github.WorkflowJob, bool) {
-	s.Mu.RLock()
-	defer s.Mu.RUnlock()
+func (s *Store) GetJob(jobID int64) (*models.Job, bool) {
+	sh, exists := s.jobShard(jobID)
+	if !exists {
+		return nil, false
+	}
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	job, exists := s.Jobs[jobID]
+	job, exists := sh.jobs[jobID]
 	return job, exists
 }
 
+// GetWorkflowRuns возвращает все запуски воркфлоу, отсортированные по ID
+func (s *Store) GetWorkflowRuns(workflowID int64) []*models.WorkflowRun {
+	s.Mu.RLock()
+	runIDs := s.workflowRuns.children(workflowID)
+	s.Mu.RUnlock()
+
+	var runs []*models.WorkflowRun
+	for _, runID := range runIDs {
+		if run, exists := s.GetWorkflowRun(runID); exists {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// GetRepositoryJobs возвращает джобы запусков репозитория с указанным статусом,
+// пустой статус означает все джобы. Обходит только поддерево репозитория.
+func (s *Store) GetRepositoryJobs(repoID int64, status string) []*models.Job {
+	var runIDs []int64
+	s.Mu.RLock()
+	for workflowID := range s.Repositories[repoID].GetWorkflows() {
+		runIDs = append(runIDs, s.workflowRuns.children(workflowID)...)
+	}
+	s.Mu.RUnlock()
+
+	var jobs []*models.Job
+	for _, runID := range runIDs {
+		sh := s.shardOf(runID)
+		sh.mu.RLock()
+		for _, job := range sh.runs[runID].GetJobs() {
+			if status == "" || job.GetStatus() == status {
+				jobs = append(jobs, job)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	sortJobs(jobs)
+	return jobs
+}
+
+// GetRunJobs возвращает все джобы запуска, включая матрицу и все попытки,
+// отсортированные по попытке и ID
+func (s *Store) GetRunJobs(runID int64) []*models.Job {
+	sh := s.shardOf(runID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return sh.runJobs(runID)
+}
+
+// GetJobSteps возвращает шаги джоба, отсортированные по номеру
+func (s *Store) GetJobSteps(jobID int64) []*models.Step {
+	job, _ := s.GetJob(jobID)
+	return SortedSteps(job)
+}
+
 // GetAllRepositories возвращает все репозитории
-func (s *Store) GetAllRepositories() map[int64]*github.Repository {
+func (s *Store) GetAllRepositories() map[int64]*models.Repository {
+	tc := s.newTreeCopy()
 	s.Mu.RLock()
-	defer s.Mu.RUnlock()
+	repos := cloneMap(s.Repositories, tc.repository)
+	s.Mu.RUnlock()
 
-	return s.Repositories
+	tc.fill()
+	return repos
 }
 
 // GetAllWorkflows возвращает все воркфлоу
-func (s *Store) GetAllWorkflows() map[int64]*github.Workflow {
+func (s *Store) GetAllWorkflows() map[int64]*models.Workflow {
+	tc := s.newTreeCopy()
 	s.Mu.RLock()
-	defer s.Mu.RUnlock()
+	workflows := cloneMap(s.Workflows, tc.workflow)
+	s.Mu.RUnlock()
 
-	return s.Workflows
+	tc.fill()
+	return workflows
 }
 
 // GetAllWorkflowRuns возвращает все запуски воркфлоу
-func (s *Store) GetAllWorkflowRuns() map[int64]*github.WorkflowRun {
+func (s *Store) GetAllWorkflowRuns() map[int64]*models.WorkflowRun {
+	runs := make(map[int64]*models.WorkflowRun)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for runID, run := range sh.runs {
+			runs[runID] = cloneRun(run)
+		}
+		sh.mu.RUnlock()
+	}
+	return runs
+}
+
+// GetAllJobs возвращает все джобы
+func (s *Store) GetAllJobs() map[int64]*models.Job {
+	jobs := make(map[int64]*models.Job)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for jobID, job := range sh.jobs {
+			jobs[jobID] = job
+		}
+		sh.mu.RUnlock()
+	}
+	return jobs
+}
+
+// GetAllUsers возвращает всех пользователей
+func (s *Store) GetAllUsers() map[int64]*models.User {
+	tc := s.newTreeCopy()
 	s.Mu.RLock()
-	defer s.Mu.RUnlock()
+	users := cloneMap(s.Users, tc.user)
+	s.Mu.RUnlock()
 
-	return s.WorkflowRuns
+	tc.fill()
+	return users
 }
 
-// GetAllJobs возвращает все джобы
-func (s *Store) GetAllJobs() map[int64]*github.WorkflowJob {
+// GetAllOrganizations возвращает все организации
+func (s *Store) GetAllOrganizations() map[int64]*models.Organization {
+	tc := s.newTreeCopy()
 	s.Mu.RLock()
-	defer s.Mu.RUnlock()
+	orgs := cloneMap(s.Organizations, tc.organization)
+	s.Mu.RUnlock()
 
-	return s.Jobs
+	tc.fill()
+	return orgs
 }
 
-// GetAllUsers возвращает всех пользователей
-func (s *Store) GetAllUsers() map[int64]*github.User {
+// UnpushedRuns возвращает завершённые запуски со всеми завершёнными джобами,
+// которые ещё не были отправлены в систему хранения метрик
+func (s *Store) UnpushedRuns() []RunSnapshot {
+	var result []RunSnapshot
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for runID, run := range sh.runs {
+			if _, pushed := sh.pushed[runID]; pushed || !IsCompleted(run.GetStatus()) {
+				continue
+			}
+			if jobs, finished := pushableJobs(run, sh.runJobs(runID)); finished {
+				result = append(result, s.runSnapshot(run, jobs))
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return result
+}
+
+// MarkPushed отмечает запуски как подтверждённые системой хранения метрик,
+// чтобы их можно было вычистить из памяти раньше TTL
+func (s *Store) MarkPushed(runIDs ...int64) {
+	now := time.Now()
+	for _, runID := range runIDs {
+		sh := s.shardOf(runID)
+		sh.mu.Lock()
+		if _, exists := sh.runs[runID]; exists {
+			sh.pushed[runID] = now
+			sh.track(runID) // Pushed runs are the first to go for memory
+		}
+		sh.mu.Unlock()
+	}
+	logger.Debugf("Marked %d workflow runs as pushed", len(runIDs))
+}
+
+// IsPushed сообщает, был ли запуск подтверждён системой хранения метрик
+func (s *Store) IsPushed(runID int64) bool {
+	sh := s.shardOf(runID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	_, pushed := sh.pushed[runID]
+	return pushed
+}
+
+// DeleteWorkflowRun удаляет запуск вместе с его джобами и шагами
+func (s *Store) DeleteWorkflowRun(runID int64) bool {
+	sh := s.shardOf(runID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	_, deleted := s.deleteRun(sh, runID, reasonDeleted)
+	return deleted
+}
+
+// ForEachRun вызывает fn для каждого запуска в порядке ID, пока fn не вернёт false.
+// fn получает копии и вызывается без блокировок.
+func (s *Store) ForEachRun(fn func(RunSnapshot) bool) {
+	var runIDs []int64
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for runID := range sh.runs {
+			runIDs = append(runIDs, runID)
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(runIDs, func(i, j int) bool { return runIDs[i] < runIDs[j] })
+
+	for _, runID := range runIDs {
+		sh := s.shardOf(runID)
+		sh.mu.RLock()
+		run, exists := sh.runs[runID]
+		var snap RunSnapshot
+		if exists {
+			snap = s.runSnapshot(run, sh.runJobs(runID))
+		}
+		sh.mu.RUnlock()
+
+		// Запуск мог быть удалён после того, как собрали ID
+		if exists && !fn(snap) {
+			return
+		}
+	}
+}
+
+// storeJSON is the layout of the store rendered for the admin endpoint
+type storeJSON struct {
+	Users         map[int64]*models.User         `json:"users"`
+	Organizations map[int64]*models.Organization `json:"organizations"`
+	Pushed        map[int64]time.Time            `json:"pushed"`  // Runs confirmed by the push target, candidates for early eviction
+	Touched       map[int64]Touch                `json:"touched"` // Local times of the first and last update of each run, used for eviction
+}
+
+// MarshalJSON сериализует копию хранилища. Блокировки держатся только на время
+// копирования каждой части, сама сериализация не мешает вебхукам.
+func (s *Store) MarshalJSON() ([]byte, error) {
+	tc := s.newTreeCopy()
+	s.Mu.RLock()
+	view := storeJSON{
+		Users:         cloneMap(s.Users, tc.user),
+		Organizations: cloneMap(s.Organizations, tc.organization),
+		Pushed:        make(map[int64]time.Time),
+		Touched:       make(map[int64]Touch),
+	}
+	s.Mu.RUnlock()
+	tc.fill()
+
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for runID, at := range sh.pushed {
+			view.Pushed[runID] = at
+		}
+		for runID, t := range sh.touched {
+			view.Touched[runID] = t
+		}
+		sh.mu.RUnlock()
+	}
+	return json.Marshal(view)
+}
+
+// Subscribe подписывает на изменения запусков и джобов, см. Bus.Subscribe
+func (s *Store) Subscribe(name string, size int) *Subscription {
+	return s.changes.Subscribe(name, size)
+}
+
+// Close ничего не делает: данные в памяти не требуют освобождения
+func (s *Store) Close() error {
+	return nil
+}
+
+// repository returns the repository the labels of its runs are taken from. Takes s.Mu.
+func (s *Store) repository(repoID int64) *models.Repository {
 	s.Mu.RLock()
 	defer s.Mu.RUnlock()
+	return s.Repositories[repoID]
+}
 
-	return s.Users
+// ensureOwner возвращает владельца репозитория, создавая заготовку, если он ещё неизвестен.
+// Возвращает nil, если владелец не указан. Caller holds s.Mu.
+func (s *Store) ensureOwner(repo *models.Repository) models.Owner {
+	ownerID := repo.GetOwnerID()
+	if ownerID == 0 {
+		return nil
+	}
+	if repo.GetOwnerType() == "User" {
+		user, exists := s.Users[ownerID]
+		if !exists {
+			user = &models.User{ID: repo.OwnerID, Login: repo.OwnerLogin}
+			s.Users[ownerID] = user
+		}
+		if user.Repositories == nil {
+			user.Repositories = make(map[int64]*models.Repository)
+		}
+		return user
+	}
+	org, exists := s.Organizations[ownerID]
+	if !exists {
+		org = &models.Organization{ID: repo.OwnerID, Login: repo.OwnerLogin}
+		s.Organizations[ownerID] = org
+	}
+	if org.Repositories == nil {
+		org.Repositories = make(map[int64]*models.Repository)
+	}
+	return org
 }
 
-// GetAllOrganizations возвращает все организации
-func (s *Store) GetAllOrganizations() map[int64]*github.Organization {
+// ensureRepository возвращает репозиторий, создавая заготовку без владельца. Caller holds s.Mu.
+func (s *Store) ensureRepository(repoID int64) *models.Repository {
+	repo, exists := s.Repositories[repoID]
+	if !exists {
+		repo = &models.Repository{ID: &repoID}
+		s.Repositories[repoID] = repo
+	}
+	if repo.Workflows == nil {
+		repo.Workflows = make(map[int64]*models.Workflow)
+	}
+	return repo
+}
+
+// attachRun привязывает запуск к воркфлоу, если известны репозиторий и воркфлоу.
+// Caller holds the lock of the run's shard, s.Mu is taken only for a run not attached yet.
+func (s *Store) attachRun(runID int64, run *models.WorkflowRun) {
+	repoID, workflowID := run.GetRepositoryID(), run.GetWorkflowID()
+	if repoID == 0 || workflowID == 0 {
+		return
+	}
+	s.Mu.RLock()
+	_, attached := s.workflowRuns[workflowID][runID]
+	s.Mu.RUnlock()
+	if attached {
+		return
+	}
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.linkRun(runID, run)
+}
+
+// linkRun добавляет запуск в воркфлоу, создавая заготовку воркфлоу. Caller holds s.Mu.
+func (s *Store) linkRun(runID int64, run *models.WorkflowRun) {
+	repoID, workflowID := run.GetRepositoryID(), run.GetWorkflowID()
+	if repoID == 0 || workflowID == 0 {
+		return
+	}
+	if _, exists := s.Workflows[workflowID]; !exists {
+		workflow := stubWorkflow(run)
+		s.Workflows[workflowID] = workflow
+		s.ensureRepository(repoID).Workflows[workflowID] = workflow
+	}
+	s.workflowRuns.add(workflowID, runID)
+}
+
+// runSnapshot копирует запуск и его репозиторий без дочерних узлов.
+// Caller holds the lock of the run's shard, takes s.Mu.
+func (s *Store) runSnapshot(run *models.WorkflowRun, jobs []*models.Job) RunSnapshot {
+	node := *run
+	node.Jobs = nil
+	snap := RunSnapshot{Run: &node, Jobs: jobs}
+
 	s.Mu.RLock()
 	defer s.Mu.RUnlock()
+	if repo, exists := s.Repositories[run.GetRepositoryID()]; exists {
+		repoNode := *repo
+		repoNode.Owner, repoNode.Workflows = nil, nil
+		snap.Repository = &repoNode
+	}
+	return snap
+}
 
-	return s.Organizations
+// sortJobs сортирует джобы по попытке и ID
+func sortJobs(jobs []*models.Job) {
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].GetAttempt() != jobs[j].GetAttempt() {
+			return jobs[i].GetAttempt() < jobs[j].GetAttempt()
+		}
+		return jobs[i].GetID() < jobs[j].GetID()
+	})
+}
+
+// SortedSteps возвращает шаги джоба, отсортированные по номеру
+func SortedSteps(job *models.Job) []*models.Step {
+	steps := make([]*models.Step, 0, len(job.GetSteps()))
+	for _, step := range job.GetSteps() {
+		steps = append(steps, step)
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].GetNumber() < steps[j].GetNumber() })
+	return steps
 }
@@ -0,0 +1,264 @@
+package store
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/config"
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+	"github.com/google/go-github/v66/github"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCompletionCounters checks that completion is counted once per transition
+func TestCompletionCounters(t *testing.T) {
+	s := NewStore()
+	repo := &github.Repository{ID: github.Int64(1), FullName: github.String("org/counters")}
+	s.AddOrUpdateRepository(1, models.NewRepository(repo))
+	labels := []string{"org/counters", "CI", "main", "push", "success"}
+
+	run := func(status string) *models.WorkflowRun {
+		return models.NewWorkflowRun(&github.WorkflowRun{
+			ID:         github.Int64(1),
+			Name:       github.String("CI"),
+			HeadBranch: github.String("main"),
+			Event:      github.String("push"),
+			Status:     github.String(status),
+			Conclusion: github.String("success"),
+			Repository: repo,
+		})
+	}
+
+	s.AddOrUpdateWorkflowRun(1, run("in_progress"))
+	assert.Equal(t, float64(0), runsCompleted.Value(labels...))
+	s.AddOrUpdateWorkflowRun(1, run("completed"))
+	assert.Equal(t, float64(1), runsCompleted.Value(labels...))
+	// Redelivery of the same state must not be counted again
+	s.AddOrUpdateWorkflowRun(1, run("completed"))
+	assert.Equal(t, float64(1), runsCompleted.Value(labels...))
+
+	step := &github.TaskStep{Number: github.Int64(1), Status: github.String("completed"), Conclusion: github.String("success")}
+	s.AddOrUpdateJob(7, models.NewJob(&github.WorkflowJob{ID: github.Int64(7), RunID: github.Int64(1), Status: github.String("in_progress"), Steps: []*github.TaskStep{step}}, 0))
+	s.AddOrUpdateJob(7, models.NewJob(&github.WorkflowJob{ID: github.Int64(7), RunID: github.Int64(1), Status: github.String("completed"), Conclusion: github.String("success"), Steps: []*github.TaskStep{step}}, 0))
+	assert.Equal(t, float64(1), jobsCompleted.Value(labels...))
+	assert.Equal(t, float64(1), stepsCompleted.Value(labels...))
+}
+
+// TestDurationHistograms checks that durations are taken from GitHub timestamps
+func TestDurationHistograms(t *testing.T) {
+	ConfigureHistograms(&config.Config{
+		RunDurationBucketsSeconds:  []float64{60, 600},
+		JobQueueBucketsSeconds:     []float64{10, 60},
+		JobDurationBucketsSeconds:  []float64{60, 600},
+		StepDurationBucketsSeconds: []float64{1, 10},
+	})
+
+	s := NewStore()
+	start := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *github.Timestamp { return &github.Timestamp{Time: start.Add(d)} }
+	labels := []string{"org/durations", "CI", "main", "push"}
+	s.AddOrUpdateRepository(2, &models.Repository{ID: github.Int64(2), FullName: github.String("org/durations")})
+
+	s.AddOrUpdateWorkflowRun(2, models.NewWorkflowRun(&github.WorkflowRun{
+		ID:           github.Int64(2),
+		Name:         github.String("CI"),
+		HeadBranch:   github.String("main"),
+		Event:        github.String("push"),
+		Status:       github.String("completed"),
+		Conclusion:   github.String("success"),
+		CreatedAt:    at(0),
+		RunStartedAt: at(0),
+		UpdatedAt:    at(5 * time.Minute),
+		Repository:   &github.Repository{ID: github.Int64(2)},
+	}))
+	assert.Equal(t, uint64(1), runDuration.Count(append(labels, "success")...))
+
+	s.AddOrUpdateJob(20, models.NewJob(&github.WorkflowJob{
+		ID:          github.Int64(20),
+		RunID:       github.Int64(2),
+		Status:      github.String("completed"),
+		Conclusion:  github.String("success"),
+		CreatedAt:   at(0),
+		StartedAt:   at(30 * time.Second),
+		CompletedAt: at(4 * time.Minute),
+		Steps: []*github.TaskStep{
+			{Number: github.Int64(1), Status: github.String("completed"), Conclusion: github.String("success"), StartedAt: at(time.Minute), CompletedAt: at(time.Minute + 2*time.Second)},
+			// Steps without timestamps are counted but not observed
+			{Number: github.Int64(2), Status: github.String("completed"), Conclusion: github.String("success")},
+		},
+	}, 0))
+	assert.Equal(t, uint64(1), jobQueueTime.Count(labels...))
+	assert.Equal(t, uint64(1), jobDuration.Count(append(labels, "success")...))
+	assert.Equal(t, uint64(1), stepDuration.Count(append(labels, "success")...))
+}
+
+// TestStaleUpdates checks that late deliveries don't roll finished objects back
+func TestStaleUpdates(t *testing.T) {
+	s := NewStore()
+	run := func(status string, attempt int) *models.WorkflowRun {
+		return models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(1), Status: github.String(status), RunAttempt: github.Int(attempt)})
+	}
+
+	s.AddOrUpdateWorkflowRun(1, run("completed", 1))
+	s.AddOrUpdateWorkflowRun(1, run("in_progress", 1))
+	stored, _ := s.GetWorkflowRun(1)
+	assert.Equal(t, "completed", stored.GetStatus())
+
+	// A re-run is a new attempt and starts over
+	s.MarkPushed(1)
+	s.AddOrUpdateWorkflowRun(1, run("queued", 2))
+	stored, _ = s.GetWorkflowRun(1)
+	assert.Equal(t, "queued", stored.GetStatus())
+	assert.False(t, s.IsPushed(1))
+
+	s.AddOrUpdateJob(7, models.NewJob(&github.WorkflowJob{ID: github.Int64(7), RunID: github.Int64(1), Status: github.String("completed")}, 0))
+	s.AddOrUpdateJob(7, models.NewJob(&github.WorkflowJob{ID: github.Int64(7), RunID: github.Int64(1), Status: github.String("in_progress")}, 0))
+	job, _ := s.GetJob(7)
+	assert.Equal(t, "completed", job.GetStatus())
+}
+
+// TestRunJobs checks that all jobs of a run are kept and linked to it
+func TestRunJobs(t *testing.T) {
+	s := NewStore()
+	s.AddOrUpdateWorkflowRun(1, models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(1), RunAttempt: github.Int(2), Status: github.String("completed")}))
+
+	job := func(id, attempt int64, status string, steps ...*github.TaskStep) *models.Job {
+		return models.NewJob(&github.WorkflowJob{ID: github.Int64(id), RunID: github.Int64(1), RunAttempt: github.Int64(attempt), Status: github.String(status), Steps: steps}, 0)
+	}
+	// Two matrix legs of the first attempt and one re-run job of the second
+	s.AddOrUpdateJob(12, job(12, 1, "completed"))
+	s.AddOrUpdateJob(11, job(11, 1, "completed"))
+	s.AddOrUpdateJob(21, job(21, 2, "in_progress",
+		&github.TaskStep{Number: github.Int64(2), Status: github.String("in_progress")},
+		&github.TaskStep{Number: github.Int64(1), Status: github.String("completed")}))
+	s.AddOrUpdateJob(30, models.NewJob(&github.WorkflowJob{ID: github.Int64(30), RunID: github.Int64(3), Status: github.String("queued")}, 0))
+
+	var ids []int64
+	for _, j := range s.GetRunJobs(1) {
+		ids = append(ids, j.GetID())
+	}
+	assert.Equal(t, []int64{11, 12, 21}, ids)
+	assert.Empty(t, s.GetRunJobs(2))
+
+	steps := s.GetJobSteps(21)
+	if assert.Len(t, steps, 2) {
+		assert.Equal(t, int64(1), steps[0].GetNumber())
+		assert.Equal(t, "in_progress", steps[1].GetStatus())
+	}
+
+	// Only the jobs of the current attempt are pushed, and only when they are finished
+	assert.Empty(t, s.UnpushedRuns())
+	s.AddOrUpdateJob(21, job(21, 2, "completed"))
+	runs := s.UnpushedRuns()
+	if assert.Len(t, runs, 1) && assert.Len(t, runs[0].Jobs, 1) {
+		assert.Equal(t, int64(21), runs[0].Jobs[0].GetID())
+	}
+	// Steps survive an update without them
+	assert.Len(t, s.GetJobSteps(21), 2)
+}
+
+// TestHierarchy checks that objects are linked into the tree and can be queried by parent
+func TestHierarchy(t *testing.T) {
+	s := NewStore()
+	org := &github.User{ID: github.Int64(100), Login: github.String("org"), Type: github.String("Organization")}
+	user := &github.User{ID: github.Int64(200), Login: github.String("someone"), Type: github.String("User")}
+	s.AddOrUpdateRepository(1, models.NewRepository(&github.Repository{ID: github.Int64(1), FullName: github.String("org/app"), Owner: org}))
+	s.AddOrUpdateRepository(2, models.NewRepository(&github.Repository{ID: github.Int64(2), FullName: github.String("someone/tool"), Owner: user}))
+	s.AddOrUpdateOrganization(100, &models.Organization{ID: github.Int64(100), Name: github.String("The Org")})
+
+	// A job may arrive before its run, it is linked once the run is known
+	s.AddOrUpdateJob(11, models.NewJob(&github.WorkflowJob{ID: github.Int64(11), RunID: github.Int64(1), Status: github.String("in_progress")}, 1))
+	assert.Empty(t, s.GetRepositoryJobs(1, ""))
+
+	run := func(id, workflowID, repoID int64) *models.WorkflowRun {
+		return models.NewWorkflowRun(&github.WorkflowRun{ID: github.Int64(id), WorkflowID: github.Int64(workflowID),
+			Status: github.String("in_progress"), Repository: &github.Repository{ID: github.Int64(repoID)}})
+	}
+	s.AddOrUpdateWorkflowRun(1, run(1, 10, 1))
+	s.AddOrUpdateWorkflowRun(2, run(2, 10, 1))
+	s.AddOrUpdateWorkflowRun(3, run(3, 20, 2))
+	s.AddOrUpdateJob(12, models.NewJob(&github.WorkflowJob{ID: github.Int64(12), RunID: github.Int64(2), Status: github.String("completed")}, 1))
+	s.AddOrUpdateJob(31, models.NewJob(&github.WorkflowJob{ID: github.Int64(31), RunID: github.Int64(3), Status: github.String("in_progress")}, 2))
+
+	orgNode, _ := s.GetOrganization(100)
+	assert.Equal(t, "The Org", *orgNode.Name)
+	assert.Equal(t, "org", *orgNode.Login)
+	if assert.Contains(t, orgNode.Repositories, int64(1)) {
+		assert.Same(t, orgNode, orgNode.Repositories[1].Owner)
+	}
+	userNode, _ := s.GetUser(200)
+	assert.Contains(t, userNode.Repositories, int64(2))
+
+	var runIDs []int64
+	for _, r := range s.GetWorkflowRuns(10) {
+		runIDs = append(runIDs, r.GetRunID())
+	}
+	assert.Equal(t, []int64{1, 2}, runIDs)
+
+	running := s.GetRepositoryJobs(1, "in_progress")
+	if assert.Len(t, running, 1) {
+		assert.Equal(t, int64(11), running[0].GetID())
+	}
+	assert.Len(t, s.GetRepositoryJobs(1, ""), 2)
+
+	// The tree has no cycles and can be dumped
+	_, err := json.Marshal(s)
+	assert.NoError(t, err)
+}
+
+// TestGettersReturnCopies checks that nodes returned by the getters don't change with
+// later updates and can be read while webhooks are applied. Meant to be run with -race.
+func TestGettersReturnCopies(t *testing.T) {
+	s := NewStore()
+	s.AddOrUpdateRepository(1, &models.Repository{ID: github.Int64(1), FullName: github.String("org/copies"),
+		OwnerID: github.Int64(5), OwnerType: github.String("Organization")})
+	run := func(runID int64, status string) *models.WorkflowRun {
+		return &models.WorkflowRun{RunID: github.Int64(runID), RepositoryID: github.Int64(1), WorkflowID: github.Int64(3), Status: github.String(status)}
+	}
+	job := func(jobID, runID int64) *models.Job {
+		return &models.Job{ID: github.Int64(jobID), RunID: github.Int64(runID), Status: github.String("completed")}
+	}
+
+	s.AddOrUpdateWorkflowRun(10, run(10, "queued"))
+	got, _ := s.GetWorkflowRun(10)
+	repos := s.GetAllRepositories()
+	orgs := s.GetAllOrganizations()
+	s.AddOrUpdateJob(100, job(100, 10))
+	assert.Empty(t, got.Jobs)
+	assert.Empty(t, repos[1].Workflows[3].Runs[10].Jobs)
+	assert.Empty(t, orgs[5].Repositories[1].Workflows[3].Runs[10].Jobs)
+	assert.Same(t, orgs[5], orgs[5].Repositories[1].Owner)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := int64(0); i < 200; i++ {
+			s.AddOrUpdateWorkflowRun(10+i%5, run(10+i%5, "completed"))
+			s.AddOrUpdateJob(1000+i, job(1000+i, 10+i%5))
+			s.AddOrUpdateRepository(1, &models.Repository{ID: github.Int64(1), FullName: github.String("org/copies")})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			repo, _ := s.GetRepository(1)
+			workflow, _ := s.GetWorkflow(3)
+			org, _ := s.GetOrganization(5)
+			var pushable []RunSnapshot
+			s.ForEachRun(func(snap RunSnapshot) bool {
+				pushable = append(pushable, snap)
+				return true
+			})
+			for _, v := range []any{s.GetAllOrganizations(), s.GetAllRepositories(), s.GetAllWorkflowRuns(),
+				s.GetWorkflowRuns(3), repo, workflow, org, pushable, s.UnpushedRuns()} {
+				_, err := json.Marshal(v)
+				assert.NoError(t, err)
+			}
+		}
+	}()
+	wg.Wait()
+	assert.Len(t, s.GetWorkflowRuns(3), 5)
+}
@@ -0,0 +1,138 @@
+// internal/store/stream.go
+// admin views of the disk backend written node by node instead of built in memory
+
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/models"
+)
+
+// WriteJSON пишет всё дерево по одному владельцу с его поддеревом за раз.
+// Блокировка на чтение держится, пока поддерево читается с диска, но не пока оно пишется в w.
+func (d *DiskStore) WriteJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("{\n  \"users\": ")
+	if err := d.writeNodes(bw, kindUser, "  ", d.loadUser); err != nil {
+		return err
+	}
+	bw.WriteString(",\n  \"organizations\": ")
+	if err := d.writeNodes(bw, kindOrganization, "  ", d.loadOrganization); err != nil {
+		return err
+	}
+
+	d.mu.RLock()
+	pushed, err := scanKind[time.Time](d.db, kindPushed)
+	touched := make(map[int64]Touch, len(d.touched))
+	for runID, t := range d.touched {
+		touched[runID] = t
+	}
+	d.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, part := range []struct {
+		name  string
+		value any
+	}{{"pushed", pushed}, {"touched", touched}} {
+		data, err := json.MarshalIndent(part.value, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		bw.WriteString(",\n  \"" + part.name + "\": ")
+		bw.Write(data)
+	}
+	bw.WriteString("\n}")
+	return bw.Flush()
+}
+
+// WriteOrganizationsJSON пишет все организации с их поддеревьями по одной
+func (d *DiskStore) WriteOrganizationsJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := d.writeNodes(bw, kindOrganization, "", d.loadOrganization); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// WriteRepositoriesJSON пишет все репозитории с их поддеревьями по одному
+func (d *DiskStore) WriteRepositoriesJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := d.writeNodes(bw, kindRepository, "", func(repoID int64) (any, bool) {
+		repo := d.loadRepository(repoID)
+		return repo, repo != nil
+	}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeNodes writes the nodes of the kind as a JSON object keyed by ID, in the order
+// encoding/json sorts map keys. prefix is the indentation of the line the object starts on.
+// Every node is loaded under the read lock and written after it is released, nodes removed
+// in between are skipped.
+func (d *DiskStore) writeNodes(w *bufio.Writer, kind, prefix string, load func(id int64) (any, bool)) error {
+	d.mu.RLock()
+	ids := d.ids(kind)
+	d.mu.RUnlock()
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = strconv.FormatInt(id, 10)
+	}
+	sort.Strings(keys)
+
+	w.WriteString("{")
+	written := 0
+	for _, key := range keys {
+		id, _ := strconv.ParseInt(key, 10, 64)
+		d.mu.RLock()
+		node, ok := load(id)
+		d.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		data, err := json.MarshalIndent(node, prefix+"  ", "  ")
+		if err != nil {
+			return err
+		}
+		if written > 0 {
+			w.WriteString(",")
+		}
+		w.WriteString("\n" + prefix + "  \"" + key + "\": ")
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		written++
+	}
+	if written > 0 {
+		w.WriteString("\n" + prefix)
+	}
+	w.WriteString("}")
+	return nil
+}
+
+// loadUser returns the user with its repositories. Caller holds d.mu.
+func (d *DiskStore) loadUser(userID int64) (any, bool) {
+	user := loadNode[models.User](d.db, kindUser, userID)
+	if user == nil {
+		return nil, false
+	}
+	user.Repositories = d.ownerRepositories(userID)
+	return user, true
+}
+
+// loadOrganization returns the organization with its repositories. Caller holds d.mu.
+func (d *DiskStore) loadOrganization(orgID int64) (any, bool) {
+	org := loadNode[models.Organization](d.db, kindOrganization, orgID)
+	if org == nil {
+		return nil, false
+	}
+	org.Repositories = d.ownerRepositories(orgID)
+	return org, true
+}
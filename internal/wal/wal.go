@@ -0,0 +1,358 @@
+// internal/wal/wal.go
+// segmented write-ahead log of accepted webhook deliveries
+
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Melsoft-Games/ant-watcher/internal/logger"
+	"github.com/Melsoft-Games/ant-watcher/internal/metrics"
+)
+
+// Record layout: length of data (uint32), CRC-32C of seq and data (uint32), seq (uint64), data.
+// All integers are little endian.
+const headerSize = 16
+
+// segmentExt is the extension of segment files, named by the sequence of their first record
+const segmentExt = ".wal"
+
+// maxRecordSize protects replay from allocating garbage lengths of a damaged header
+const maxRecordSize = 64 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// syncSegment flushes a segment to disk, replaced in tests to make it fail
+var syncSegment = (*os.File).Sync
+
+// errTorn is returned by the reader when a record is incomplete or its checksum doesn't match
+var errTorn = errors.New("torn record")
+
+var (
+	appendedRecords = metrics.NewCounter("ant_watcher_wal_appended_records_total",
+		"Number of records appended to the write-ahead log.")
+	truncatedTails = metrics.NewCounter("ant_watcher_wal_truncated_tails_total",
+		"Number of torn records cut from the end of the write-ahead log on startup.")
+	removedSegments = metrics.NewCounter("ant_watcher_wal_removed_segments_total",
+		"Number of write-ahead log segments removed because a snapshot covers them.")
+)
+
+func init() {
+	metrics.Register(appendedRecords, truncatedTails, removedSegments)
+}
+
+// Log appends records to segment files and fsyncs every record before
+// Append returns. Every record gets a sequence number. The log also tracks
+// which appended records were applied, so a snapshot knows which part of
+// the log it covers, see Applied.
+type Log struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    []uint64 // First sequence of every segment, ascending
+	current     *os.File // Segment open for appending, nil until the first Append
+	currentSize int64
+	lastSeq     uint64              // Sequence of the last appended record
+	pending     map[uint64]struct{} // Appended but not yet applied records
+	broken      error               // Set when a failed record couldn't be cut off, every later Append fails with it
+}
+
+// Open opens the log in dir, creating the directory if needed. A torn record at
+// the end of the last segment, left by a crash in the middle of a write, is cut off.
+// Damage anywhere else is reported as an error.
+func Open(dir string, segmentSize int64) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create WAL directory: %v", err)
+	}
+	l := &Log{
+		dir:         dir,
+		segmentSize: segmentSize,
+		pending:     make(map[uint64]struct{}),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read WAL directory: %v", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, first)
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i] < l.segments[j] })
+
+	for i, first := range l.segments {
+		last := i == len(l.segments)-1
+		lastSeq, size, err := l.scan(first, last)
+		if err != nil {
+			return nil, err
+		}
+		if lastSeq != 0 {
+			l.lastSeq = lastSeq
+		} else if first > 0 {
+			l.lastSeq = first - 1
+		}
+		if last {
+			if l.current, err = os.OpenFile(l.path(first), os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+				return nil, fmt.Errorf("could not open WAL segment: %v", err)
+			}
+			l.currentSize = size
+		}
+	}
+	return l, nil
+}
+
+// scan checks the records of a segment and returns the sequence of its last record and its valid size.
+// A torn tail is truncated if the segment is the last one.
+func (l *Log) scan(first uint64, last bool) (uint64, int64, error) {
+	path := l.path(first)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not open WAL segment: %v", err)
+	}
+	defer f.Close()
+
+	var lastSeq uint64
+	var offset int64
+	for {
+		seq, _, size, err := readRecord(f)
+		if err == io.EOF {
+			return lastSeq, offset, nil
+		}
+		if err != nil {
+			if !last {
+				return 0, 0, fmt.Errorf("WAL segment %s is damaged at offset %d: %v", path, offset, err)
+			}
+			logger.Warningf("Truncating torn record at offset %d of WAL segment %s: %v", offset, path, err)
+			truncatedTails.Inc()
+			if err := os.Truncate(path, offset); err != nil {
+				return 0, 0, fmt.Errorf("could not truncate WAL segment: %v", err)
+			}
+			return lastSeq, offset, nil
+		}
+		lastSeq = seq
+		offset += size
+	}
+}
+
+// Append writes data as the next record, syncs it to disk and returns its sequence.
+// The record stays pending until Done is called with the sequence.
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.broken != nil {
+		return 0, l.broken
+	}
+	seq := l.lastSeq + 1
+	if l.current == nil || l.currentSize >= l.segmentSize {
+		if err := l.rotate(seq); err != nil {
+			return 0, err
+		}
+	}
+
+	record := make([]byte, headerSize+len(data))
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(record[8:], seq)
+	copy(record[headerSize:], data)
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(record[8:], crcTable))
+
+	if _, err := l.current.Write(record); err != nil {
+		l.cut()
+		return 0, fmt.Errorf("could not write WAL record: %v", err)
+	}
+	if err := syncSegment(l.current); err != nil {
+		// The record is in the file but not acknowledged, its sequence is given to the next one
+		l.cut()
+		return 0, fmt.Errorf("could not sync WAL segment: %v", err)
+	}
+	l.currentSize += int64(len(record))
+	l.lastSeq = seq
+	l.pending[seq] = struct{}{}
+	appendedRecords.Inc()
+	return seq, nil
+}
+
+// cut removes a record that failed to be written or synced from the end of the current
+// segment, so the next record doesn't follow garbage or a record with its own sequence.
+// If the segment can't be cut, the log is broken. Caller holds l.mu.
+func (l *Log) cut() {
+	if err := l.current.Truncate(l.currentSize); err != nil {
+		l.broken = fmt.Errorf("WAL segment can't be appended to after a failed record: %v", err)
+		logger.Errorf("%v", l.broken)
+	}
+}
+
+// rotate starts a new segment with the record seq. Caller holds l.mu.
+func (l *Log) rotate(seq uint64) error {
+	f, err := os.OpenFile(l.path(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not create WAL segment: %v", err)
+	}
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		return err
+	}
+	if l.current != nil {
+		l.current.Close()
+	}
+	l.current, l.currentSize = f, 0
+	l.segments = append(l.segments, seq)
+	return nil
+}
+
+// Done marks the record seq as applied
+func (l *Log) Done(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, seq)
+}
+
+// Applied returns the sequence up to which all records are applied.
+// Records found on disk by Open count as applied, Replay has to be called before serving.
+func (l *Log) Applied() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	applied := l.lastSeq
+	for seq := range l.pending {
+		if seq-1 < applied {
+			applied = seq - 1
+		}
+	}
+	return applied
+}
+
+// Compact removes segments whose records all have sequences up to seq.
+// The segment open for appending is never removed.
+func (l *Log) Compact(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	removed := 0
+	for len(l.segments) > 1 && l.segments[1] <= seq+1 {
+		if err := os.Remove(l.path(l.segments[0])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove WAL segment: %v", err)
+		}
+		l.segments = l.segments[1:]
+		removed++
+	}
+	if removed > 0 {
+		removedSegments.Add(float64(removed))
+		logger.Debugf("Removed %d WAL segments covered by the snapshot up to record %d", removed, seq)
+	}
+	return nil
+}
+
+// Replay calls fn for every record with a sequence above after, in order.
+// It must be called before the first Append.
+func (l *Log) Replay(after uint64, fn func(seq uint64, data []byte) error) error {
+	l.mu.Lock()
+	segments := append([]uint64(nil), l.segments...)
+	l.mu.Unlock()
+
+	for i, first := range segments {
+		// Skip segments that end before after, the next one starts not later than after+1
+		if i+1 < len(segments) && segments[i+1] <= after+1 {
+			continue
+		}
+		if err := l.replaySegment(first, after, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Log) replaySegment(first, after uint64, fn func(seq uint64, data []byte) error) error {
+	f, err := os.Open(l.path(first))
+	if err != nil {
+		return fmt.Errorf("could not open WAL segment: %v", err)
+	}
+	defer f.Close()
+
+	for {
+		seq, data, _, err := readRecord(f)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read WAL segment %s: %v", l.path(first), err)
+		}
+		if seq <= after {
+			continue
+		}
+		if err := fn(seq, data); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the segment open for appending
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current == nil {
+		return nil
+	}
+	err := l.current.Close()
+	l.current = nil
+	return err
+}
+
+func (l *Log) path(first uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+// readRecord reads the next record. It returns io.EOF at a clean end of the
+// segment and errTorn if the record is incomplete or damaged.
+func readRecord(r io.Reader) (seq uint64, data []byte, size int64, err error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, 0, io.EOF
+		}
+		return 0, nil, 0, errTorn
+	}
+	length := binary.LittleEndian.Uint32(header[0:])
+	if length > maxRecordSize {
+		return 0, nil, 0, errTorn
+	}
+	data = make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, 0, errTorn
+	}
+	crc := crc32.Update(crc32.Checksum(header[8:], crcTable), crcTable, data)
+	if crc != binary.LittleEndian.Uint32(header[4:]) {
+		return 0, nil, 0, errTorn
+	}
+	return binary.LittleEndian.Uint64(header[8:]), data, int64(headerSize) + int64(length), nil
+}
+
+// syncDir makes the creation of a file in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open WAL directory: %v", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync WAL directory: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func records(t *testing.T, l *Log, after uint64) []string {
+	var got []string
+	assert.NoError(t, l.Replay(after, func(seq uint64, data []byte) error {
+		got = append(got, fmt.Sprintf("%d:%s", seq, data))
+		return nil
+	}))
+	return got
+}
+
+// TestLogReopen checks that records survive reopening and replay starts after the given sequence
+func TestLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 1<<20)
+	assert.NoError(t, err)
+	for _, data := range []string{"a", "b", "c"} {
+		_, err := l.Append([]byte(data))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, l.Close())
+
+	l, err = Open(dir, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1:a", "2:b", "3:c"}, records(t, l, 0))
+	assert.Equal(t, []string{"3:c"}, records(t, l, 2))
+	assert.Equal(t, uint64(3), l.Applied())
+
+	seq, err := l.Append([]byte("d"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), seq)
+	assert.NoError(t, l.Close())
+}
+
+// TestLogTornTail checks that a half-written last record is cut off instead of failing the startup
+func TestLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 1<<20)
+	assert.NoError(t, err)
+	l.Append([]byte("complete"))
+	l.Append([]byte("torn"))
+	assert.NoError(t, l.Close())
+
+	path := l.path(1)
+	info, _ := os.Stat(path)
+	assert.NoError(t, os.Truncate(path, info.Size()-2))
+
+	l, err = Open(dir, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1:complete"}, records(t, l, 0))
+	seq, err := l.Append([]byte("next"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+	assert.NoError(t, l.Close())
+
+	// A flipped byte is detected by the checksum
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	l, err = Open(dir, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1:complete"}, records(t, l, 0))
+	l.Close()
+}
+
+// TestLogSyncFailure checks that a record whose sync failed is cut off, and its sequence is given to the next record
+func TestLogSyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 1<<20)
+	assert.NoError(t, err)
+	_, err = l.Append([]byte("a"))
+	assert.NoError(t, err)
+
+	defer func() { syncSegment = (*os.File).Sync }()
+	syncSegment = func(*os.File) error { return errors.New("input/output error") }
+	_, err = l.Append([]byte("lost"))
+	assert.ErrorContains(t, err, "could not sync WAL segment")
+
+	syncSegment = (*os.File).Sync
+	seq, err := l.Append([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+	seq, err = l.Append([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+	assert.NoError(t, l.Close())
+
+	l, err = Open(dir, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1:a", "2:b", "3:c"}, records(t, l, 0))
+	l.Close()
+}
+
+// TestLogSegments checks rotation, compaction and that damage before the last segment is an error
+func TestLogSegments(t *testing.T) {
+	dir := t.TempDir()
+	// Every record takes a segment of its own
+	l, err := Open(dir, 1)
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		l.Append([]byte{byte('a' + i)})
+	}
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 4)
+
+	assert.NoError(t, l.Compact(2))
+	entries, _ = os.ReadDir(dir)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, []string{"3:c", "4:d"}, records(t, l, 0))
+
+	// The segment open for appending stays
+	assert.NoError(t, l.Compact(10))
+	assert.Equal(t, []string{"4:d"}, records(t, l, 0))
+	l.Append([]byte("e"))
+	assert.NoError(t, l.Close())
+
+	assert.NoError(t, os.Truncate(filepath.Join(dir, fmt.Sprintf("%020d%s", 4, segmentExt)), 3))
+	_, err = Open(dir, 1)
+	assert.Error(t, err)
+}
+
+// TestLogApplied checks that the applied sequence stops before the oldest pending record
+func TestLogApplied(t *testing.T) {
+	l, err := Open(t.TempDir(), 1<<20)
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, uint64(0), l.Applied())
+
+	first, _ := l.Append([]byte("a"))
+	second, _ := l.Append([]byte("b"))
+	assert.Equal(t, uint64(0), l.Applied())
+
+	l.Done(second)
+	assert.Equal(t, uint64(0), l.Applied())
+	l.Done(first)
+	assert.Equal(t, uint64(2), l.Applied())
+}